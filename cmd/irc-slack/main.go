@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/insomniacslk/irc-slack/pkg/ircslack"
 
@@ -29,10 +37,33 @@ var (
 	serverName           = flag.StringP("server", "s", "", "IRC server name (i.e. the host name to send to clients)")
 	chunkSize            = flag.IntP("chunk", "C", 512, "Maximum size of a line to send to the client. Only works for certain reply types")
 	fileDownloadLocation = flag.StringP("download", "d", "", "If set will download attachments to this location")
+	flagDownloadWorkers  = flag.IntP("download-workers", "w", ircslack.DefaultDownloadWorkers, "Number of attachments downloaded concurrently")
+	flagDownloadMaxSize  = flag.Int64P("download-max-size", "m", 0, "Maximum size in bytes of a downloaded attachment. 0 means no limit")
+	flagDownloadQuota    = flag.Int64P("download-quota", "q", 0, "Maximum total size in bytes of the download directory. The least recently used files are removed to stay within it. 0 means no limit")
 	fileProxyPrefix      = flag.StringP("fileprefix", "l", "", "If set will overwrite urls to attachments with this prefix and local file name inside the path set with -d")
+	flagHTTPListen       = flag.StringP("http-listen", "W", "", "If set, serve the files in the download directory over HTTP(S) on this address, e.g. :8080. Requires -d")
+	flagHTTPURL          = flag.StringP("http-url", "U", "", "Public URL of the file server, used in links to files. Defaults to the server name and the port of --http-listen")
+	flagHTTPAuth         = flag.StringP("http-auth", "A", "", "If set, require basic authentication with these user:password credentials to download files")
+	flagHTTPExpiry       = flag.DurationP("http-expiry", "E", ircslack.DefaultFileLinkExpiry, "How long links to downloaded files are valid. 0 means forever")
 	logLevel             = flag.StringP("loglevel", "L", "info", fmt.Sprintf("Log level. One of %v", getLogLevels()))
 	flagSlackDebug       = flag.BoolP("debug", "D", false, "Enable debug logging of the Slack API")
 	flagPagination       = flag.IntP("pagination", "P", 0, "Pagination value for API calls. If 0 or unspecified, use the recommended default (currently 200). Larger values can help on large Slack teams")
+	flagEmoji            = flag.BoolP("emoji", "e", false, "Translate Slack emoji shortcodes to and from Unicode emoji. Clients can override it with SET emoji on|off")
+	flagFormatting       = flag.StringP("formatting", "f", ircslack.FormattingRaw, fmt.Sprintf("How to translate Slack's mrkdwn and IRC formatting. One of %v. Clients can override it with SET formatting", ircslack.FormattingModes()))
+	flagFilePreviews     = flag.StringP("file-previews", "F", ircslack.DefaultFilePreviews, fmt.Sprintf("How shared files are shown, as a comma-separated list of kind=value. Kinds are %v, values are none (URL only), details, or a number of lines of text to show", ircslack.FileKinds()))
+	flagListArchived     = flag.BoolP("list-archived", "a", false, "Include archived channels in LIST replies, with an [archived] prefix in their topic")
+	flagCreateChannels   = flag.BoolP("create-channels", "j", false, "Create the channels that do not exist on JOIN. Names starting with # create public channels, names starting with @ create private channels")
+	flagTopicMode        = flag.StringP("topic", "t", ircslack.TopicModePurpose, fmt.Sprintf("Which Slack channel attribute is shown and set as the IRC topic. One of %v. With both, the topic and the purpose are shown together, and the topic is set", ircslack.TopicModes()))
+	flagAwayMode         = flag.StringP("away", "y", ircslack.AwayModePresence, fmt.Sprintf("What AWAY does on Slack besides setting the presence to away. One of %v. With status, the away message is set as Slack status, with dnd notifications are paused", ircslack.AwayModes()))
+	flagNickPolicy       = flag.StringP("nick", "n", ircslack.NickPolicyUsername, fmt.Sprintf("Which Slack user attribute IRC nicknames are derived from. One of %v", ircslack.NickPolicies()))
+	flagCacheDir         = flag.StringP("cachedir", "K", "", "If set, users and channels are cached in this directory to speed up logins")
+	flagBatchWindow      = flag.DurationP("batch-window", "b", ircslack.DefaultBatchWindow, "How long to wait for more lines before posting them to Slack as a single message. 0 disables batching")
+	flagBatchMaxSize     = flag.IntP("batch-size", "B", ircslack.DefaultBatchMaxSize, "Maximum size in bytes of a batched message")
+	flagSnippetLines     = flag.IntP("snippet-lines", "S", 0, "Upload messages longer than this number of lines as snippets. 0 disables snippets")
+	flagFormatPaste      = flag.BoolP("format-paste", "x", false, "Post the messages that look like pasted code, stack traces or logs as code blocks")
+	flagUploadDir        = flag.StringP("upload-dir", "u", "", "If set, local files in this directory can be shared to Slack with the UPLOAD command")
+	flagUploadURLs       = flag.BoolP("upload-urls", "r", false, "Allow sharing files to Slack from http(s) URLs with the UPLOAD command. Only public addresses are downloaded from")
+	flagShutdownTimeout  = flag.DurationP("shutdown-timeout", "T", 10*time.Second, "How long to wait for clients to be disconnected gracefully on SIGINT or SIGTERM")
 	flagKey              = flag.StringP("key", "k", "", "TLS key for HTTPS server. Requires -cert")
 	flagCert             = flag.StringP("cert", "c", "", "TLS certificate for HTTPS server. Requires -key")
 	flagVersion          = flag.BoolP("version", "v", false, "Print version and exit")
@@ -57,6 +88,16 @@ func getLogLevels() []string {
 	return levels
 }
 
+// checkChoice exits if the value of a flag is not one of the valid ones.
+func checkChoice(name, value string, valid []string) {
+	for _, v := range valid {
+		if value == v {
+			return
+		}
+	}
+	log.Fatalf("Invalid %s '%s'. Valid values are %v", name, value, valid)
+}
+
 func main() {
 	flag.CommandLine.SortFlags = false
 	flag.Parse()
@@ -90,6 +131,17 @@ func main() {
 			log.Fatalf("Missing or invalid download directory: %s", *fileDownloadLocation)
 		}
 	}
+	if *flagHTTPListen != "" && *fileDownloadLocation == "" {
+		log.Fatalf("--http-listen requires a download directory")
+	}
+	checkChoice("formatting mode", *flagFormatting, ircslack.FormattingModes())
+	checkChoice("topic mode", *flagTopicMode, ircslack.TopicModes())
+	checkChoice("away mode", *flagAwayMode, ircslack.AwayModes())
+	checkChoice("nick policy", *flagNickPolicy, ircslack.NickPolicies())
+	filePreviews, err := ircslack.ParseFilePreviews(*flagFilePreviews)
+	if err != nil {
+		log.Fatalf("Invalid file previews '%s': %v", *flagFilePreviews, err)
+	}
 	doTLS := false
 	if *flagKey != "" && *flagCert != "" {
 		doTLS = true
@@ -105,17 +157,125 @@ func main() {
 		}
 		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
+	var (
+		fileServer *ircslack.FileServer
+		httpServer *http.Server
+	)
+	if *flagHTTPListen != "" {
+		fileServer, httpServer = newFileServer(sName, tlsConfig)
+	}
 	server := ircslack.Server{
 		LocalAddr:            &localAddr,
 		Name:                 sName,
 		ChunkSize:            *chunkSize,
+		BatchWindow:          *flagBatchWindow,
+		BatchMaxSize:         *flagBatchMaxSize,
+		SnippetLines:         *flagSnippetLines,
+		FormatPaste:          *flagFormatPaste,
+		UploadDir:            *flagUploadDir,
+		UploadURLs:           *flagUploadURLs,
 		FileDownloadLocation: *fileDownloadLocation,
+		DownloadWorkers:      *flagDownloadWorkers,
+		MaxDownloadSize:      *flagDownloadMaxSize,
+		DownloadQuota:        *flagDownloadQuota,
 		FileProxyPrefix:      *fileProxyPrefix,
+		FileServer:           fileServer,
 		SlackDebug:           *flagSlackDebug,
 		Pagination:           *flagPagination,
+		TranslateEmoji:       *flagEmoji,
+		Formatting:           *flagFormatting,
+		FilePreviews:         filePreviews,
+		ListArchived:         *flagListArchived,
+		CreateChannels:       *flagCreateChannels,
+		TopicMode:            *flagTopicMode,
+		AwayMode:             *flagAwayMode,
+		NickPolicy:           *flagNickPolicy,
+		CacheDir:             *flagCacheDir,
 		TLSConfig:            tlsConfig,
 	}
-	if err := server.Start(); err != nil {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Start()
+	}()
+	if httpServer != nil {
+		go func() {
+			var err error
+			if httpServer.TLSConfig != nil {
+				err = httpServer.ListenAndServeTLS("", "")
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("file server: %w", err)
+			}
+		}()
+		log.Printf("Serving files from %s on %s", fileServer.Dir, fileServer.BaseURL)
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
 		log.Fatal(err)
+	case sig := <-sigCh:
+		log.Infof("Got signal %v, shutting down", sig)
+	}
+	// a second signal terminates immediately
+	signal.Stop(sigCh)
+	ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+	defer cancel()
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Warningf("File server shutdown failed: %v", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warningf("Graceful shutdown failed: %v", err)
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, ircslack.ErrServerClosed) {
+		log.Warning(err)
+	}
+}
+
+// newFileServer returns the file server for the download directory, and the
+// HTTP server that it is served by. Links point to --http-url, and the files
+// are served under its path.
+func newFileServer(sName string, tlsConfig *tls.Config) (*ircslack.FileServer, *http.Server) {
+	baseURL := *flagHTTPURL
+	if baseURL == "" {
+		_, httpPort, err := net.SplitHostPort(*flagHTTPListen)
+		if err != nil {
+			log.Fatalf("Invalid file server address '%s': %v", *flagHTTPListen, err)
+		}
+		scheme := "http"
+		if tlsConfig != nil {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://%s/", scheme, net.JoinHostPort(sName, httpPort))
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid file server URL '%s'", baseURL)
+	}
+	fileServer := &ircslack.FileServer{
+		Dir:     *fileDownloadLocation,
+		BaseURL: baseURL,
+		Expiry:  *flagHTTPExpiry,
+	}
+	if *flagHTTPAuth != "" {
+		user, password, ok := strings.Cut(*flagHTTPAuth, ":")
+		if !ok {
+			log.Fatalf("Invalid file server credentials, want user:password")
+		}
+		fileServer.Username, fileServer.Password = user, password
+	}
+	// e.g. "/files" for https://example.com/files/ , or "" for the root
+	prefix := strings.TrimSuffix("/"+strings.Trim(u.Path, "/"), "/")
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, fileServer))
+	return fileServer, &http.Server{
+		Addr:              *flagHTTPListen,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
 	}
 }
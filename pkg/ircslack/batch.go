@@ -0,0 +1,118 @@
+package ircslack
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultBatchWindow is the default time to wait for more lines before
+	// posting them to Slack as a single message.
+	DefaultBatchWindow = time.Second
+	// DefaultBatchMaxSize is the default maximum size, in bytes, of a
+	// batched message.
+	DefaultBatchMaxSize = 4000
+	// SlackMaxMessageLength is the maximum length of the text of a Slack
+	// message. Longer texts are truncated by Slack, so they are split in
+	// several messages instead.
+	SlackMaxMessageLength = 40000
+)
+
+// batchKey identifies the conversation or thread that a batch is posted to.
+type batchKey struct {
+	target   string
+	targetTs string
+}
+
+// messageBatcher groups the lines sent to the same conversation or thread into
+// a single Slack message. Batches are returned in the order their first line
+// was added, so that the ordering of the messages is preserved.
+type messageBatcher struct {
+	// maxSize is the maximum size of a batch in bytes. If zero, batches are
+	// only limited by SlackMaxMessageLength
+	maxSize int
+	order   []batchKey
+	lines   map[batchKey][]string
+	sizes   map[batchKey]int
+}
+
+// newMessageBatcher creates a new messageBatcher object.
+func newMessageBatcher(maxSize int) *messageBatcher {
+	return &messageBatcher{
+		maxSize: maxSize,
+		lines:   make(map[batchKey][]string),
+		sizes:   make(map[batchKey]int),
+	}
+}
+
+// Add adds a line to the batch of its conversation or thread. If the line does
+// not fit in the batch, all the pending batches are returned to be posted
+// first, and the line starts a new batch.
+func (b *messageBatcher) Add(msg SlackPostMessage) []SlackPostMessage {
+	key := batchKey{target: msg.Target, targetTs: msg.TargetTs}
+	var ready []SlackPostMessage
+	if size, ok := b.sizes[key]; ok && b.maxSize > 0 && size+1+len(msg.Text) > b.maxSize {
+		ready = b.Flush()
+	}
+	if _, ok := b.sizes[key]; ok {
+		b.sizes[key]++
+	} else {
+		b.order = append(b.order, key)
+	}
+	b.lines[key] = append(b.lines[key], msg.Text)
+	b.sizes[key] += len(msg.Text)
+	return ready
+}
+
+// Flush returns all the pending batches, split at Slack's message size limit,
+// and empties the batcher.
+func (b *messageBatcher) Flush() []SlackPostMessage {
+	var ret []SlackPostMessage
+	for _, key := range b.order {
+		text := strings.Join(b.lines[key], "\n")
+		if strings.TrimSpace(text) == "" {
+			// Slack refuses empty messages
+			continue
+		}
+		for _, part := range splitMessage(text, SlackMaxMessageLength) {
+			ret = append(ret, SlackPostMessage{Target: key.target, TargetTs: key.targetTs, Text: part})
+		}
+	}
+	b.order = nil
+	b.lines = make(map[batchKey][]string)
+	b.sizes = make(map[batchKey]int)
+	return ret
+}
+
+// splitMessage splits a text in parts of at most maxLen bytes. Texts are split
+// at the last newline or space before the limit if possible, and never in the
+// middle of a UTF-8 sequence.
+func splitMessage(text string, maxLen int) []string {
+	var parts []string
+	for len(text) > maxLen {
+		// the separator itself is dropped
+		sep := 1
+		cut := strings.LastIndex(text[:maxLen+1], "\n")
+		if cut <= 0 {
+			cut = strings.LastIndex(text[:maxLen+1], " ")
+		}
+		if cut <= 0 {
+			sep = 0
+			cut = maxLen
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				// maxLen is shorter than the first character
+				_, cut = utf8.DecodeRuneInString(text)
+			}
+		}
+		parts = append(parts, text[:cut])
+		text = text[cut+sep:]
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
@@ -0,0 +1,62 @@
+package ircslack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageBatcherKeys(t *testing.T) {
+	b := newMessageBatcher(0)
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C1", Text: "one"}))
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C1", TargetTs: "1.1", Text: "in thread"}))
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C1", Text: "two"}))
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C1", TargetTs: "2.2", Text: "other thread"}))
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C2", Text: "elsewhere"}))
+	assert.Equal(t, []SlackPostMessage{
+		{Target: "C1", Text: "one\ntwo"},
+		{Target: "C1", TargetTs: "1.1", Text: "in thread"},
+		{Target: "C1", TargetTs: "2.2", Text: "other thread"},
+		{Target: "C2", Text: "elsewhere"},
+	}, b.Flush())
+	assert.Empty(t, b.Flush())
+}
+
+func TestMessageBatcherMaxSize(t *testing.T) {
+	b := newMessageBatcher(10)
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C2", Text: "first"}))
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C1", Text: "12345"}))
+	assert.Empty(t, b.Add(SlackPostMessage{Target: "C1", Text: "1234"}))
+	// does not fit, all the pending batches are posted in order
+	assert.Equal(t, []SlackPostMessage{
+		{Target: "C2", Text: "first"},
+		{Target: "C1", Text: "12345\n1234"},
+	}, b.Add(SlackPostMessage{Target: "C1", Text: "x"}))
+	assert.Equal(t, []SlackPostMessage{{Target: "C1", Text: "x"}}, b.Flush())
+}
+
+func TestMessageBatcherEmpty(t *testing.T) {
+	b := newMessageBatcher(0)
+	b.Add(SlackPostMessage{Target: "C1", Text: " "})
+	assert.Empty(t, b.Flush())
+}
+
+func TestSplitMessage(t *testing.T) {
+	assert.Equal(t, []string{"short"}, splitMessage("short", 10))
+	assert.Empty(t, splitMessage("", 10))
+	assert.Equal(t, []string{"line one", "line two"}, splitMessage("line one\nline two", 10))
+	assert.Equal(t, []string{"some words", "here"}, splitMessage("some words here", 10))
+	assert.Equal(t, []string{"some", "words", "here"}, splitMessage("some words here", 8))
+	assert.Equal(t, []string{"0123456789", "0123"}, splitMessage("01234567890123", 10))
+	// leading indentation of the next part is preserved
+	assert.Equal(t, []string{"if x {", "  return", "}"}, splitMessage("if x {\n  return\n}", 9))
+	// UTF-8 sequences are not split
+	parts := splitMessage(strings.Repeat("é", 10), 5)
+	require.Len(t, parts, 5)
+	for _, p := range parts {
+		assert.Equal(t, "éé", p)
+	}
+	assert.Equal(t, []string{"é", "é"}, splitMessage("éé", 1))
+}
@@ -0,0 +1,315 @@
+package ircslack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// blockDivider is how a divider block is rendered.
+const blockDivider = "──────────"
+
+// escapeSlackText escapes a plain text string the same way Slack does in a
+// message's text, so that the result can be expanded like any other message.
+func escapeSlackText(text string) string {
+	text = strings.ReplaceAll(text, "&", "&amp;")
+	text = strings.ReplaceAll(text, "<", "&lt;")
+	return strings.ReplaceAll(text, ">", "&gt;")
+}
+
+// HasOnlyRichTextBlocks returns true if all the blocks are rich text blocks.
+// Messages typed by users carry their text both in the message's Text field
+// and as rich text blocks, so the blocks don't need to be rendered.
+func HasOnlyRichTextBlocks(blocks slack.Blocks) bool {
+	for _, block := range blocks.BlockSet {
+		if block.BlockType() != slack.MBTRichText {
+			return false
+		}
+	}
+	return true
+}
+
+// RenderBlocks renders a list of Block Kit blocks as text. The returned text
+// uses Slack's message syntax (mrkdwn, <@U1234> mentions, <url|text> links,
+// :emoji: and so on), and can be expanded like the text of any other message.
+// Every block is rendered on one or more separate lines. Interactive elements
+// are rendered as their label and, if any, their URL.
+func RenderBlocks(blocks slack.Blocks) string {
+	var lines []string
+	for _, block := range blocks.BlockSet {
+		if text := renderBlock(block); text != "" {
+			lines = append(lines, text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func renderBlock(block slack.Block) string {
+	switch b := block.(type) {
+	case *slack.SectionBlock:
+		var lines []string
+		if t := renderTextObject(b.Text); t != "" {
+			lines = append(lines, t)
+		}
+		for _, field := range b.Fields {
+			if t := renderTextObject(field); t != "" {
+				lines = append(lines, t)
+			}
+		}
+		if b.Accessory != nil {
+			if t := renderBlockElement(accessoryElement(b.Accessory)); t != "" {
+				lines = append(lines, t)
+			}
+		}
+		return strings.Join(lines, "\n")
+	case *slack.HeaderBlock:
+		if t := renderTextObject(b.Text); t != "" {
+			return "*" + t + "*"
+		}
+	case *slack.ContextBlock:
+		var parts []string
+		for _, elem := range b.ContextElements.Elements {
+			switch e := elem.(type) {
+			case *slack.TextBlockObject:
+				if t := renderTextObject(e); t != "" {
+					parts = append(parts, t)
+				}
+			case *slack.ImageBlockElement:
+				if e.AltText != "" {
+					parts = append(parts, escapeSlackText(e.AltText))
+				}
+			}
+		}
+		return strings.Join(parts, " ")
+	case *slack.DividerBlock:
+		return blockDivider
+	case *slack.ImageBlock:
+		title := b.AltText
+		if b.Title != nil && b.Title.Text != "" {
+			title = b.Title.Text
+		}
+		return renderImage(title, b.ImageURL)
+	case *slack.ActionBlock:
+		if b.Elements == nil {
+			return ""
+		}
+		var parts []string
+		for _, elem := range b.Elements.ElementSet {
+			if t := renderBlockElement(elem); t != "" {
+				parts = append(parts, t)
+			}
+		}
+		return strings.Join(parts, " ")
+	case *slack.RichTextBlock:
+		var parts []string
+		for _, elem := range b.Elements {
+			if t := renderRichTextElement(elem); t != "" {
+				parts = append(parts, t)
+			}
+		}
+		return strings.Join(parts, "\n")
+	case *slack.MarkdownBlock:
+		return b.Text
+	default:
+		log.Debugf("Not rendering unsupported block type %s", block.BlockType())
+	}
+	return ""
+}
+
+// renderTextObject renders a text object. Plain text is escaped, while mrkdwn
+// text is returned as it is.
+func renderTextObject(obj *slack.TextBlockObject) string {
+	if obj == nil {
+		return ""
+	}
+	if obj.Type == slack.PlainTextType {
+		return escapeSlackText(obj.Text)
+	}
+	return obj.Text
+}
+
+func renderImage(title, url string) string {
+	if title == "" {
+		title = "image"
+	}
+	if url == "" {
+		return fmt.Sprintf("[%s]", escapeSlackText(title))
+	}
+	return fmt.Sprintf("[%s] <%s>", escapeSlackText(title), url)
+}
+
+// renderButton renders a button label, followed by its URL if any.
+func renderButton(label *slack.TextBlockObject, url string) string {
+	text := "[" + renderTextObject(label) + "]"
+	if url != "" {
+		text += " <" + url + ">"
+	}
+	return text
+}
+
+func accessoryElement(a *slack.Accessory) slack.BlockElement {
+	switch {
+	case a.ButtonElement != nil:
+		return a.ButtonElement
+	case a.ImageElement != nil:
+		return a.ImageElement
+	case a.WorkflowButtonElement != nil:
+		return a.WorkflowButtonElement
+	case a.SelectElement != nil:
+		return a.SelectElement
+	case a.OverflowElement != nil:
+		return a.OverflowElement
+	case a.DatePickerElement != nil:
+		return a.DatePickerElement
+	}
+	return nil
+}
+
+func renderBlockElement(elem slack.BlockElement) string {
+	switch e := elem.(type) {
+	case *slack.ButtonBlockElement:
+		return renderButton(e.Text, e.URL)
+	case *slack.WorkflowButtonBlockElement:
+		return renderButton(e.Text, "")
+	case *slack.ImageBlockElement:
+		var url string
+		if e.ImageURL != nil {
+			url = *e.ImageURL
+		}
+		return renderImage(e.AltText, url)
+	case *slack.SelectBlockElement:
+		if e.InitialOption != nil {
+			return "[" + renderTextObject(e.InitialOption.Text) + " ▾]"
+		}
+		if e.Placeholder != nil {
+			return "[" + renderTextObject(e.Placeholder) + " ▾]"
+		}
+		return "[select ▾]"
+	case *slack.OverflowBlockElement:
+		var parts []string
+		for _, opt := range e.Options {
+			parts = append(parts, renderButton(opt.Text, opt.URL))
+		}
+		return strings.Join(parts, " ")
+	case *slack.DatePickerBlockElement:
+		if e.InitialDate != "" {
+			return "[" + e.InitialDate + "]"
+		}
+		return "[date]"
+	case nil:
+		return ""
+	default:
+		log.Debugf("Not rendering unsupported block element type %s", elem.ElementType())
+	}
+	return ""
+}
+
+func renderRichTextElement(elem slack.RichTextElement) string {
+	switch e := elem.(type) {
+	case *slack.RichTextSection:
+		return renderRichTextSection(e.Elements)
+	case *slack.RichTextList:
+		return renderRichTextList(e)
+	case *slack.RichTextQuote:
+		lines := strings.Split(renderRichTextSection(e.Elements), "\n")
+		for idx, line := range lines {
+			lines[idx] = "&gt; " + line
+		}
+		return strings.Join(lines, "\n")
+	case *slack.RichTextPreformatted:
+		// styles are meaningless inside a code block
+		var b strings.Builder
+		for _, se := range e.Elements {
+			b.WriteString(renderRichTextSectionElement(se, false))
+		}
+		return "```\n" + strings.TrimSuffix(b.String(), "\n") + "\n```"
+	}
+	return ""
+}
+
+func renderRichTextList(list *slack.RichTextList) string {
+	indent := strings.Repeat("  ", list.Indent)
+	var lines []string
+	for idx, item := range list.Elements {
+		bullet := "•"
+		if list.Style == slack.RTEListOrdered {
+			bullet = fmt.Sprintf("%d.", list.Offset+idx+1)
+		}
+		// nested lists are sent as separate lists with a deeper indentation
+		lines = append(lines, indent+bullet+" "+renderRichTextElement(item))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func renderRichTextSection(elems []slack.RichTextSectionElement) string {
+	var b strings.Builder
+	for _, se := range elems {
+		b.WriteString(renderRichTextSectionElement(se, true))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// renderRichTextSectionElement renders a rich text element using Slack's
+// message syntax. If withStyle is true, text styles are rendered as mrkdwn.
+func renderRichTextSectionElement(se slack.RichTextSectionElement, withStyle bool) string {
+	var (
+		text  string
+		style *slack.RichTextSectionTextStyle
+	)
+	switch e := se.(type) {
+	case *slack.RichTextSectionTextElement:
+		text, style = escapeSlackText(e.Text), e.Style
+	case *slack.RichTextSectionChannelElement:
+		text, style = "<#"+e.ChannelID+">", e.Style
+	case *slack.RichTextSectionUserElement:
+		text, style = "<@"+e.UserID+">", e.Style
+	case *slack.RichTextSectionUserGroupElement:
+		text, style = "<!subteam^"+e.UsergroupID+">", e.Style
+	case *slack.RichTextSectionTeamElement:
+		text, style = e.TeamID, e.Style
+	case *slack.RichTextSectionBroadcastElement:
+		text = "<!" + e.Range + ">"
+	case *slack.RichTextSectionEmojiElement:
+		text, style = ":"+e.Name+":", e.Style
+		if e.SkinTone >= 2 && e.SkinTone <= 6 {
+			text += fmt.Sprintf(":skin-tone-%d:", e.SkinTone)
+		}
+	case *slack.RichTextSectionLinkElement:
+		text, style = "<"+e.URL+">", e.Style
+		if e.Text != "" {
+			text = "<" + e.URL + "|" + escapeSlackText(e.Text) + ">"
+		}
+	case *slack.RichTextSectionDateElement:
+		fallback := e.Timestamp.String()
+		if e.Fallback != nil {
+			fallback = *e.Fallback
+		}
+		text = fmt.Sprintf("<!date^%d^%s|%s>", int64(e.Timestamp), e.Format, fallback)
+	case *slack.RichTextSectionColorElement:
+		text = e.Value
+	default:
+		return ""
+	}
+	if !withStyle || style == nil || strings.TrimSpace(text) == "" {
+		return text
+	}
+	// mrkdwn markers must be adjacent to the text, so keep the surrounding
+	// white spaces outside
+	trimmed := strings.TrimSpace(text)
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	if style.Code {
+		trimmed = "`" + trimmed + "`"
+	}
+	if style.Strike {
+		trimmed = "~" + trimmed + "~"
+	}
+	if style.Italic {
+		trimmed = "_" + trimmed + "_"
+	}
+	if style.Bold {
+		trimmed = "*" + trimmed + "*"
+	}
+	return lead + trimmed + trail
+}
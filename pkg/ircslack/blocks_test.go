@@ -0,0 +1,85 @@
+package ircslack
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blocksFromJSON(t *testing.T, data string) slack.Blocks {
+	var msg slack.Msg
+	require.NoError(t, json.Unmarshal([]byte(`{"blocks": `+data+`}`), &msg))
+	return msg.Blocks
+}
+
+func TestRenderBlocksSection(t *testing.T) {
+	blocks := blocksFromJSON(t, `[
+		{"type": "header", "text": {"type": "plain_text", "text": "Deploy <prod>"}},
+		{"type": "section", "text": {"type": "mrkdwn", "text": "Deployed by <@U1234>"},
+			"fields": [{"type": "mrkdwn", "text": "*Status:* ok"}, {"type": "plain_text", "text": "Took 5m"}],
+			"accessory": {"type": "button", "text": {"type": "plain_text", "text": "Logs"}, "url": "https://example.com/logs"}},
+		{"type": "divider"},
+		{"type": "context", "elements": [{"type": "image", "image_url": "https://example.com/a.png", "alt_text": "bot"}, {"type": "mrkdwn", "text": "sent by CI"}]}
+	]`)
+	assert.Equal(t,
+		"*Deploy &lt;prod&gt;*\n"+
+			"Deployed by <@U1234>\n*Status:* ok\nTook 5m\n[Logs] <https://example.com/logs>\n"+
+			blockDivider+"\n"+
+			"bot sent by CI",
+		RenderBlocks(blocks),
+	)
+}
+
+func TestRenderBlocksImageAndActions(t *testing.T) {
+	blocks := blocksFromJSON(t, `[
+		{"type": "image", "image_url": "https://example.com/cat.png", "alt_text": "a cat"},
+		{"type": "actions", "elements": [
+			{"type": "button", "text": {"type": "plain_text", "text": "Approve"}, "value": "yes"},
+			{"type": "button", "text": {"type": "plain_text", "text": "Open"}, "url": "https://example.com"}
+		]}
+	]`)
+	assert.Equal(t,
+		"[a cat] <https://example.com/cat.png>\n[Approve] [Open] <https://example.com>",
+		RenderBlocks(blocks),
+	)
+}
+
+func TestRenderBlocksRichText(t *testing.T) {
+	blocks := blocksFromJSON(t, `[{"type": "rich_text", "elements": [
+		{"type": "rich_text_section", "elements": [
+			{"type": "text", "text": "hello "},
+			{"type": "text", "text": "world ", "style": {"bold": true}},
+			{"type": "user", "user_id": "U1234"},
+			{"type": "text", "text": " see "},
+			{"type": "link", "url": "https://example.com", "text": "this"},
+			{"type": "emoji", "name": "wave", "skin_tone": 3},
+			{"type": "broadcast", "range": "here"},
+			{"type": "text", "text": "\n"}
+		]},
+		{"type": "rich_text_list", "style": "bullet", "elements": [
+			{"type": "rich_text_section", "elements": [{"type": "text", "text": "one"}]},
+			{"type": "rich_text_section", "elements": [{"type": "text", "text": "two"}]}
+		]},
+		{"type": "rich_text_list", "style": "ordered", "indent": 1, "elements": [
+			{"type": "rich_text_section", "elements": [{"type": "text", "text": "first"}]}
+		]},
+		{"type": "rich_text_quote", "elements": [{"type": "text", "text": "a quote"}]},
+		{"type": "rich_text_preformatted", "elements": [{"type": "text", "text": "x := <-ch"}]}
+	]}]`)
+	assert.Equal(t,
+		"hello *world* <@U1234> see <https://example.com|this>:wave::skin-tone-3:<!here>\n"+
+			"• one\n• two\n"+
+			"  1. first\n"+
+			"&gt; a quote\n"+
+			"```\nx := &lt;-ch\n```",
+		RenderBlocks(blocks),
+	)
+}
+
+func TestHasOnlyRichTextBlocks(t *testing.T) {
+	assert.True(t, HasOnlyRichTextBlocks(blocksFromJSON(t, `[{"type": "rich_text", "elements": []}]`)))
+	assert.False(t, HasOnlyRichTextBlocks(blocksFromJSON(t, `[{"type": "rich_text", "elements": []}, {"type": "divider"}]`)))
+}
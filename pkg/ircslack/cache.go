@@ -0,0 +1,175 @@
+package ircslack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// CacheVersion is the version of the on-disk cache format. It has to be bumped
+// every time the format changes, so that caches written by older versions are
+// discarded instead of being misinterpreted.
+const CacheVersion = 1
+
+// DefaultCacheSaveDelay is how long to wait after the cache is invalidated
+// before writing it to disk, so that bursts of events result in a single
+// write.
+const DefaultCacheSaveDelay = 30 * time.Second
+
+// ErrCacheVersion is returned when loading a cache with a different format
+// version.
+var ErrCacheVersion = errors.New("unsupported cache version")
+
+// cacheData is the on-disk format of the cache.
+type cacheData struct {
+	Version  int          `json:"version"`
+	TeamID   string       `json:"team_id"`
+	SavedAt  time.Time    `json:"saved_at"`
+	Users    []slack.User `json:"users"`
+	Channels []Channel    `json:"channels"`
+}
+
+// Cache persists the users and channels of a Slack team to a JSON file, so
+// that logins do not have to wait for them to be fetched. They are still all
+// fetched again in the background after login, see refreshCache. There is one
+// file per team in the cache directory.
+type Cache struct {
+	dir      string
+	teamID   string
+	users    *Users
+	channels *Channels
+	// SaveDelay is how long to wait after an invalidation before saving
+	SaveDelay time.Duration
+	mu        sync.Mutex
+	timer     *time.Timer
+}
+
+// NewCache creates a new Cache object for the given team, that persists the
+// given users and channels.
+func NewCache(dir, teamID string, users *Users, channels *Channels) *Cache {
+	return &Cache{
+		dir:       dir,
+		teamID:    teamID,
+		users:     users,
+		channels:  channels,
+		SaveDelay: DefaultCacheSaveDelay,
+	}
+}
+
+// Path returns the path of the cache file.
+func (c *Cache) Path() string {
+	return filepath.Join(c.dir, filepath.Base(c.teamID)+".json")
+}
+
+// Load reads the cache file and adds its users and channels to the in-memory
+// caches. It returns the time the cache was saved at. If there is no cache
+// file, the returned error satisfies errors.Is(err, os.ErrNotExist).
+func (c *Cache) Load() (time.Time, error) {
+	data, err := os.ReadFile(c.Path())
+	if err != nil {
+		return time.Time{}, err
+	}
+	var cd cacheData
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode cache file %s: %w", c.Path(), err)
+	}
+	if cd.Version != CacheVersion {
+		return time.Time{}, fmt.Errorf("%w %d in %s, want %d", ErrCacheVersion, cd.Version, c.Path(), CacheVersion)
+	}
+	if cd.TeamID != c.teamID {
+		return time.Time{}, fmt.Errorf("cache file %s is for team %s, want %s", c.Path(), cd.TeamID, c.teamID)
+	}
+	c.users.Add(cd.Users...)
+	c.channels.Add(cd.Channels...)
+	log.Infof("Loaded %d users and %d channels from cache %s, saved at %v", len(cd.Users), len(cd.Channels), c.Path(), cd.SavedAt)
+	return cd.SavedAt, nil
+}
+
+// Save writes the users and channels to the cache file. The file is replaced
+// atomically, so that a crash cannot leave a truncated cache behind.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.mu.Unlock()
+
+	cd := cacheData{
+		Version: CacheVersion,
+		TeamID:  c.teamID,
+		SavedAt: time.Now(),
+	}
+	for _, user := range c.users.AsMap() {
+		cd.Users = append(cd.Users, user)
+	}
+	for _, ch := range c.channels.AsMap() {
+		cd.Channels = append(cd.Channels, ch)
+	}
+	data, err := json.Marshal(&cd)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache: %w", err)
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, filepath.Base(c.teamID)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.Path()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log.Debugf("Saved %d users and %d channels to cache %s", len(cd.Users), len(cd.Channels), c.Path())
+	return nil
+}
+
+// Invalidate notifies the cache that the users or channels have changed. The
+// cache is saved after SaveDelay, unless a save is already scheduled. It is
+// safe to call Invalidate on a nil Cache, i.e. when caching is disabled.
+func (c *Cache) Invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		return
+	}
+	c.timer = time.AfterFunc(c.SaveDelay, func() {
+		if err := c.Save(); err != nil {
+			log.Warningf("Failed to save cache: %v", err)
+		}
+	})
+}
+
+// Flush saves the cache immediately if a save is scheduled. Like Invalidate,
+// it is safe to call Flush on a nil Cache.
+func (c *Cache) Flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	pending := c.timer != nil
+	c.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	return c.Save()
+}
@@ -0,0 +1,127 @@
+package ircslack
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	users, channels := NewUsers(0), NewChannels(0)
+	users.Add(slack.User{ID: "U1234", Name: "insomniac", Profile: slack.UserProfile{DisplayName: "Andrea"}})
+	channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: "general", Conversation: slack.Conversation{ID: "C1234"}}, IsChannel: true})
+	cache := NewCache(dir, "T1234", users, channels)
+	require.NoError(t, cache.Save())
+	assert.Equal(t, filepath.Join(dir, "T1234.json"), cache.Path())
+	assert.FileExists(t, cache.Path())
+
+	users, channels = NewUsers(0), NewChannels(0)
+	cache = NewCache(dir, "T1234", users, channels)
+	savedAt, err := cache.Load()
+	require.NoError(t, err)
+	assert.False(t, savedAt.IsZero())
+	u := users.ByNick("insomniac")
+	require.NotNil(t, u)
+	assert.Equal(t, "Andrea", u.Profile.DisplayName)
+	ch := channels.ByName("#general")
+	require.NotNil(t, ch)
+	assert.Equal(t, "C1234", ch.ID)
+}
+
+func TestCacheLoadMissing(t *testing.T) {
+	cache := NewCache(t.TempDir(), "T1234", NewUsers(0), NewChannels(0))
+	_, err := cache.Load()
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestCacheLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewCache(dir, "T1234", NewUsers(0), NewChannels(0))
+
+	require.NoError(t, os.WriteFile(cache.Path(), []byte(`{"version": 999, "team_id": "T1234"}`), 0600))
+	_, err := cache.Load()
+	assert.ErrorIs(t, err, ErrCacheVersion)
+
+	require.NoError(t, os.WriteFile(cache.Path(), []byte(`{"version": 1, "team_id": "T5678"}`), 0600))
+	_, err = cache.Load()
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(cache.Path(), []byte(`not json`), 0600))
+	_, err = cache.Load()
+	assert.Error(t, err)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	users := NewUsers(0)
+	cache := NewCache(dir, "T1234", users, NewChannels(0))
+	// a nil cache, i.e. a disabled one, can be invalidated
+	var nilCache *Cache
+	nilCache.Invalidate()
+
+	// nothing to flush
+	require.NoError(t, cache.Flush())
+	assert.NoFileExists(t, cache.Path())
+
+	cache.SaveDelay = time.Hour
+	users.Add(slack.User{ID: "U1234", Name: "insomniac"})
+	cache.Invalidate()
+	assert.NoFileExists(t, cache.Path())
+	require.NoError(t, cache.Flush())
+	assert.FileExists(t, cache.Path())
+
+	// the save is delayed
+	require.NoError(t, os.Remove(cache.Path()))
+	cache.SaveDelay = 10 * time.Millisecond
+	cache.Invalidate()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(cache.Path())
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRefreshCacheMembership(t *testing.T) {
+	ctx, conn, _ := newFakeSlackTestContext(func(req *http.Request) (string, string, error) {
+		switch req.URL.Path {
+		case "/api/conversations.list":
+			// joined #new and left #old since the cache was saved
+			return "", `{"ok": true, "channels": [
+				{"id": "CGENERAL", "name": "general", "is_channel": true, "is_member": true},
+				{"id": "CNEW", "name": "new", "is_channel": true, "is_member": true},
+				{"id": "COLD", "name": "old", "is_channel": true, "is_member": false}
+			]}`, nil
+		case "/api/conversations.members":
+			return "", `{"ok": true, "members": ["UME", "UBOB"]}`, nil
+		case "/api/users.info":
+			return "", `{"ok": true, "users": [{"id": "UME", "name": "me"}, {"id": "UBOB", "name": "bob"}]}`, nil
+		}
+		return "", "", errUnsupportedURL(req)
+	})
+	ctx.Users.Add(*ctx.User, slack.User{ID: "UBOB", Name: "bob"})
+	general := Channel{IsChannel: true}
+	general.ID, general.Name, general.IsMember = "CGENERAL", "general", true
+	stale := Channel{IsChannel: true}
+	stale.ID, stale.Name = "CNEW", "new"
+	old := Channel{IsChannel: true}
+	old.ID, old.Name, old.IsMember = "COLD", "old", true
+	ctx.Channels.Add(general, stale, old)
+	ctx.Cache = NewCache(t.TempDir(), "T1234", ctx.Users, ctx.Channels)
+
+	refreshCache(ctx)
+	ctx.wg.Wait()
+	out := conn.buf.String()
+	assert.Contains(t, out, " JOIN #new\r\n")
+	assert.Contains(t, out, ":localhost 353 me = #new :me bob\r\n")
+	assert.Contains(t, out, " PART #old\r\n")
+	assert.NotContains(t, out, "#general")
+	assert.True(t, ctx.Channels.ByID("CNEW").IsMember)
+	assert.FileExists(t, ctx.Cache.Path())
+}
@@ -1,9 +1,9 @@
 package ircslack
 
 import (
+	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/slack-go/slack"
 )
@@ -34,6 +34,20 @@ func HasChannelPrefix(name string) bool {
 	}
 }
 
+// SplitThreadName splits the IRC name of a thread, e.g.
+// "+general-1234567890.123456", into the Slack name of its channel and the
+// timestamp of the thread. It returns false if the name is not a thread.
+func SplitThreadName(name string) (string, string, bool) {
+	if !strings.HasPrefix(name, ChannelPrefixThread) {
+		return "", "", false
+	}
+	idx := strings.LastIndex(name, "-")
+	if idx <= len(ChannelPrefixThread) || idx == len(name)-1 {
+		return "", "", false
+	}
+	return name[len(ChannelPrefixThread):idx], name[idx+1:], true
+}
+
 // StripChannelPrefix returns a channel name without its channel prefix. If no
 // channel prefix is present, the string is returned unchanged.
 func StripChannelPrefix(name string) string {
@@ -52,27 +66,14 @@ func ChannelMembers(ctx *IrcContext, channelID string) ([]slack.User, error) {
 		page       int
 	)
 	for {
-		attempt := 0
-		for {
-			// retry if rate-limited, no more than MaxSlackAPIAttempts times
-			if attempt >= MaxSlackAPIAttempts {
-				return nil, fmt.Errorf("ChannelMembers: exceeded the maximum number of attempts (%d) with the Slack API", MaxSlackAPIAttempts)
-			}
-			log.Debugf("ChannelMembers: page %d attempt #%d nextCursor=%s", page, attempt, nextCursor)
-			m, nextCursor, err = ctx.SlackClient.GetUsersInConversation(&slack.GetUsersInConversationParameters{ChannelID: channelID, Cursor: nextCursor, Limit: 1000})
-			if err != nil {
-				log.Errorf("Failed to get users in conversation '%s': %v", channelID, err)
-				if rlErr, ok := err.(*slack.RateLimitedError); ok {
-					// we were rate-limited. Let's wait as much as Slack
-					// instructs us to do
-					log.Warningf("Hit Slack API rate limiter. Waiting %v", rlErr.RetryAfter)
-					time.Sleep(rlErr.RetryAfter)
-					attempt++
-					continue
-				}
-				return nil, fmt.Errorf("Cannot get member list for conversation %s: %v", channelID, err)
-			}
-			break
+		log.Debugf("ChannelMembers: page %d nextCursor=%s", page, nextCursor)
+		err = ctx.RateLimiter.Do(ctx.Context(), "conversations.members", PriorityLow, func(c context.Context) error {
+			var err error
+			m, nextCursor, err = ctx.SlackClient.GetUsersInConversationContext(c, &slack.GetUsersInConversationParameters{ChannelID: channelID, Cursor: nextCursor, Limit: 1000})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get member list for conversation %s: %w", channelID, err)
 		}
 		members = append(members, m...)
 		log.Debugf("Fetched %d user IDs for channel %s (fetched so far: %d)", len(m), channelID, len(members))
@@ -84,10 +85,14 @@ func ChannelMembers(ctx *IrcContext, channelID string) ([]slack.User, error) {
 		page++
 	}
 	log.Debugf("Retrieving user information for %d users", len(members))
-	users, err := ctx.Users.FetchByIDs(ctx.SlackClient, false, members...)
+	users, changes, err := ctx.Users.FetchByIDs(ctx.Context(), ctx.SlackClient, false, members...)
+	// the new users may take the nicknames of known ones
+	ctx.SendNickChanges(changes)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to fetch users by their IDs: %v", err)
 	}
+	ctx.Cache.Invalidate()
+	subscribePresence(ctx, members...)
 	return users, nil
 }
 
@@ -3,6 +3,7 @@ package ircslack
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,17 +11,45 @@ import (
 )
 
 // Channels wraps the channel list with convenient operations and cache.
+// Channels are indexed by Slack ID and by case-folded Slack name.
 type Channels struct {
 	channels   map[string]Channel
+	byName     map[string]string
 	Pagination int
-	mu         sync.Mutex
+	// RateLimiter schedules the requests to the Slack API. It should be
+	// shared with the other caches of the same Slack client
+	RateLimiter *RateLimiter
+	mu          sync.RWMutex
 }
 
 // NewChannels creates a new Channels object.
 func NewChannels(pagination int) *Channels {
 	return &Channels{
-		channels:   make(map[string]Channel),
-		Pagination: pagination,
+		channels:    make(map[string]Channel),
+		byName:      make(map[string]string),
+		Pagination:  pagination,
+		RateLimiter: NewRateLimiter(),
+	}
+}
+
+// Add adds or replaces channels in the cache.
+func (c *Channels) Add(channels ...Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range channels {
+		c.add(ch)
+	}
+}
+
+// add adds a channel to the cache and updates the name index. The caller must
+// hold the lock.
+func (c *Channels) add(ch Channel) {
+	if old, ok := c.channels[ch.ID]; ok && old.Name != ch.Name && c.byName[foldCase(old.Name)] == ch.ID {
+		delete(c.byName, foldCase(old.Name))
+	}
+	c.channels[ch.ID] = ch
+	if ch.Name != "" {
+		c.byName[foldCase(ch.Name)] = ch.ID
 	}
 }
 
@@ -35,28 +64,40 @@ func SupportedChannelPrefixes() []string {
 
 }
 
+// Remove removes a channel from the cache, e.g. when it is deleted.
+func (c *Channels) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.channels[id]; ok {
+		if c.byName[foldCase(ch.Name)] == id {
+			delete(c.byName, foldCase(ch.Name))
+		}
+		delete(c.channels, id)
+	}
+}
+
 // AsMap returns the channels as a map of name -> channel. The map is copied to
 // avoid data races
 func (c *Channels) AsMap() map[string]Channel {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	ret := make(map[string]Channel, len(c.channels))
-	for k, v := range c.channels {
-		ret[k] = v
+	for _, v := range c.channels {
+		ret[v.Name] = v
 	}
 	return ret
 }
 
 // FetchByIDs fetches the channels with the specified IDs and updates the
 // internal channel mapping.
-func (c *Channels) FetchByIDs(client *slack.Client, skipCache bool, channelIDs ...string) ([]Channel, error) {
+func (c *Channels) FetchByIDs(ctx context.Context, client *slack.Client, skipCache bool, channelIDs ...string) ([]Channel, error) {
 	var (
 		toRetrieve       []string
 		alreadyRetrieved []Channel
 	)
 
 	if !skipCache {
-		c.mu.Lock()
+		c.mu.RLock()
 		for _, cid := range channelIDs {
 			if ch, ok := c.channels[cid]; !ok {
 				toRetrieve = append(toRetrieve, cid)
@@ -64,38 +105,27 @@ func (c *Channels) FetchByIDs(client *slack.Client, skipCache bool, channelIDs .
 				alreadyRetrieved = append(alreadyRetrieved, ch)
 			}
 		}
-		c.mu.Unlock()
+		c.mu.RUnlock()
 		log.Debugf("Fetching information for %d channels out of %d (%d already in cache)", len(toRetrieve), len(channelIDs), len(channelIDs)-len(toRetrieve))
 	} else {
 		toRetrieve = channelIDs
 	}
 	allFetchedChannels := make([]Channel, 0, len(channelIDs))
 	for i := 0; i < len(toRetrieve); i++ {
-		for {
-			attempt := 0
-			if attempt >= MaxSlackAPIAttempts {
-				return nil, fmt.Errorf("Channels.FetchByIDs: exceeded the maximum number of attempts (%d) with the Slack API", MaxSlackAPIAttempts)
-			}
-			log.Debugf("Fetching %d channels of %d, attempt %d of %d", len(toRetrieve), len(channelIDs), attempt+1, MaxSlackAPIAttempts)
-			slackChannel, err := client.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: toRetrieve[i], IncludeLocale: true, IncludeNumMembers: true})
-			if err != nil {
-				if rlErr, ok := err.(*slack.RateLimitedError); ok {
-					// we were rate-limited. Let's wait the recommended delay
-					log.Warningf("Hit Slack API rate limiter. Waiting %v", rlErr.RetryAfter)
-					time.Sleep(rlErr.RetryAfter)
-					attempt++
-					continue
-				}
-				return nil, err
-			}
-			ch := Channel(*slackChannel)
-			allFetchedChannels = append(allFetchedChannels, ch)
-			// also update the local users map
-			c.mu.Lock()
-			c.channels[ch.ID] = ch
-			c.mu.Unlock()
-			break
+		log.Debugf("Fetching channel %d of %d", i+1, len(toRetrieve))
+		var slackChannel *slack.Channel
+		err := c.RateLimiter.Do(ctx, "conversations.info", PriorityLow, func(ctx context.Context) error {
+			var err error
+			slackChannel, err = client.GetConversationInfoContext(ctx, &slack.GetConversationInfoInput{ChannelID: toRetrieve[i], IncludeLocale: true, IncludeNumMembers: true})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Channels.FetchByIDs: %w", err)
 		}
+		ch := Channel(*slackChannel)
+		allFetchedChannels = append(allFetchedChannels, ch)
+		// also update the local channels map
+		c.Add(ch)
 	}
 	allChannels := append(alreadyRetrieved, allFetchedChannels...)
 	if len(channelIDs) != len(allChannels) {
@@ -106,37 +136,37 @@ func (c *Channels) FetchByIDs(client *slack.Client, skipCache bool, channelIDs .
 
 // Fetch retrieves all the channels on a given Slack team. The Slack client has
 // to be valid and connected.
-func (c *Channels) Fetch(client *slack.Client) error {
+func (c *Channels) Fetch(ctx context.Context, client *slack.Client) error {
 	log.Infof("Fetching all channels, might take a while on large Slack teams")
 	// currently slack-go does not expose a way to change channel pagination as
 	// it does for the users API.
 	var (
-		err      error
-		ctx      = context.Background()
 		channels = make(map[string]Channel)
+		byName   = make(map[string]string)
 	)
 	start := time.Now()
 	params := slack.GetConversationsParameters{
 		Types: []string{"public_channel", "private_channel"},
 		Limit: c.Pagination,
 	}
-	for err == nil {
-		chans, nextCursor, err := client.GetConversationsContext(ctx, &params)
-		if err == nil {
-			log.Debugf("Retrieved %d channels (current total is %d)", len(chans), len(channels))
-			for _, sch := range chans {
-				// WARNING WARNING WARNING: channels are internally mapped by
-				// the Slack name, while users are mapped by Slack ID.
-				ch := Channel(sch)
-				channels[ch.SlackName()] = ch
-			}
-		} else if rateLimitedError, ok := err.(*slack.RateLimitedError); ok {
-			select {
-			case <-ctx.Done():
-				err = ctx.Err()
-			case <-time.After(rateLimitedError.RetryAfter):
-				err = nil
-			}
+	for {
+		var (
+			chans      []slack.Channel
+			nextCursor string
+		)
+		err := c.RateLimiter.Do(ctx, "conversations.list", PriorityLow, func(ctx context.Context) error {
+			var err error
+			chans, nextCursor, err = client.GetConversationsContext(ctx, &params)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Channels.Fetch: %w", err)
+		}
+		log.Debugf("Retrieved %d channels (current total is %d)", len(chans), len(channels))
+		for _, sch := range chans {
+			ch := Channel(sch)
+			channels[ch.ID] = ch
+			byName[foldCase(ch.SlackName())] = ch.ID
 		}
 		if nextCursor == "" {
 			break
@@ -146,8 +176,9 @@ func (c *Channels) Fetch(client *slack.Client) error {
 	log.Infof("Retrieved %d channels in %s", len(channels), time.Since(start))
 	c.mu.Lock()
 	c.channels = channels
-	for name, ch := range channels {
-		log.Debugf("Retrieved channel: %s -> %+v", name, ch)
+	c.byName = byName
+	for name, id := range byName {
+		log.Debugf("Retrieved channel: %s -> %+v", name, channels[id])
 	}
 	c.mu.Unlock()
 	return nil
@@ -156,30 +187,37 @@ func (c *Channels) Fetch(client *slack.Client) error {
 // Count returns the number of channels. This method must be called after
 // `Fetch`.
 func (c *Channels) Count() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return len(c.channels)
 }
 
 // ByID retrieves a channel by its Slack ID.
 func (c *Channels) ByID(id string) *Channel {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	for _, c := range c.channels {
-		if c.ID == id {
-			return &c
-		}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if ch, ok := c.channels[id]; ok {
+		return &ch
 	}
 	return nil
 }
 
-// ByName retrieves a channel by its Slack or IRC name.
+// ByName retrieves a channel by its Slack or IRC name. Multi-party IMs are
+// looked up by the ID embedded in their IRC name.
 func (c *Channels) ByName(name string) *Channel {
+	if strings.HasPrefix(name, ChannelPrefixMpIM) {
+		if idx := strings.Index(name, "|"); idx > 0 {
+			return c.ByID(name[len(ChannelPrefixMpIM):idx])
+		}
+	}
 	if HasChannelPrefix(name) {
 		// without prefix, the channel now has the form of a Slack name
 		name = name[1:]
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if ch, ok := c.channels[name]; ok {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if id, ok := c.byName[foldCase(name)]; ok {
+		ch := c.channels[id]
 		return &ch
 	}
 	return nil
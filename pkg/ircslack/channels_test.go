@@ -2,6 +2,7 @@ package ircslack
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -52,7 +53,7 @@ func (c fakeSlackHTTPClientChannels) Do(req *http.Request) (*http.Response, erro
 func TestChannelsFetch(t *testing.T) {
 	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClientChannels{}))
 	channels := NewChannels(100)
-	err := channels.Fetch(client)
+	err := channels.Fetch(context.Background(), client)
 	require.NoError(t, err)
 	assert.Equal(t, 1, channels.Count())
 }
@@ -60,21 +61,82 @@ func TestChannelsFetch(t *testing.T) {
 func TestChannelsById(t *testing.T) {
 	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClientChannels{}))
 	channels := NewChannels(100)
-	err := channels.Fetch(client)
+	err := channels.Fetch(context.Background(), client)
 	require.NoError(t, err)
 	u := channels.ByID("1234")
 	require.NotNil(t, u)
 	assert.Equal(t, "1234", u.ID)
 	assert.Equal(t, "general", u.Name)
+	// channel names are compared case-insensitively
+	u = channels.ByName("#General")
+	require.NotNil(t, u)
+	assert.Equal(t, "1234", u.ID)
 }
 
 func TestChannelsByName(t *testing.T) {
 	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClientChannels{}))
 	channels := NewChannels(100)
-	err := channels.Fetch(client)
+	err := channels.Fetch(context.Background(), client)
 	require.NoError(t, err)
 	u := channels.ByName("general")
 	require.NotNil(t, u)
 	assert.Equal(t, "1234", u.ID)
 	assert.Equal(t, "general", u.Name)
 }
+
+func TestChannelsAddRename(t *testing.T) {
+	channels := NewChannels(100)
+	channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: "general", Conversation: slack.Conversation{ID: "C1234"}}, IsChannel: true})
+	channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: "random", Conversation: slack.Conversation{ID: "C1234"}}, IsChannel: true})
+	assert.Equal(t, 1, channels.Count())
+	assert.Nil(t, channels.ByName("#general"))
+	ch := channels.ByName("#random")
+	require.NotNil(t, ch)
+	assert.Equal(t, "C1234", ch.ID)
+	assert.Equal(t, map[string]Channel{"random": *ch}, channels.AsMap())
+}
+
+func TestChannelsByNameMpIM(t *testing.T) {
+	channels := NewChannels(100)
+	mpim := Channel{GroupConversation: slack.GroupConversation{Name: "mpdm-alice--bob--carol-1", Conversation: slack.Conversation{ID: "G1234", IsMpIM: true}}}
+	channels.Add(mpim)
+	ch := channels.ByName(mpim.IRCName())
+	require.NotNil(t, ch)
+	assert.Equal(t, "G1234", ch.ID)
+}
+
+func newBenchmarkChannels(n int) *Channels {
+	channels := NewChannels(0)
+	for i := 0; i < n; i++ {
+		channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: fmt.Sprintf("channel-%d", i), Conversation: slack.Conversation{ID: fmt.Sprintf("C%08d", i)}}, IsChannel: true})
+	}
+	return channels
+}
+
+func BenchmarkChannelsByID(b *testing.B) {
+	for _, n := range []int{100, 20000} {
+		channels := newBenchmarkChannels(n)
+		id := fmt.Sprintf("C%08d", n-1)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if channels.ByID(id) == nil {
+					b.Fatal("channel not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkChannelsByName(b *testing.B) {
+	for _, n := range []int{100, 20000} {
+		channels := newBenchmarkChannels(n)
+		name := fmt.Sprintf("#channel-%d", n-1)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if channels.ByName(name) == nil {
+					b.Fatal("channel not found")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package ircslack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	// DefaultDownloadWorkers is the default number of concurrent downloads.
+	DefaultDownloadWorkers = 4
+	// downloadQueueSize is the number of downloads that can be waiting for
+	// a worker. Further downloads are refused.
+	downloadQueueSize = 1024
+	// maxFileNameLength is the maximum length in bytes of a downloaded
+	// file's name.
+	maxFileNameLength = 200
+	// tempFilePrefix is the prefix of the files being downloaded. They are
+	// renamed once complete.
+	tempFilePrefix = ".download-"
+	// downloadStatusRetention is how long the status of a finished download
+	// is kept. Files downloaded earlier are found again in the download
+	// directory.
+	downloadStatusRetention = time.Hour
+)
+
+// DownloadState is the state of a download.
+type DownloadState int
+
+// Download states.
+const (
+	DownloadQueued DownloadState = iota
+	DownloadRunning
+	DownloadDone
+	DownloadFailed
+)
+
+func (s DownloadState) String() string {
+	switch s {
+	case DownloadQueued:
+		return "queued"
+	case DownloadRunning:
+		return "downloading"
+	case DownloadDone:
+		return "done"
+	case DownloadFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("DownloadState(%d)", int(s))
+}
+
+// DownloadStatus is the status of the download of a Slack file.
+type DownloadStatus struct {
+	FileID string
+	// Name is the name of the local file, relative to the download
+	// directory
+	Name  string
+	Size  int64
+	State DownloadState
+	Err   error
+}
+
+// downloadJob is a download waiting for a worker, or running.
+type downloadJob struct {
+	// ctx is cancelled when the download is finished, or when all the
+	// clients waiting for it are gone
+	ctx    context.Context
+	cancel context.CancelFunc
+	token  string
+	url    string
+	entry  *download
+	// waiters is the number of clients waiting for the download, and stops
+	// stop watching their contexts. They are protected by the manager's mu
+	waiters int
+	stops   []func() bool
+}
+
+// download is the state of the download of a Slack file.
+type download struct {
+	status DownloadStatus
+	// job is the running or queued download, if any
+	job *downloadJob
+	// finished is when the download finished
+	finished time.Time
+}
+
+// DownloadManager downloads Slack files to a directory, with a pool of workers
+// shared by all the clients. Files are downloaded at most once, and are only
+// visible under their final name once complete. A download is aborted when all
+// the clients waiting for it are gone. If a quota is set, the least recently
+// used files are removed to make room for new ones.
+type DownloadManager struct {
+	// Dir is the directory that files are downloaded to
+	Dir string
+	// Workers is the number of concurrent downloads. If zero,
+	// DefaultDownloadWorkers is used
+	Workers int
+	// MaxFileSize is the maximum size in bytes of a downloaded file. If
+	// zero, there is no limit
+	MaxFileSize int64
+	// Quota is the maximum total size in bytes of the files in Dir. If
+	// zero, there is no limit
+	Quota int64
+	// Client is the HTTP client used for downloads. If nil,
+	// http.DefaultClient is used
+	Client *http.Client
+
+	mu      sync.Mutex
+	files   map[string]*download
+	queue   chan *downloadJob
+	started bool
+	closed  bool
+	wg      sync.WaitGroup
+	// ctx is the parent of the contexts of the downloads, and is cancelled
+	// when the manager is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Enqueue schedules the download of a Slack file with the given token, unless
+// it was already downloaded or is being downloaded, and returns the name of
+// the local file. The caller waits for the download until ctx is done, and
+// the download is aborted when no caller waits for it anymore.
+func (m *DownloadManager) Enqueue(ctx context.Context, token string, file slack.File) (string, error) {
+	if m.MaxFileSize > 0 && int64(file.Size) > m.MaxFileSize {
+		return "", fmt.Errorf("file %s is too big (%s, maximum is %s)", file.ID, formatSize(int64(file.Size)), formatSize(m.MaxFileSize))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return "", errors.New("download manager is closed")
+	}
+	if m.files == nil {
+		m.files = make(map[string]*download)
+	}
+	m.prune(time.Now())
+	if d, ok := m.files[file.ID]; ok && d.status.State != DownloadFailed {
+		switch {
+		case d.job == nil:
+			m.touch(d.status.Name)
+			return d.status.Name, nil
+		case d.job.ctx.Err() == nil:
+			m.addWaiter(ctx, d.job)
+			return d.status.Name, nil
+		}
+		// the download is being aborted, start a new one
+	}
+	name := downloadFileName(file)
+	d := &download{status: DownloadStatus{FileID: file.ID, Name: name, Size: int64(file.Size)}}
+	// files downloaded by a previous run are not downloaded again
+	if fi, err := os.Stat(filepath.Join(m.Dir, name)); err == nil && fi.Mode().IsRegular() {
+		d.status.State = DownloadDone
+		d.status.Size = fi.Size()
+		d.finished = time.Now()
+		m.files[file.ID] = d
+		m.touch(name)
+		return name, nil
+	}
+	if !m.started {
+		m.start()
+	}
+	jobCtx, cancel := context.WithCancel(m.ctx)
+	job := &downloadJob{ctx: jobCtx, cancel: cancel, token: token, url: file.URLPrivate, entry: d}
+	select {
+	case m.queue <- job:
+	default:
+		cancel()
+		return "", errors.New("too many pending downloads")
+	}
+	d.job = job
+	m.files[file.ID] = d
+	m.addWaiter(ctx, job)
+	return name, nil
+}
+
+// addWaiter adds a client waiting for a download until ctx is done. The
+// download is aborted when the last client stops waiting. It must be called
+// with mu held.
+func (m *DownloadManager) addWaiter(ctx context.Context, job *downloadJob) {
+	job.waiters++
+	job.stops = append(job.stops, context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		job.waiters--
+		if job.waiters == 0 {
+			job.cancel()
+		}
+	}))
+}
+
+// prune removes the status of the downloads that finished more than
+// downloadStatusRetention ago. It must be called with mu held.
+func (m *DownloadManager) prune(now time.Time) {
+	for id, d := range m.files {
+		if d.job == nil && now.Sub(d.finished) > downloadStatusRetention {
+			delete(m.files, id)
+		}
+	}
+}
+
+// start starts the workers. It must be called with mu held.
+func (m *DownloadManager) start() {
+	workers := m.Workers
+	if workers <= 0 {
+		workers = DefaultDownloadWorkers
+	}
+	m.queue = make(chan *downloadJob, downloadQueueSize)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for job := range m.queue {
+				m.run(job)
+			}
+		}()
+	}
+	m.started = true
+}
+
+// Close stops the workers after the pending downloads, and waits for them to
+// terminate. Downloads that no client waits for anymore are aborted.
+func (m *DownloadManager) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	if m.started {
+		close(m.queue)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+// Status returns the status of the download of a Slack file.
+func (m *DownloadManager) Status(fileID string) (DownloadStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[fileID]
+	if !ok {
+		return DownloadStatus{}, false
+	}
+	return d.status, true
+}
+
+// setState updates the state of a download. Once the download is finished,
+// its job is released.
+func (m *DownloadManager) setState(job *downloadJob, state DownloadState, size int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := job.entry
+	d.status.State = state
+	d.status.Err = err
+	if size > 0 {
+		d.status.Size = size
+	}
+	if state == DownloadDone || state == DownloadFailed {
+		d.job = nil
+		d.finished = time.Now()
+		for _, stop := range job.stops {
+			stop()
+		}
+		job.cancel()
+	}
+}
+
+// run downloads a file, and records its outcome.
+func (m *DownloadManager) run(job *downloadJob) {
+	m.mu.Lock()
+	name := job.entry.status.Name
+	m.mu.Unlock()
+	m.setState(job, DownloadRunning, 0, nil)
+	size, err := m.download(job, name)
+	if err != nil {
+		log.Warningf("Failed to download %s: %v", job.url, err)
+		m.setState(job, DownloadFailed, 0, err)
+		return
+	}
+	m.setState(job, DownloadDone, size, nil)
+	if m.Quota > 0 {
+		m.mu.Lock()
+		m.enforceQuota(name)
+		m.mu.Unlock()
+	}
+}
+
+// download downloads a file to a temporary file, and renames it once
+// complete. It returns the size of the file.
+func (m *DownloadManager) download(job *downloadJob, name string) (int64, error) {
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var (
+		resp *http.Response
+		err  error
+	)
+	for attempt := 0; attempt < maxHTTPAttempts; attempt++ {
+		if attempt > 0 {
+			// wait 1s, 2s, 4s, ... between attempts
+			select {
+			case <-job.ctx.Done():
+				return 0, job.ctx.Err()
+			case <-time.After(retryInterval << (attempt - 1)):
+			}
+		}
+		var request *http.Request
+		request, err = http.NewRequestWithContext(job.ctx, "GET", job.url, nil)
+		if err != nil {
+			return 0, err
+		}
+		request.Header.Add("Authorization", "Bearer "+job.token)
+		resp, err = client.Do(request)
+		if err != nil && retryableNetError(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if retryableHTTPError(resp) && attempt < maxHTTPAttempts-1 {
+			resp.Body.Close()
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("got %s", resp.Status)
+	}
+	tmp, err := os.CreateTemp(m.Dir, tempFilePrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	body := io.Reader(resp.Body)
+	if m.MaxFileSize > 0 {
+		body = io.LimitReader(resp.Body, m.MaxFileSize+1)
+	}
+	size, err := io.Copy(tmp, body)
+	if err == nil && m.MaxFileSize > 0 && size > m.MaxFileSize {
+		err = fmt.Errorf("file is bigger than %s", formatSize(m.MaxFileSize))
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(m.Dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return size, nil
+}
+
+// touch marks a file as recently used, for the LRU cleanup. It must be called
+// with mu held.
+func (m *DownloadManager) touch(name string) {
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(m.Dir, name), now, now); err != nil {
+		log.Warningf("Cannot update the access time of %s: %v", name, err)
+	}
+}
+
+// enforceQuota removes the least recently used files in Dir until their total
+// size is within the quota. The file being kept is never removed. It must be
+// called with mu held.
+func (m *DownloadManager) enforceQuota(keep string) {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		log.Warningf("Cannot read download directory %s: %v", m.Dir, err)
+		return
+	}
+	type entry struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		files []entry
+		total int64
+	)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), tempFilePrefix) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, entry{name: e.Name(), size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= m.Quota {
+			break
+		}
+		if f.name == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.Dir, f.name)); err != nil {
+			log.Warningf("Cannot remove %s: %v", f.name, err)
+			continue
+		}
+		log.Debugf("Removed %s to stay within the download quota", f.name)
+		total -= f.size
+		for id, d := range m.files {
+			if d.status.Name == f.name {
+				delete(m.files, id)
+			}
+		}
+	}
+}
+
+// downloadFileName returns the local name of a Slack file. It is prefixed
+// with the file ID, so it is unique, and it cannot contain path separators.
+func downloadFileName(file slack.File) string {
+	name := file.Name
+	if name == "" {
+		name = file.Title
+		if file.Filetype != "" && !strings.HasSuffix(name, "."+file.Filetype) {
+			name += "." + file.Filetype
+		}
+	}
+	// no hidden files, and no "." or ".."
+	name = file.ID + "_" + strings.TrimLeft(name, ".")
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > maxFileNameLength {
+		// keep the extension, and cut at a rune boundary
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		cut := maxFileNameLength - len(ext)
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut] + ext
+	}
+	return name
+}
+
+// IrcDownloadsHandler is called when a DOWNLOADS command is sent. It reports
+// the status of the most recent downloads of the client as notices.
+func IrcDownloadsHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if ctx.FileHandler == nil || ctx.FileHandler.Downloads == nil {
+		ctx.SendNotice("Downloads are disabled")
+		return
+	}
+	statuses := ctx.FileHandler.Recent()
+	if len(statuses) == 0 {
+		ctx.SendNotice("No downloads")
+		return
+	}
+	for _, status := range statuses {
+		msg := fmt.Sprintf("%s %s (%s): %s", status.FileID, status.Name, formatSize(status.Size), status.State)
+		if status.Err != nil {
+			msg += fmt.Sprintf(": %v", status.Err)
+		}
+		ctx.SendNotice("%s", msg)
+	}
+}
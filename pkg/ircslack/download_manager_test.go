@@ -0,0 +1,254 @@
+package ircslack
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFileName(t *testing.T) {
+	assert.Equal(t, "F1_report.pdf", downloadFileName(slack.File{ID: "F1", Name: "report.pdf"}))
+	assert.Equal(t, "F1_notes.txt", downloadFileName(slack.File{ID: "F1", Title: "notes", Filetype: "txt"}))
+	assert.Equal(t, "F1__.._etc_passwd", downloadFileName(slack.File{ID: "F1", Name: "../../etc/passwd"}))
+	assert.Equal(t, "F1_a_b", downloadFileName(slack.File{ID: "F1", Name: "a\\b"}))
+	assert.Equal(t, "F1_hidden", downloadFileName(slack.File{ID: "F1", Name: ".hidden"}))
+
+	long := downloadFileName(slack.File{ID: "F1", Name: strings.Repeat("é", 200) + ".png"})
+	assert.True(t, len(long) <= maxFileNameLength)
+	assert.True(t, strings.HasSuffix(long, "é.png"))
+}
+
+func newDownloadTestServer(t *testing.T, hits *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/small":
+			_, _ = w.Write([]byte("hello"))
+		case "/big":
+			_, _ = w.Write([]byte(strings.Repeat("x", 100)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownloadManager(t *testing.T) {
+	var hits int32
+	server := newDownloadTestServer(t, &hits)
+	dir := t.TempDir()
+	m := &DownloadManager{Dir: dir, Workers: 2}
+	file := slack.File{ID: "F1", Name: "hello.txt", URLPrivate: server.URL + "/small", Size: 5}
+
+	name, err := m.Enqueue(context.Background(), "token", file)
+	require.NoError(t, err)
+	assert.Equal(t, "F1_hello.txt", name)
+	// the same file is only downloaded once
+	name, err = m.Enqueue(context.Background(), "token", file)
+	require.NoError(t, err)
+	assert.Equal(t, "F1_hello.txt", name)
+
+	_, err = m.Enqueue(context.Background(), "token", slack.File{ID: "F2", Name: "missing", URLPrivate: server.URL + "/missing"})
+	require.NoError(t, err)
+	m.Close()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	data, err := os.ReadFile(filepath.Join(dir, "F1_hello.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	status, ok := m.Status("F1")
+	require.True(t, ok)
+	assert.Equal(t, DownloadDone, status.State)
+	assert.Equal(t, int64(5), status.Size)
+
+	// failed downloads leave no files behind
+	status, ok = m.Status("F2")
+	require.True(t, ok)
+	assert.Equal(t, DownloadFailed, status.State)
+	assert.Error(t, status.Err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = m.Enqueue(context.Background(), "token", file)
+	assert.Error(t, err)
+}
+
+func TestDownloadManagerExistingFile(t *testing.T) {
+	var hits int32
+	server := newDownloadTestServer(t, &hits)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "F1_hello.txt"), []byte("hello"), 0o644))
+	m := &DownloadManager{Dir: dir}
+	_, err := m.Enqueue(context.Background(), "token", slack.File{ID: "F1", Name: "hello.txt", URLPrivate: server.URL + "/small"})
+	require.NoError(t, err)
+	m.Close()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+}
+
+func TestDownloadManagerMaxFileSize(t *testing.T) {
+	var hits int32
+	server := newDownloadTestServer(t, &hits)
+	dir := t.TempDir()
+	m := &DownloadManager{Dir: dir, MaxFileSize: 50}
+	// files known to be too big are not downloaded at all
+	_, err := m.Enqueue(context.Background(), "token", slack.File{ID: "F1", Name: "big", URLPrivate: server.URL + "/big", Size: 100})
+	require.Error(t, err)
+	// files with a wrong size are aborted
+	_, err = m.Enqueue(context.Background(), "token", slack.File{ID: "F2", Name: "big", URLPrivate: server.URL + "/big", Size: 10})
+	require.NoError(t, err)
+	m.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	status, _ := m.Status("F2")
+	assert.Equal(t, DownloadFailed, status.State)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDownloadManagerQuota(t *testing.T) {
+	var hits int32
+	server := newDownloadTestServer(t, &hits)
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{"F8_oldest", "F9_old"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("x", 100)), 0o644))
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	m := &DownloadManager{Dir: dir, Quota: 250}
+	// using a file makes it the most recently used one
+	_, err := m.Enqueue(context.Background(), "token", slack.File{ID: "F8", Name: "oldest"})
+	require.NoError(t, err)
+	_, err = m.Enqueue(context.Background(), "token", slack.File{ID: "F1", Name: "new", URLPrivate: server.URL + "/big"})
+	require.NoError(t, err)
+	m.Close()
+
+	var names []string
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"F1_new", "F8_oldest"}, names)
+}
+
+func TestFileHandlerRecent(t *testing.T) {
+	var hits int32
+	server := newDownloadTestServer(t, &hits)
+	handler := &FileHandler{
+		SlackAPIKey: "token",
+		Downloads:   &DownloadManager{Dir: t.TempDir()},
+		ProxyPrefix: "https://example.com/files/",
+	}
+	link := handler.Download(context.Background(), slack.File{ID: "F1", Name: "hello world.txt", URLPrivate: server.URL + "/small"})
+	assert.Equal(t, "https://example.com/files/F1_hello%20world.txt", link)
+	handler.Downloads.Close()
+
+	recent := handler.Recent()
+	require.Len(t, recent, 1)
+	assert.Equal(t, DownloadStatus{FileID: "F1", Name: "F1_hello world.txt", Size: 5, State: DownloadDone}, recent[0])
+}
+
+// newBlockingDownloadServer returns a file server whose downloads block until
+// release is closed, or the request is aborted. Started and aborted downloads
+// are reported on started and aborted.
+func newBlockingDownloadServer(t *testing.T, release <-chan struct{}) (server *httptest.Server, started, aborted chan string) {
+	started = make(chan string, 10)
+	aborted = make(chan string, 10)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		select {
+		case <-release:
+			_, _ = w.Write([]byte("hello"))
+		case <-r.Context().Done():
+			aborted <- r.URL.Path
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, started, aborted
+}
+
+func TestDownloadManagerSharedDownload(t *testing.T) {
+	release := make(chan struct{})
+	server, started, aborted := newBlockingDownloadServer(t, release)
+	m := &DownloadManager{Dir: t.TempDir()}
+	file := slack.File{ID: "F1", Name: "hello.txt", URLPrivate: server.URL + "/shared"}
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	_, err := m.Enqueue(first, "token", file)
+	require.NoError(t, err)
+	_, err = m.Enqueue(second, "token", file)
+	require.NoError(t, err)
+	<-started
+
+	// the download goes on while a client still waits for it
+	cancelFirst()
+	select {
+	case <-aborted:
+		t.Fatal("download aborted while a client still waits for it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	m.Close()
+	status, ok := m.Status("F1")
+	require.True(t, ok)
+	assert.Equal(t, DownloadDone, status.State)
+}
+
+func TestDownloadManagerAbortWithoutWaiters(t *testing.T) {
+	server, started, aborted := newBlockingDownloadServer(t, make(chan struct{}))
+	m := &DownloadManager{Dir: t.TempDir()}
+	file := slack.File{ID: "F1", Name: "hello.txt", URLPrivate: server.URL + "/aborted"}
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	_, err := m.Enqueue(first, "token", file)
+	require.NoError(t, err)
+	_, err = m.Enqueue(second, "token", file)
+	require.NoError(t, err)
+	<-started
+
+	cancelFirst()
+	cancelSecond()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download not aborted after all the clients stopped waiting")
+	}
+	m.Close()
+	status, ok := m.Status("F1")
+	require.True(t, ok)
+	assert.Equal(t, DownloadFailed, status.State)
+}
+
+func TestDownloadManagerPrune(t *testing.T) {
+	var hits int32
+	server := newDownloadTestServer(t, &hits)
+	m := &DownloadManager{Dir: t.TempDir()}
+	_, err := m.Enqueue(context.Background(), "token", slack.File{ID: "F1", Name: "missing", URLPrivate: server.URL + "/missing"})
+	require.NoError(t, err)
+	m.Close()
+	_, ok := m.Status("F1")
+	require.True(t, ok)
+
+	// the status of old finished downloads is removed
+	m.mu.Lock()
+	m.prune(time.Now().Add(downloadStatusRetention + time.Minute))
+	m.mu.Unlock()
+	_, ok = m.Status("F1")
+	assert.False(t, ok)
+}
@@ -0,0 +1,664 @@
+package ircslack
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/slack-go/slack"
+)
+
+// emojiTable maps Unicode emoji to their Slack shortcodes. The first name of
+// each entry is the canonical one, i.e. the one used when translating from
+// Unicode to Slack shortcodes. This is not the complete list of emoji known to
+// Slack, but it covers the most commonly used ones.
+var emojiTable = []struct {
+	emoji string
+	names []string
+}{
+	// faces
+	{"😀", []string{"grinning"}},
+	{"😃", []string{"smiley"}},
+	{"😄", []string{"smile"}},
+	{"😁", []string{"grin"}},
+	{"😆", []string{"laughing", "satisfied"}},
+	{"😅", []string{"sweat_smile"}},
+	{"🤣", []string{"rolling_on_the_floor_laughing", "rofl"}},
+	{"😂", []string{"joy"}},
+	{"🙂", []string{"slightly_smiling_face"}},
+	{"🙃", []string{"upside_down_face"}},
+	{"😉", []string{"wink"}},
+	{"😊", []string{"blush"}},
+	{"😇", []string{"innocent"}},
+	{"🥰", []string{"smiling_face_with_3_hearts"}},
+	{"😍", []string{"heart_eyes"}},
+	{"🤩", []string{"star-struck", "grinning_face_with_star_eyes"}},
+	{"😘", []string{"kissing_heart"}},
+	{"😗", []string{"kissing"}},
+	{"☺️", []string{"relaxed"}},
+	{"😚", []string{"kissing_closed_eyes"}},
+	{"😙", []string{"kissing_smiling_eyes"}},
+	{"😋", []string{"yum"}},
+	{"😛", []string{"stuck_out_tongue"}},
+	{"😜", []string{"stuck_out_tongue_winking_eye"}},
+	{"🤪", []string{"zany_face", "grinning_face_with_one_large_and_one_small_eye"}},
+	{"😝", []string{"stuck_out_tongue_closed_eyes"}},
+	{"🤑", []string{"money_mouth_face"}},
+	{"🤗", []string{"hugging_face"}},
+	{"🤭", []string{"face_with_hand_over_mouth", "smiling_face_with_smiling_eyes_and_hand_covering_mouth"}},
+	{"🤫", []string{"shushing_face", "face_with_finger_covering_closed_lips"}},
+	{"🤔", []string{"thinking_face"}},
+	{"🤐", []string{"zipper_mouth_face"}},
+	{"🤨", []string{"face_with_raised_eyebrow", "face_with_one_eyebrow_raised"}},
+	{"😐", []string{"neutral_face"}},
+	{"😑", []string{"expressionless"}},
+	{"😶", []string{"no_mouth"}},
+	{"😏", []string{"smirk"}},
+	{"😒", []string{"unamused"}},
+	{"🙄", []string{"face_with_rolling_eyes", "rolling_eyes"}},
+	{"😬", []string{"grimacing"}},
+	{"🤥", []string{"lying_face"}},
+	{"😌", []string{"relieved"}},
+	{"😔", []string{"pensive"}},
+	{"😪", []string{"sleepy"}},
+	{"🤤", []string{"drooling_face"}},
+	{"😴", []string{"sleeping"}},
+	{"😷", []string{"mask"}},
+	{"🤒", []string{"face_with_thermometer"}},
+	{"🤕", []string{"face_with_head_bandage"}},
+	{"🤢", []string{"nauseated_face"}},
+	{"🤮", []string{"face_vomiting", "face_with_open_mouth_vomiting"}},
+	{"🤧", []string{"sneezing_face"}},
+	{"🥵", []string{"hot_face"}},
+	{"🥶", []string{"cold_face"}},
+	{"🥴", []string{"woozy_face"}},
+	{"😵", []string{"dizzy_face"}},
+	{"🤯", []string{"exploding_head", "shocked_face_with_exploding_head"}},
+	{"🤠", []string{"face_with_cowboy_hat"}},
+	{"🥳", []string{"partying_face"}},
+	{"😎", []string{"sunglasses"}},
+	{"🤓", []string{"nerd_face"}},
+	{"🧐", []string{"face_with_monocle"}},
+	{"😕", []string{"confused"}},
+	{"😟", []string{"worried"}},
+	{"🙁", []string{"slightly_frowning_face"}},
+	{"😮", []string{"open_mouth"}},
+	{"😯", []string{"hushed"}},
+	{"😲", []string{"astonished"}},
+	{"😳", []string{"flushed"}},
+	{"🥺", []string{"pleading_face"}},
+	{"😦", []string{"frowning"}},
+	{"😧", []string{"anguished"}},
+	{"😨", []string{"fearful"}},
+	{"😰", []string{"cold_sweat"}},
+	{"😥", []string{"disappointed_relieved"}},
+	{"😢", []string{"cry"}},
+	{"😭", []string{"sob"}},
+	{"😱", []string{"scream"}},
+	{"😖", []string{"confounded"}},
+	{"😣", []string{"persevere"}},
+	{"😞", []string{"disappointed"}},
+	{"😓", []string{"sweat"}},
+	{"😩", []string{"weary"}},
+	{"😫", []string{"tired_face"}},
+	{"🥱", []string{"yawning_face"}},
+	{"😤", []string{"triumph"}},
+	{"😡", []string{"rage"}},
+	{"😠", []string{"angry"}},
+	{"🤬", []string{"face_with_symbols_on_mouth", "serious_face_with_symbols_covering_mouth"}},
+	{"😈", []string{"smiling_imp"}},
+	{"👿", []string{"imp"}},
+	{"💀", []string{"skull"}},
+	{"💩", []string{"hankey", "poop", "shit"}},
+	{"🤡", []string{"clown_face"}},
+	{"👻", []string{"ghost"}},
+	{"👽", []string{"alien"}},
+	{"🤖", []string{"robot_face"}},
+	{"🙈", []string{"see_no_evil"}},
+	{"🙉", []string{"hear_no_evil"}},
+	{"🙊", []string{"speak_no_evil"}},
+	// hearts
+	{"❤️", []string{"heart"}},
+	{"🧡", []string{"orange_heart"}},
+	{"💛", []string{"yellow_heart"}},
+	{"💚", []string{"green_heart"}},
+	{"💙", []string{"blue_heart"}},
+	{"💜", []string{"purple_heart"}},
+	{"🖤", []string{"black_heart"}},
+	{"🤍", []string{"white_heart"}},
+	{"💔", []string{"broken_heart"}},
+	{"💕", []string{"two_hearts"}},
+	{"💞", []string{"revolving_hearts"}},
+	{"💓", []string{"heartbeat"}},
+	{"💗", []string{"heartpulse"}},
+	{"💖", []string{"sparkling_heart"}},
+	{"💘", []string{"cupid"}},
+	// hands and people
+	{"👋", []string{"wave"}},
+	{"🤚", []string{"raised_back_of_hand"}},
+	{"✋", []string{"hand", "raised_hand"}},
+	{"🖖", []string{"spock-hand"}},
+	{"👌", []string{"ok_hand"}},
+	{"✌️", []string{"v"}},
+	{"🤞", []string{"crossed_fingers", "hand_with_index_and_middle_fingers_crossed"}},
+	{"🤘", []string{"the_horns", "sign_of_the_horns", "metal"}},
+	{"🤙", []string{"call_me_hand"}},
+	{"👈", []string{"point_left"}},
+	{"👉", []string{"point_right"}},
+	{"👆", []string{"point_up_2"}},
+	{"🖕", []string{"middle_finger", "reversed_hand_with_middle_finger_extended"}},
+	{"👇", []string{"point_down"}},
+	{"☝️", []string{"point_up"}},
+	{"👍", []string{"+1", "thumbsup"}},
+	{"👎", []string{"-1", "thumbsdown"}},
+	{"✊", []string{"fist"}},
+	{"👊", []string{"facepunch", "punch"}},
+	{"👏", []string{"clap"}},
+	{"🙌", []string{"raised_hands"}},
+	{"👐", []string{"open_hands"}},
+	{"🤲", []string{"palms_up_together"}},
+	{"🤝", []string{"handshake"}},
+	{"🙏", []string{"pray"}},
+	{"✍️", []string{"writing_hand"}},
+	{"💪", []string{"muscle"}},
+	{"👀", []string{"eyes"}},
+	{"👁️", []string{"eye"}},
+	{"🧠", []string{"brain"}},
+	{"👶", []string{"baby"}},
+	{"👨", []string{"man"}},
+	{"👩", []string{"woman"}},
+	{"🙋", []string{"raising_hand"}},
+	{"🙆", []string{"ok_woman"}},
+	{"🙅", []string{"no_good"}},
+	{"🙇", []string{"bow"}},
+	{"🤦", []string{"face_palm"}},
+	{"🤦‍♂️", []string{"man-facepalming"}},
+	{"🤦‍♀️", []string{"woman-facepalming"}},
+	{"🤷", []string{"shrug"}},
+	{"🤷‍♂️", []string{"man-shrugging"}},
+	{"🤷‍♀️", []string{"woman-shrugging"}},
+	{"👨‍💻", []string{"male-technologist"}},
+	{"👩‍💻", []string{"female-technologist"}},
+	{"👑", []string{"crown"}},
+	{"💍", []string{"ring"}},
+	{"💎", []string{"gem"}},
+	// symbols
+	{"💯", []string{"100"}},
+	{"🔥", []string{"fire"}},
+	{"✨", []string{"sparkles"}},
+	{"⭐", []string{"star"}},
+	{"🌟", []string{"star2"}},
+	{"⚡", []string{"zap"}},
+	{"💥", []string{"boom", "collision"}},
+	{"💤", []string{"zzz"}},
+	{"💦", []string{"sweat_drops"}},
+	{"💨", []string{"dash"}},
+	{"💬", []string{"speech_balloon"}},
+	{"💭", []string{"thought_balloon"}},
+	{"⚠️", []string{"warning"}},
+	{"⛔", []string{"no_entry"}},
+	{"🚫", []string{"no_entry_sign"}},
+	{"❌", []string{"x"}},
+	{"⭕", []string{"o"}},
+	{"✅", []string{"white_check_mark"}},
+	{"☑️", []string{"ballot_box_with_check"}},
+	{"✔️", []string{"heavy_check_mark"}},
+	{"✖️", []string{"heavy_multiplication_x"}},
+	{"➕", []string{"heavy_plus_sign"}},
+	{"➖", []string{"heavy_minus_sign"}},
+	{"❓", []string{"question"}},
+	{"❔", []string{"grey_question"}},
+	{"❗", []string{"exclamation", "heavy_exclamation_mark"}},
+	{"❕", []string{"grey_exclamation"}},
+	{"‼️", []string{"bangbang"}},
+	{"⁉️", []string{"interrobang"}},
+	{"♻️", []string{"recycle"}},
+	{"♾️", []string{"infinity"}},
+	{"🔴", []string{"red_circle"}},
+	{"🟠", []string{"large_orange_circle"}},
+	{"🟡", []string{"large_yellow_circle"}},
+	{"🟢", []string{"large_green_circle"}},
+	{"🔵", []string{"large_blue_circle"}},
+	{"⚪", []string{"white_circle"}},
+	{"⚫", []string{"black_circle"}},
+	{"➡️", []string{"arrow_right"}},
+	{"⬅️", []string{"arrow_left"}},
+	{"⬆️", []string{"arrow_up"}},
+	{"⬇️", []string{"arrow_down"}},
+	{"🔄", []string{"arrows_counterclockwise"}},
+	{"🆗", []string{"ok"}},
+	{"🆕", []string{"new"}},
+	{"🆒", []string{"cool"}},
+	{"🆘", []string{"sos"}},
+	{"0️⃣", []string{"zero"}},
+	{"1️⃣", []string{"one"}},
+	{"2️⃣", []string{"two"}},
+	{"3️⃣", []string{"three"}},
+	{"4️⃣", []string{"four"}},
+	{"5️⃣", []string{"five"}},
+	{"6️⃣", []string{"six"}},
+	{"7️⃣", []string{"seven"}},
+	{"8️⃣", []string{"eight"}},
+	{"9️⃣", []string{"nine"}},
+	{"🔟", []string{"keycap_ten"}},
+	{"#️⃣", []string{"hash"}},
+	// objects
+	{"🎉", []string{"tada"}},
+	{"🎊", []string{"confetti_ball"}},
+	{"🎈", []string{"balloon"}},
+	{"🎁", []string{"gift"}},
+	{"🎂", []string{"birthday"}},
+	{"🏆", []string{"trophy"}},
+	{"🏅", []string{"sports_medal"}},
+	{"🥇", []string{"first_place_medal"}},
+	{"🥈", []string{"second_place_medal"}},
+	{"🥉", []string{"third_place_medal"}},
+	{"🚀", []string{"rocket"}},
+	{"💡", []string{"bulb"}},
+	{"📝", []string{"memo", "pencil"}},
+	{"✏️", []string{"pencil2"}},
+	{"📖", []string{"book", "open_book"}},
+	{"📚", []string{"books"}},
+	{"📅", []string{"date"}},
+	{"📆", []string{"calendar"}},
+	{"🗓️", []string{"spiral_calendar_pad"}},
+	{"📧", []string{"e-mail"}},
+	{"📨", []string{"incoming_envelope"}},
+	{"✉️", []string{"email", "envelope"}},
+	{"☎️", []string{"phone", "telephone"}},
+	{"📞", []string{"telephone_receiver"}},
+	{"📱", []string{"iphone"}},
+	{"💻", []string{"computer"}},
+	{"⌨️", []string{"keyboard"}},
+	{"🖥️", []string{"desktop_computer"}},
+	{"🔒", []string{"lock"}},
+	{"🔓", []string{"unlock"}},
+	{"🔑", []string{"key"}},
+	{"🔨", []string{"hammer"}},
+	{"🔧", []string{"wrench"}},
+	{"⚙️", []string{"gear"}},
+	{"🔗", []string{"link"}},
+	{"📎", []string{"paperclip"}},
+	{"📌", []string{"pushpin"}},
+	{"📍", []string{"round_pushpin"}},
+	{"🔍", []string{"mag"}},
+	{"🔔", []string{"bell"}},
+	{"🔕", []string{"no_bell"}},
+	{"📢", []string{"loudspeaker"}},
+	{"📣", []string{"mega"}},
+	{"⌛", []string{"hourglass"}},
+	{"⏳", []string{"hourglass_flowing_sand"}},
+	{"⌚", []string{"watch"}},
+	{"⏰", []string{"alarm_clock"}},
+	{"⏱️", []string{"stopwatch"}},
+	{"💰", []string{"moneybag"}},
+	{"💵", []string{"dollar"}},
+	{"💸", []string{"money_with_wings"}},
+	{"📈", []string{"chart_with_upwards_trend"}},
+	{"📉", []string{"chart_with_downwards_trend"}},
+	{"📊", []string{"bar_chart"}},
+	{"📋", []string{"clipboard"}},
+	{"📦", []string{"package"}},
+	{"🗿", []string{"moyai"}},
+	{"🚨", []string{"rotating_light"}},
+	{"🚧", []string{"construction"}},
+	{"🏁", []string{"checkered_flag"}},
+	{"🚩", []string{"triangular_flag_on_post"}},
+	{"🏳️‍🌈", []string{"rainbow-flag"}},
+	{"🇺🇸", []string{"us", "flag-us"}},
+	{"🇬🇧", []string{"gb", "uk", "flag-gb"}},
+	{"🇮🇹", []string{"it", "flag-it"}},
+	{"🇩🇪", []string{"de", "flag-de"}},
+	{"🇫🇷", []string{"fr", "flag-fr"}},
+	{"🇪🇸", []string{"es", "flag-es"}},
+	{"🇯🇵", []string{"jp", "flag-jp"}},
+	// nature and animals
+	{"☀️", []string{"sunny"}},
+	{"☁️", []string{"cloud"}},
+	{"☔", []string{"umbrella_with_rain_drops"}},
+	{"❄️", []string{"snowflake"}},
+	{"🌈", []string{"rainbow"}},
+	{"🌊", []string{"ocean"}},
+	{"🌴", []string{"palm_tree"}},
+	{"🌲", []string{"evergreen_tree"}},
+	{"🌳", []string{"deciduous_tree"}},
+	{"🌵", []string{"cactus"}},
+	{"🌱", []string{"seedling"}},
+	{"🌿", []string{"herb"}},
+	{"🍀", []string{"four_leaf_clover"}},
+	{"🌹", []string{"rose"}},
+	{"🌻", []string{"sunflower"}},
+	{"🌷", []string{"tulip"}},
+	{"🌸", []string{"cherry_blossom"}},
+	{"🌍", []string{"earth_africa"}},
+	{"🌎", []string{"earth_americas"}},
+	{"🌏", []string{"earth_asia"}},
+	{"🌕", []string{"full_moon"}},
+	{"🌑", []string{"new_moon"}},
+	{"🌙", []string{"crescent_moon"}},
+	{"🐶", []string{"dog"}},
+	{"🐱", []string{"cat"}},
+	{"🐭", []string{"mouse"}},
+	{"🐰", []string{"rabbit"}},
+	{"🦊", []string{"fox_face"}},
+	{"🐻", []string{"bear"}},
+	{"🐼", []string{"panda_face"}},
+	{"🐨", []string{"koala"}},
+	{"🐯", []string{"tiger"}},
+	{"🦁", []string{"lion_face"}},
+	{"🐮", []string{"cow"}},
+	{"🐷", []string{"pig"}},
+	{"🐸", []string{"frog"}},
+	{"🐵", []string{"monkey_face"}},
+	{"🐔", []string{"chicken"}},
+	{"🐧", []string{"penguin"}},
+	{"🐦", []string{"bird"}},
+	{"🦉", []string{"owl"}},
+	{"🦄", []string{"unicorn_face"}},
+	{"🐝", []string{"bee", "honeybee"}},
+	{"🐛", []string{"bug"}},
+	{"🐞", []string{"ladybug", "lady_beetle"}},
+	{"🐜", []string{"ant"}},
+	{"🐢", []string{"turtle"}},
+	{"🐍", []string{"snake"}},
+	{"🐙", []string{"octopus"}},
+	{"🐟", []string{"fish"}},
+	{"🐳", []string{"whale"}},
+	{"🐬", []string{"dolphin", "flipper"}},
+	{"🦀", []string{"crab"}},
+	{"🦥", []string{"sloth"}},
+	// food and drinks
+	{"☕", []string{"coffee"}},
+	{"🍵", []string{"tea"}},
+	{"🍺", []string{"beer"}},
+	{"🍻", []string{"beers"}},
+	{"🍷", []string{"wine_glass"}},
+	{"🍸", []string{"cocktail"}},
+	{"🍹", []string{"tropical_drink"}},
+	{"🍾", []string{"champagne"}},
+	{"🍕", []string{"pizza"}},
+	{"🍔", []string{"hamburger"}},
+	{"🍟", []string{"fries"}},
+	{"🌭", []string{"hotdog"}},
+	{"🌮", []string{"taco"}},
+	{"🌯", []string{"burrito"}},
+	{"🍣", []string{"sushi"}},
+	{"🍜", []string{"ramen"}},
+	{"🍝", []string{"spaghetti"}},
+	{"🍞", []string{"bread"}},
+	{"🥐", []string{"croissant"}},
+	{"🍰", []string{"cake"}},
+	{"🍪", []string{"cookie"}},
+	{"🍩", []string{"doughnut"}},
+	{"🍨", []string{"ice_cream"}},
+	{"🍎", []string{"apple"}},
+	{"🍏", []string{"green_apple"}},
+	{"🍌", []string{"banana"}},
+	{"🍓", []string{"strawberry"}},
+	{"🍋", []string{"lemon"}},
+	{"🍑", []string{"peach"}},
+	{"🍆", []string{"eggplant"}},
+	{"🥑", []string{"avocado"}},
+	{"🌶️", []string{"hot_pepper"}},
+	{"🍿", []string{"popcorn"}},
+	// activities and travel
+	{"⚽", []string{"soccer"}},
+	{"🏀", []string{"basketball"}},
+	{"🏈", []string{"football"}},
+	{"🎾", []string{"tennis"}},
+	{"🎮", []string{"video_game"}},
+	{"🎲", []string{"game_die"}},
+	{"🎯", []string{"dart"}},
+	{"🎸", []string{"guitar"}},
+	{"🎵", []string{"musical_note"}},
+	{"🎶", []string{"notes"}},
+	{"🎧", []string{"headphones"}},
+	{"🎥", []string{"movie_camera"}},
+	{"📷", []string{"camera"}},
+	{"🎨", []string{"art"}},
+	{"🚗", []string{"car", "red_car"}},
+	{"🚌", []string{"bus"}},
+	{"🚲", []string{"bike"}},
+	{"🚢", []string{"ship"}},
+	{"✈️", []string{"airplane"}},
+	{"🏠", []string{"house"}},
+	{"🏡", []string{"house_with_garden"}},
+	{"🏢", []string{"office"}},
+	{"🏥", []string{"hospital"}},
+	{"🏫", []string{"school"}},
+}
+
+// emojiSkinTones maps Slack's skin tone modifiers to the corresponding Unicode
+// Fitzpatrick modifiers.
+var emojiSkinTones = map[string]string{
+	"skin-tone-2": "\U0001F3FB",
+	"skin-tone-3": "\U0001F3FC",
+	"skin-tone-4": "\U0001F3FD",
+	"skin-tone-5": "\U0001F3FE",
+	"skin-tone-6": "\U0001F3FF",
+}
+
+const emojiVariationSelector = "\ufe0f"
+
+var (
+	// shortcode -> Unicode
+	emojiByName = make(map[string]string)
+	// Unicode (without variation selectors) -> canonical shortcode
+	emojiByUnicode = make(map[string]string)
+	// skin tone modifier -> Slack skin tone name
+	emojiSkinToneNames = make(map[string]string)
+	// the maximum length in runes of an emoji in emojiByUnicode
+	emojiMaxRunes int
+)
+
+func init() {
+	for _, e := range emojiTable {
+		for _, name := range e.names {
+			emojiByName[name] = e.emoji
+		}
+		key := strings.ReplaceAll(e.emoji, emojiVariationSelector, "")
+		emojiByUnicode[key] = e.names[0]
+		if n := utf8.RuneCountInString(key); n > emojiMaxRunes {
+			emojiMaxRunes = n
+		}
+	}
+	for name, modifier := range emojiSkinTones {
+		emojiSkinToneNames[modifier] = name
+	}
+}
+
+// Emoji translates between Slack emoji shortcodes (e.g. `:+1:`) and Unicode
+// emoji. Besides the standard emoji, it knows about the workspace's custom
+// emoji, which are used to resolve aliases to standard emoji. Custom emoji that
+// have no Unicode equivalent are left as shortcodes.
+type Emoji struct {
+	// RateLimiter schedules the requests to the Slack API. It should be
+	// shared with the other caches of the same Slack client
+	RateLimiter *RateLimiter
+	custom      map[string]string
+	mu          sync.RWMutex
+}
+
+// NewEmoji creates a new Emoji object.
+func NewEmoji() *Emoji {
+	return &Emoji{
+		RateLimiter: NewRateLimiter(),
+		custom:      make(map[string]string),
+	}
+}
+
+// Fetch retrieves the custom emoji of a Slack team via emoji.list. The Slack
+// client has to be valid and connected.
+func (e *Emoji) Fetch(ctx context.Context, client *slack.Client) error {
+	var custom map[string]string
+	err := e.RateLimiter.Do(ctx, "emoji.list", PriorityLow, func(ctx context.Context) error {
+		var err error
+		custom, err = client.GetEmojiContext(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Retrieved %d custom emoji", len(custom))
+	e.mu.Lock()
+	e.custom = custom
+	e.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the Unicode emoji for the given shortcode, without colons.
+// Custom emoji are resolved if they are aliases of a standard emoji. The
+// second return value is false if the shortcode has no Unicode equivalent.
+func (e *Emoji) Lookup(name string) (string, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	// follow custom aliases, but don't loop forever on circular ones
+	for i := 0; i < 5; i++ {
+		if u, ok := emojiByName[name]; ok {
+			return u, true
+		}
+		v, ok := e.custom[name]
+		if !ok || !strings.HasPrefix(v, "alias:") {
+			return "", false
+		}
+		name = strings.TrimPrefix(v, "alias:")
+	}
+	return "", false
+}
+
+// ToUnicode replaces all the known Slack emoji shortcodes in the text with
+// the corresponding Unicode emoji, including skin tone modifiers, e.g.
+// `:+1::skin-tone-2:`. Unknown shortcodes are left untouched, and so are the
+// ones next to a letter or a digit, like the 100 in "10:100:5".
+func (e *Emoji) ToUnicode(text string) string {
+	var (
+		b strings.Builder
+		// prev is the rune before text, which is always a colon after the
+		// first iteration
+		prev rune
+	)
+	for {
+		start := strings.IndexByte(text, ':')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(text[start+1:], ':')
+		if end < 0 {
+			break
+		}
+		end += start + 1
+		name := text[start+1 : end]
+		if start > 0 {
+			prev, _ = utf8.DecodeLastRuneInString(text[:start])
+		}
+		next, _ := utf8.DecodeRuneInString(text[end+1:])
+		u, ok := "", false
+		if isEmojiName(name) && !isWordRune(prev) && !isWordRune(next) {
+			u, ok = e.Lookup(name)
+		}
+		if !ok {
+			// not an emoji. The closing colon could be the opening colon of
+			// the next shortcode, so only skip the opening one
+			b.WriteString(text[:start+1])
+			text = text[start+1:]
+			prev = ':'
+			continue
+		}
+		b.WriteString(text[:start])
+		b.WriteString(u)
+		text = text[end+1:]
+		prev = ':'
+		// the skin tone is a separate shortcode immediately following the
+		// emoji
+		if strings.HasPrefix(text, ":skin-tone-") {
+			if idx := strings.IndexByte(text[1:], ':'); idx >= 0 {
+				if modifier, ok := emojiSkinTones[text[1:idx+1]]; ok {
+					b.WriteString(modifier)
+					text = text[idx+2:]
+				}
+			}
+		}
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+// ToShortcodes replaces all the known Unicode emoji in the text with the
+// corresponding Slack shortcodes, including skin tone modifiers.
+func (e *Emoji) ToShortcodes(text string) string {
+	var (
+		b     strings.Builder
+		runes = []rune(text)
+	)
+	for i := 0; i < len(runes); {
+		name, n := matchEmoji(runes[i:])
+		if n == 0 {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+		b.WriteString(":" + name + ":")
+		i += n
+		if i < len(runes) {
+			if tone, ok := emojiSkinToneNames[string(runes[i])]; ok {
+				b.WriteString(":" + tone + ":")
+				i++
+			}
+		}
+	}
+	return b.String()
+}
+
+// matchEmoji returns the shortcode of the longest emoji at the beginning of
+// the given runes, and the number of runes that it spans. Variation selectors
+// are ignored when matching, and consumed. If there is no match, the returned
+// length is 0.
+func matchEmoji(runes []rune) (string, int) {
+	var (
+		key      []rune
+		name     string
+		consumed int
+	)
+	for i := 0; i < len(runes) && len(key) < emojiMaxRunes; i++ {
+		if string(runes[i]) == emojiVariationSelector {
+			continue
+		}
+		key = append(key, runes[i])
+		if len(key) == 1 && runes[i] < 0xff {
+			// plain ASCII and Latin-1 characters are only emoji as part of
+			// a longer sequence (e.g. keycaps)
+			continue
+		}
+		if n, ok := emojiByUnicode[string(key)]; ok {
+			name, consumed = n, i+1
+		}
+	}
+	if consumed > 0 {
+		for consumed < len(runes) && string(runes[consumed]) == emojiVariationSelector {
+			consumed++
+		}
+	}
+	return name, consumed
+}
+
+// isWordRune returns true if r is a letter or a digit.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// isEmojiName returns true if the string can be a Slack emoji name.
+func isEmojiName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-', r == '+', r == '\'':
+		default:
+			return false
+		}
+	}
+	return true
+}
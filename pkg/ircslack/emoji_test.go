@@ -0,0 +1,94 @@
+package ircslack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmojiToUnicode(t *testing.T) {
+	e := NewEmoji()
+	assert.Equal(t, "hello 👍", e.ToUnicode("hello :+1:"))
+	assert.Equal(t, "👍👎", e.ToUnicode(":thumbsup::-1:"))
+	assert.Equal(t, "❤️ ok", e.ToUnicode(":heart: ok"))
+}
+
+func TestEmojiToUnicodeSkinTone(t *testing.T) {
+	e := NewEmoji()
+	assert.Equal(t, "👍\U0001F3FD", e.ToUnicode(":+1::skin-tone-4:"))
+	// unknown skin tones are left alone
+	assert.Equal(t, "👍:skin-tone-9:", e.ToUnicode(":+1::skin-tone-9:"))
+}
+
+func TestEmojiToUnicodeUnknown(t *testing.T) {
+	e := NewEmoji()
+	assert.Equal(t, ":not_an_emoji:", e.ToUnicode(":not_an_emoji:"))
+	assert.Equal(t, "at 12:30:45", e.ToUnicode("at 12:30:45"))
+	assert.Equal(t, "std::vector 😄", e.ToUnicode("std::vector :smile:"))
+	assert.Equal(t, "a: 😄", e.ToUnicode("a: :smile:"))
+}
+
+func TestEmojiToShortcodes(t *testing.T) {
+	e := NewEmoji()
+	assert.Equal(t, "hello :+1:", e.ToShortcodes("hello 👍"))
+	assert.Equal(t, ":heart: and :heart:", e.ToShortcodes("❤️ and ❤"))
+	assert.Equal(t, ":+1::skin-tone-2:", e.ToShortcodes("👍\U0001F3FB"))
+	assert.Equal(t, ":man-shrugging:", e.ToShortcodes("🤷‍♂️"))
+	assert.Equal(t, ":one: 1 # plain", e.ToShortcodes("1️⃣ 1 # plain"))
+	assert.Equal(t, ":it:", e.ToShortcodes("🇮🇹"))
+}
+
+func TestEmojiRoundTrip(t *testing.T) {
+	e := NewEmoji()
+	for _, text := range []string{":smile: :+1::skin-tone-3: :tada:", ":woman-facepalming:"} {
+		assert.Equal(t, text, e.ToShortcodes(e.ToUnicode(text)))
+	}
+}
+
+type fakeSlackHTTPClientEmoji struct{}
+
+func (c fakeSlackHTTPClientEmoji) Do(req *http.Request) (*http.Response, error) {
+	switch req.URL.Path {
+	case "/api/emoji.list":
+		// reply as per https://api.slack.com/methods/emoji.list
+		data := []byte(`{"ok": true, "emoji": {"partyparrot": "https://emoji.slack-edge.com/T1234/partyparrot/abcd.gif", "yay": "alias:tada", "yayyay": "alias:yay"}}`)
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(data)),
+		}, nil
+	default:
+		return nil, fmt.Errorf("testing: http client URL not supported: %s", req.URL)
+	}
+}
+
+func TestEmojiCustom(t *testing.T) {
+	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClientEmoji{}))
+	e := NewEmoji()
+	require.NoError(t, e.Fetch(context.Background(), client))
+	// the request goes through the rate limiter
+	assert.Equal(t, uint64(1), e.RateLimiter.Stats()["emoji.list"].Calls)
+	// aliases of standard emoji are resolved, custom images are kept as
+	// shortcodes
+	assert.Equal(t, "🎉 🎉 :partyparrot:", e.ToUnicode(":yay: :yayyay: :partyparrot:"))
+}
+
+func TestEmojiToUnicodeInsideWords(t *testing.T) {
+	e := NewEmoji()
+	assert.Equal(t, "10:100:5", e.ToUnicode("10:100:5"))
+	assert.Equal(t, "score:100:", e.ToUnicode("score:100:"))
+	assert.Equal(t, ":100:points", e.ToUnicode(":100:points"))
+	assert.Equal(t, "💯!", e.ToUnicode(":100:!"))
+	assert.Equal(t, "(💯)", e.ToUnicode("(:100:)"))
+	assert.Equal(t, "😄💯", e.ToUnicode(":smile::100:"))
+}
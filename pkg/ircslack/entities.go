@@ -0,0 +1,221 @@
+package ircslack
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rxSlackEntity matches Slack's special entities in a message's text: user,
+// channel and user group mentions, special mentions, and dates. URLs are not
+// matched, see ExpandText for those.
+var rxSlackEntity = regexp.MustCompile(`<([@#!])([^>|]*)(?:\|([^>]*))?>`)
+
+// ExpandEntities expands Slack's special entities in a message's text into
+// their IRC representation:
+//   - <@U1234> and <@U1234|name> become @nick
+//   - <#C1234> and <#C1234|name> become the IRC channel name, e.g. #general
+//   - <!subteam^S1234> and <!subteam^S1234|@handle> become @handle
+//   - <!here>, <!channel> and <!everyone> become @here, @channel and @everyone
+//   - <!date^timestamp^format^link|fallback> become the formatted date in the
+//     user's timezone
+//
+// Entities that cannot be resolved are replaced with their label, if any, and
+// are left untouched otherwise.
+func (ic *IrcContext) ExpandEntities(text string) string {
+	return rxSlackEntity.ReplaceAllStringFunc(text, func(subs string) string {
+		m := rxSlackEntity.FindStringSubmatch(subs)
+		kind, id, label := m[1], m[2], m[3]
+		var expanded string
+		switch kind {
+		case "@":
+			expanded = ic.expandUser(id, label)
+		case "#":
+			expanded = ic.expandChannel(id, label)
+		case "!":
+			expanded = ic.expandSpecial(id, label)
+		}
+		if expanded == "" {
+			return subs
+		}
+		return expanded
+	})
+}
+
+func (ic *IrcContext) expandUser(id, label string) string {
+	if ic.Users != nil {
+		if user := ic.Users.ByID(id); user != nil {
+			return "@" + ic.NickOf(user)
+		}
+	}
+	if label != "" {
+		return "@" + strings.TrimPrefix(label, "@")
+	}
+	return ""
+}
+
+func (ic *IrcContext) expandChannel(id, label string) string {
+	if ic.Channels != nil {
+		if ch := ic.Channels.ByID(id); ch != nil {
+			return ch.IRCName()
+		}
+	}
+	if label != "" {
+		return ChannelPrefixPublicChannel + label
+	}
+	return ""
+}
+
+func (ic *IrcContext) expandSpecial(id, label string) string {
+	args := strings.Split(id, "^")
+	switch args[0] {
+	case "here", "channel", "everyone":
+		return "@" + args[0]
+	case "subteam":
+		if len(args) > 1 && ic.UserGroups != nil {
+			if group := ic.UserGroups.ByID(args[1]); group != nil {
+				return "@" + group.Handle
+			}
+		}
+		if label != "" {
+			return "@" + strings.TrimPrefix(label, "@")
+		}
+	case "date":
+		if len(args) < 3 {
+			return label
+		}
+		ts, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return label
+		}
+		date := FormatSlackDate(ts, args[2], ic.Location(), time.Now())
+		if len(args) > 3 {
+			date += " (" + strings.Join(args[3:], "^") + ")"
+		}
+		return date
+	default:
+		return label
+	}
+	return ""
+}
+
+// Location returns the time zone of the Slack user, or the local time zone if
+// unknown.
+func (ic *IrcContext) Location() *time.Location {
+	if ic.User == nil || ic.User.TZ == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(ic.User.TZ)
+	if err != nil {
+		log.Warningf("Cannot load time zone '%s': %v", ic.User.TZ, err)
+		return time.Local
+	}
+	return loc
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+// FormatSlackDate formats a Unix timestamp according to a Slack date format
+// string, as used in <!date^...> entities, in the given time zone. The `now`
+// argument is used for relative dates like "yesterday" or "3 minutes ago".
+// See https://api.slack.com/reference/surfaces/formatting#date-formatting .
+func FormatSlackDate(ts int64, format string, loc *time.Location, now time.Time) string {
+	t := time.Unix(ts, 0).In(loc)
+	now = now.In(loc)
+	pretty := func(fallback string) string {
+		y1, m1, d1 := t.Date()
+		for delta, name := range map[int]string{0: "today", -1: "yesterday", 1: "tomorrow"} {
+			y2, m2, d2 := now.AddDate(0, 0, delta).Date()
+			if y1 == y2 && m1 == m2 && d1 == d2 {
+				return name
+			}
+		}
+		return fallback
+	}
+	tokens := map[string]func() string{
+		"date_num": func() string { return t.Format("2006-01-02") },
+		"date": func() string {
+			return fmt.Sprintf("%s %s, %d", t.Month(), ordinal(t.Day()), t.Year())
+		},
+		"date_short": func() string { return t.Format("Jan 2, 2006") },
+		"date_long": func() string {
+			return fmt.Sprintf("%s, %s %s, %d", t.Weekday(), t.Month(), ordinal(t.Day()), t.Year())
+		},
+		"time":      func() string { return t.Format("3:04 PM") },
+		"time_secs": func() string { return t.Format("3:04:05 PM") },
+		"ago":       func() string { return formatAgo(now.Sub(t)) },
+	}
+	for _, name := range []string{"date", "date_short", "date_long"} {
+		f := tokens[name]
+		tokens[name+"_pretty"] = func() string { return pretty(f()) }
+	}
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(format, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(format[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+		b.WriteString(format[:start])
+		if f, ok := tokens[format[start+1:end]]; ok {
+			b.WriteString(f())
+		} else {
+			b.WriteString(format[start : end+1])
+		}
+		format = format[end+1:]
+	}
+	b.WriteString(format)
+	return b.String()
+}
+
+// formatAgo formats a duration as a human-readable relative time, e.g.
+// "3 minutes ago" or "in 2 hours".
+func formatAgo(d time.Duration) string {
+	future := d < 0
+	if future {
+		d = -d
+	}
+	var n int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		n, unit = int(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		n, unit = int(d/(30*24*time.Hour)), "month"
+	default:
+		n, unit = int(d/(365*24*time.Hour)), "year"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	if future {
+		return fmt.Sprintf("in %d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %s ago", n, unit)
+}
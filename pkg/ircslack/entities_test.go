@@ -0,0 +1,91 @@
+package ircslack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEntitiesTestContext() *IrcContext {
+	ctx := &IrcContext{
+		User:       &slack.User{ID: "UME", Name: "me", TZ: "Europe/Rome"},
+		Users:      NewUsers(0),
+		Channels:   NewChannels(0),
+		UserGroups: NewUserGroups(),
+	}
+	ctx.Users.Add(slack.User{ID: "U1234", Name: "insomniac"})
+	ctx.Channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: "general", Conversation: slack.Conversation{ID: "C1234"}}, IsChannel: true})
+	ctx.Channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: "secret", Conversation: slack.Conversation{ID: "G1234", IsGroup: true, IsPrivate: true}}})
+	ctx.UserGroups.Update(slack.UserGroup{ID: "S1234", Handle: "oncall"})
+	return ctx
+}
+
+func TestExpandEntitiesUsers(t *testing.T) {
+	ctx := newEntitiesTestContext()
+	assert.Equal(t, "hi @insomniac", ctx.ExpandEntities("hi <@U1234>"))
+	assert.Equal(t, "hi @insomniac", ctx.ExpandEntities("hi <@U1234|oldname>"))
+	assert.Equal(t, "hi @someone", ctx.ExpandEntities("hi <@U9999|someone>"))
+	assert.Equal(t, "hi <@U9999>", ctx.ExpandEntities("hi <@U9999>"))
+}
+
+func TestExpandEntitiesChannels(t *testing.T) {
+	ctx := newEntitiesTestContext()
+	assert.Equal(t, "see #general", ctx.ExpandEntities("see <#C1234>"))
+	assert.Equal(t, "see #general", ctx.ExpandEntities("see <#C1234|general>"))
+	assert.Equal(t, "see @secret", ctx.ExpandEntities("see <#G1234|secret>"))
+	assert.Equal(t, "see #random", ctx.ExpandEntities("see <#C9999|random>"))
+	assert.Equal(t, "see <#C9999>", ctx.ExpandEntities("see <#C9999>"))
+}
+
+func TestExpandEntitiesUserGroups(t *testing.T) {
+	ctx := newEntitiesTestContext()
+	assert.Equal(t, "ping @oncall", ctx.ExpandEntities("ping <!subteam^S1234>"))
+	assert.Equal(t, "ping @oncall", ctx.ExpandEntities("ping <!subteam^S1234|@old-oncall>"))
+	assert.Equal(t, "ping @devs", ctx.ExpandEntities("ping <!subteam^S9999|@devs>"))
+	assert.Equal(t, "ping <!subteam^S9999>", ctx.ExpandEntities("ping <!subteam^S9999>"))
+}
+
+func TestExpandEntitiesSpecialMentions(t *testing.T) {
+	ctx := newEntitiesTestContext()
+	assert.Equal(t, "@here @channel @everyone", ctx.ExpandEntities("<!here> <!channel|channel> <!everyone>"))
+	assert.Equal(t, "label", ctx.ExpandEntities("<!unknown^thing|label>"))
+	assert.Equal(t, "<!unknown>", ctx.ExpandEntities("<!unknown>"))
+}
+
+func TestExpandEntitiesDates(t *testing.T) {
+	ctx := newEntitiesTestContext()
+	// 1392734382 is 2014-02-18 14:39:42 UTC, i.e. 15:39:42 in Rome
+	assert.Equal(t, "on 2014-02-18 at 3:39 PM", ctx.ExpandEntities("on <!date^1392734382^{date_num} at {time}|Feb 18, 2014>"))
+	assert.Equal(t, "Feb 18, 2014 (https://example.com)", ctx.ExpandEntities("<!date^1392734382^{date_short}^https://example.com|Feb 18, 2014>"))
+	assert.Equal(t, "fallback", ctx.ExpandEntities("<!date^notanumber^{date}|fallback>"))
+}
+
+func TestExpandEntitiesURLsUntouched(t *testing.T) {
+	ctx := newEntitiesTestContext()
+	assert.Equal(t, "<https://example.com|example>", ctx.ExpandEntities("<https://example.com|example>"))
+	// and ExpandText leaves the entities alone
+	assert.Equal(t, "<#C1234|general> example (https://example.com)", ExpandText("<#C1234|general> <https://example.com|example>"))
+}
+
+func TestFormatSlackDate(t *testing.T) {
+	loc := time.UTC
+	ts := int64(1392734382) // 2014-02-18 14:39:42 UTC, a Tuesday
+	now := time.Unix(ts, 0).Add(3 * time.Minute)
+	assert.Equal(t, "February 18th, 2014", FormatSlackDate(ts, "{date}", loc, now))
+	assert.Equal(t, "Feb 18, 2014", FormatSlackDate(ts, "{date_short}", loc, now))
+	assert.Equal(t, "Tuesday, February 18th, 2014", FormatSlackDate(ts, "{date_long}", loc, now))
+	assert.Equal(t, "today at 2:39:42 PM", FormatSlackDate(ts, "{date_pretty} at {time_secs}", loc, now))
+	assert.Equal(t, "yesterday", FormatSlackDate(ts, "{date_short_pretty}", loc, now.AddDate(0, 0, 1)))
+	assert.Equal(t, "Feb 18, 2014", FormatSlackDate(ts, "{date_short_pretty}", loc, now.AddDate(0, 0, 5)))
+	assert.Equal(t, "3 minutes ago", FormatSlackDate(ts, "{ago}", loc, now))
+	assert.Equal(t, "in 2 hours", FormatSlackDate(ts, "{ago}", loc, now.Add(-2*time.Hour-3*time.Minute)))
+	assert.Equal(t, "{unknown} 2014", FormatSlackDate(ts, "{unknown} 2014", loc, now))
+}
+
+func TestOrdinal(t *testing.T) {
+	for n, want := range map[int]string{1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 13: "13th", 21: "21st", 22: "22nd", 31: "31st"} {
+		assert.Equal(t, want, ordinal(n))
+	}
+}
@@ -1,9 +1,12 @@
 package ircslack
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"strings"
+	"time"
 
 	"github.com/slack-go/slack"
 )
@@ -28,7 +31,7 @@ func resolveChannelName(ctx *IrcContext, msgChannel, threadTimestamp string) str
 		channel := ctx.Channels.ByID(msgChannel)
 		if channel == nil {
 			// try fetching it, in case it's a new channel
-			channels, err := ctx.Channels.FetchByIDs(ctx.SlackClient, false, msgChannel)
+			channels, err := ctx.Channels.FetchByIDs(ctx.Context(), ctx.SlackClient, false, msgChannel)
 			if err != nil || len(channels) == 0 {
 				ctx.SendUnknownError("Failed to fetch channel with ID `%s`: %v", msgChannel, err)
 				return ""
@@ -41,6 +44,8 @@ func resolveChannelName(ctx *IrcContext, msgChannel, threadTimestamp string) str
 			return ""
 		} else if threadTimestamp != "" {
 			channame := formatThreadChannelName(threadTimestamp, channel)
+			// threads are joined again on every message
+			ctx.unhide(channame)
 			openingText, err := ctx.GetThreadOpener(msgChannel, threadTimestamp)
 			if err != nil {
 				ctx.SendUnknownError("Failed to get thread opener for `%s`: %v", msgChannel, err)
@@ -63,7 +68,8 @@ func resolveChannelName(ctx *IrcContext, msgChannel, threadTimestamp string) str
 			}
 			return channame
 		} else if channel.IsMpIM {
-			if ctx.Channels.ByName(channel.IRCName()) == nil {
+			// a multi-party IM that was parted is joined again
+			if ctx.Channels.ByName(channel.IRCName()) == nil || ctx.unhide(channel.IRCName()) {
 				members, err := ChannelMembers(ctx, channel.ID)
 				if err != nil {
 					log.Warningf("Failed to fetch channel members for `%s`: %v", channel.Name, err)
@@ -80,7 +86,7 @@ func resolveChannelName(ctx *IrcContext, msgChannel, threadTimestamp string) str
 		channel := ctx.Channels.ByID(msgChannel)
 		if channel == nil {
 			// not found locally, try to get it via Slack API
-			channels, err := ctx.Channels.FetchByIDs(ctx.SlackClient, false, msgChannel)
+			channels, err := ctx.Channels.FetchByIDs(ctx.Context(), ctx.SlackClient, false, msgChannel)
 			if err != nil || len(channels) == 0 {
 				ctx.SendUnknownError("Failed to fetch IM chat with ID `%s`: %v", msgChannel, err)
 				return ""
@@ -129,12 +135,22 @@ func resolveChannelName(ctx *IrcContext, msgChannel, threadTimestamp string) str
 			ctx.SendUnknownError("Unknown destination user ID %s for direct message %s", recipientID, msgChannel)
 			return ""
 		}
-		return nickname.Name
+		return ctx.NickOf(nickname)
 	}
 	log.Warningf("Unknown recipient ID: %s", msgChannel)
 	return ""
 }
 
+// refreshChannel fetches a channel again after Slack notified us that it has
+// changed, and invalidates the persistent cache.
+func refreshChannel(ctx *IrcContext, channelID string) {
+	if _, err := ctx.Channels.FetchByIDs(ctx.Context(), ctx.SlackClient, true, channelID); err != nil {
+		log.Warningf("Failed to fetch channel %s: %v", channelID, err)
+		return
+	}
+	ctx.Cache.Invalidate()
+}
+
 func appendIfNotMoreThan(slice []slack.Msg, msg slack.Msg) []slack.Msg {
 	if len(slice) == 100 {
 		return append(slice[1:], msg)
@@ -147,11 +163,16 @@ func getConversationDetails(
 	channelID string,
 	timestamp string,
 ) (slack.Message, error) {
-	message, err := ctx.SlackClient.GetConversationHistory(&slack.GetConversationHistoryParameters{
-		ChannelID: channelID,
-		Latest:    timestamp,
-		Limit:     1,
-		Inclusive: true,
+	var message *slack.GetConversationHistoryResponse
+	err := ctx.RateLimiter.Do(ctx.Context(), "conversations.history", PriorityHigh, func(c context.Context) error {
+		var err error
+		message, err = ctx.SlackClient.GetConversationHistoryContext(c, &slack.GetConversationHistoryParameters{
+			ChannelID: channelID,
+			Latest:    timestamp,
+			Limit:     1,
+			Inclusive: true,
+		})
+		return err
 	})
 	if err != nil {
 		return slack.Message{}, err
@@ -188,24 +209,38 @@ func printMessage(ctx *IrcContext, message slack.Msg, prefix string) {
 			name = strings.ReplaceAll(message.Username, " ", "_")
 		}
 	} else {
-		name = user.Name
+		name = ctx.NickOf(user)
 	}
 	// get channel or other recipient (e.g. recipient of a direct message)
 	channame := resolveChannelName(ctx, message.Channel, message.ThreadTimestamp)
 
 	text := message.Text
+	if len(message.Blocks.BlockSet) > 0 && (text == "" || !HasOnlyRichTextBlocks(message.Blocks)) {
+		// when there are blocks, the text is just a fallback for
+		// notifications
+		if rendered := RenderBlocks(message.Blocks); rendered != "" {
+			text = rendered
+		}
+	}
 	for _, attachment := range message.Attachments {
 		text = joinText(text, attachment.Pretext, "\n")
 		text = joinText(text, attachment.Title, "\n")
 		if attachment.Text != "" {
 			text = joinText(text, attachment.Text, "\n")
+		} else if len(attachment.Blocks.BlockSet) > 0 {
+			text = joinText(text, RenderBlocks(attachment.Blocks), "\n")
 		} else {
 			text = joinText(text, attachment.Fallback, "\n")
 		}
 		text = joinText(text, attachment.ImageURL, "\n")
 	}
 	for _, file := range message.Files {
-		text = joinText(text, ctx.FileHandler.Download(file), " ")
+		if strings.Contains(text, file.InitialComment.Comment) {
+			// the comment is usually the text of the message
+			file.InitialComment.Comment = ""
+		}
+		link := ctx.FileHandler.Download(ctx.Context(), file)
+		text = joinText(text, formatFile(file, link, ctx.FilePreviews[fileKind(file)]), " ")
 	}
 
 	log.Debugf("SLACK msg from %v (%v) on %v: %v",
@@ -219,8 +254,7 @@ func printMessage(ctx *IrcContext, message slack.Msg, prefix string) {
 		return
 	}
 	text = replacePermalinkWithText(ctx, text)
-	text = ctx.ExpandUserIds(text)
-	text = ExpandText(text)
+	text = ctx.ExpandText(text)
 	text = joinText(prefix, text, " ")
 
 	if name == ctx.Nick() {
@@ -254,9 +288,51 @@ func printMessage(ctx *IrcContext, message slack.Msg, prefix string) {
 	}
 }
 
+// rtmDisconnectTimeout is how long to wait for the Slack RTM connection to
+// terminate after the IRC client disconnects.
+const rtmDisconnectTimeout = 10 * time.Second
+
+// disconnectRTM waits for the IRC client to disconnect, then terminates the
+// Slack RTM connection. Events that arrive in the meantime are discarded, so
+// that the RTM goroutines are not blocked on a channel that nobody reads.
+func disconnectRTM(ctx *IrcContext, rtm *slack.RTM) {
+	<-ctx.Context().Done()
+	done := make(chan error, 1)
+	go func() {
+		done <- rtm.Disconnect()
+	}()
+	var disconnected, disconnectedEvent bool
+	timeout := time.NewTimer(rtmDisconnectTimeout)
+	defer timeout.Stop()
+	for !disconnected || !disconnectedEvent {
+		select {
+		case err := <-done:
+			if errors.Is(err, slack.ErrAlreadyDisconnected) {
+				return
+			}
+			disconnected = true
+		case msg := <-rtm.IncomingEvents:
+			if _, ok := msg.Data.(*slack.DisconnectedEvent); ok {
+				disconnectedEvent = true
+			}
+		case <-timeout.C:
+			log.Warningf("Timed out waiting for the Slack RTM connection to terminate")
+			return
+		}
+	}
+	log.Info("Disconnected from Slack")
+}
+
 func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 	log.Info("Started Slack event listener")
-	for msg := range rtm.IncomingEvents {
+	for {
+		var msg slack.RTMEvent
+		select {
+		case <-ctx.Context().Done():
+			// disconnectRTM takes care of the remaining events
+			return
+		case msg = <-rtm.IncomingEvents:
+		}
 		switch ev := msg.Data.(type) {
 		case *slack.MessageEvent:
 			// https://api.slack.com/events/message
@@ -276,19 +352,14 @@ func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 				editedMessage.Msg.Channel = message.Channel
 				printMessage(ctx, editedMessage.Msg, "(edited)")
 				continue
-			case "channel_topic":
+			case slack.MsgSubTypeChannelTopic, slack.MsgSubTypeGroupTopic:
 				// https://api.slack.com/events/message/channel_topic
-				// Send out new topic
-				channel := ctx.Channels.ByID(message.Channel)
-				if channel == nil {
-					log.Warningf("Cannot get channel name for %v", message.Channel)
-				} else {
-					newTopic := fmt.Sprintf(":%v TOPIC %s :%v\r\n", ctx.Mask(), channel.IRCName(), message.Topic)
-					log.Infof("Got new topic: %v", newTopic)
-					if _, err := ctx.Conn.Write([]byte(newTopic)); err != nil {
-						log.Warningf("Failed to send IRC message: %v", err)
-					}
-				}
+				handleTopicChange(ctx, message, true)
+				ctx.Cache.Invalidate()
+			case slack.MsgSubTypeChannelPurpose, slack.MsgSubTypeGroupPurpose:
+				// https://api.slack.com/events/message/channel_purpose
+				handleTopicChange(ctx, message, false)
+				ctx.Cache.Invalidate()
 			case "channel_join", "channel_leave":
 				// https://api.slack.com/events/message/channel_join
 				// https://api.slack.com/events/message/channel_leave
@@ -304,8 +375,8 @@ func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 			de := msg.Data.(*slack.DisconnectedEvent)
 			log.Warningf("Disconnected from Slack (intentional: %v, cause: %v)", de.Intentional, de.Cause)
 			ctx.SlackConnected = false
+			ctx.Close()
 			ctx.Conn.Close()
-			ctx.Users, ctx.Channels = nil, nil
 			return
 		case *slack.MemberJoinedChannelEvent:
 			// This is the currently preferred way to notify when a user joins a
@@ -336,15 +407,46 @@ func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 		case *slack.TeamJoinEvent:
 			// https://api.slack.com/events/team_join
 			// update the users list
-			if _, err := ctx.Users.FetchByIDs(ctx.SlackClient, false, ev.User.ID); err != nil {
-				log.Warningf("Failed to fetch users: %v", err)
-			}
+			ctx.Users.Add(ev.User)
+			ctx.Cache.Invalidate()
+			subscribePresence(ctx, ev.User.ID)
+		case *slack.PresenceChangeEvent:
+			// https://api.slack.com/events/presence_change
+			handlePresenceChange(ctx, ev)
 		case *slack.UserChangeEvent:
 			// https://api.slack.com/events/user_change
-			// update the user list
-			if _, err := ctx.Users.FetchByIDs(ctx.SlackClient, false, ev.User.ID); err != nil {
-				log.Warningf("Failed to fetch users: %v", err)
+			// update the user list. The event carries the whole user
+			// object, so there's no need to fetch it again
+			changes := ctx.Users.Add(ev.User)
+			if ctx.User != nil && ev.User.ID == ctx.User.ID {
+				user := ev.User
+				ctx.User = &user
 			}
+			ctx.SendNickChanges(changes)
+			ctx.Cache.Invalidate()
+			subscribePresence(ctx, ev.User.ID)
+		case *slack.ChannelCreatedEvent:
+			// https://api.slack.com/events/channel_created
+			refreshChannel(ctx, ev.Channel.ID)
+		case *slack.GroupCreatedEvent:
+			refreshChannel(ctx, ev.Channel.ID)
+		case *slack.ChannelRenameEvent:
+			// https://api.slack.com/events/channel_rename
+			refreshChannel(ctx, ev.Channel.ID)
+		case *slack.GroupRenameEvent:
+			refreshChannel(ctx, ev.Group.ID)
+		case *slack.ChannelArchiveEvent:
+			refreshChannel(ctx, ev.Channel)
+		case *slack.ChannelUnarchiveEvent:
+			refreshChannel(ctx, ev.Channel)
+		case *slack.GroupArchiveEvent:
+			refreshChannel(ctx, ev.Channel)
+		case *slack.GroupUnarchiveEvent:
+			refreshChannel(ctx, ev.Channel)
+		case *slack.ChannelDeletedEvent:
+			// https://api.slack.com/events/channel_deleted
+			ctx.Channels.Remove(ev.Channel)
+			ctx.Cache.Invalidate()
 		case *slack.ChannelJoinedEvent, *slack.ChannelLeftEvent:
 			// https://api.slack.com/events/channel_joined
 			// Note: this is handled by slack.MemberJoinedChannelEvent
@@ -358,7 +460,7 @@ func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 				log.Warningf("Error getting user info for %v", ev.User)
 				name = ev.User
 			} else {
-				name = user.Name
+				name = ctx.NickOf(user)
 			}
 			msg, err := getConversationDetails(ctx, ev.Item.Channel, ev.Item.Timestamp)
 			if err != nil {
@@ -367,15 +469,18 @@ func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 			}
 			msgText := msg.Text
 
-			msgText = ctx.ExpandUserIds(msgText)
-			msgText = ExpandText(msgText)
+			msgText = ctx.ExpandText(msgText)
 			msgText = strings.Split(msgText, "\n")[0]
 
 			msgText = msgText[:int(math.Min(float64(len(msgText)), 100))]
+			reaction := ":" + ev.Reaction + ":"
+			if emoji := ctx.emoji(); emoji != nil {
+				reaction = emoji.ToUnicode(reaction)
+			}
 
 			privmsg := fmt.Sprintf(":%v!%v@%v PRIVMSG %v :\x01ACTION reacted with %s to: \x0315%s\x03\x01\r\n",
 				name, ev.User, ctx.ServerName,
-				channame, ev.Reaction, msgText,
+				channame, reaction, msgText,
 			)
 			log.Debug(privmsg)
 			if _, err := ctx.Conn.Write([]byte(privmsg)); err != nil {
@@ -386,7 +491,7 @@ func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 			u := ctx.GetUserInfo(ev.User)
 			username := "<unknown>"
 			if u != nil {
-				username = u.Name
+				username = ctx.NickOf(u)
 			}
 			c, err := ctx.GetConversationInfo(ev.Channel)
 			channame := "<unknown or IM chat>"
@@ -394,6 +499,19 @@ func eventHandler(ctx *IrcContext, rtm *slack.RTM) {
 				channame = c.Name
 			}
 			log.Infof("User %s (%s) is typing on channel %s (%s)", ev.User, username, ev.Channel, channame)
+		case *slack.SubteamCreatedEvent:
+			// https://api.slack.com/events/subteam_created
+			ctx.UserGroups.Update(ev.Subteam)
+		case *slack.SubteamUpdatedEvent:
+			// https://api.slack.com/events/subteam_updated
+			ctx.UserGroups.Update(ev.Subteam)
+		case *slack.EmojiChangedEvent:
+			// https://api.slack.com/events/emoji_changed
+			if emoji := ctx.emoji(); emoji != nil {
+				if err := emoji.Fetch(ctx.Context(), ctx.SlackClient); err != nil {
+					log.Warningf("Failed to fetch custom emoji: %v", err)
+				}
+			}
 		case *slack.DesktopNotificationEvent:
 			// TODO implement actions on notifications
 			log.Infof("Event: Desktop notification: %+v", ev)
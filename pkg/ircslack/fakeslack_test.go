@@ -0,0 +1,73 @@
+package ircslack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/slack-go/slack"
+)
+
+// fakeSlackRoute replies to a request to the Slack API, whose form is already
+// parsed. It returns the call to record, if any, and the JSON body of the
+// reply.
+type fakeSlackRoute func(req *http.Request) (call, data string, err error)
+
+// fakeSlackAPI is a Slack HTTP client that replies to the requests with a
+// route, and records the calls that the route returns.
+type fakeSlackAPI struct {
+	route fakeSlackRoute
+	calls []string
+}
+
+func (c *fakeSlackAPI) Do(req *http.Request) (*http.Response, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	if c.route == nil {
+		return nil, errUnsupportedURL(req)
+	}
+	call, data, err := c.route(req)
+	if err != nil {
+		return nil, err
+	}
+	if call != "" {
+		c.calls = append(c.calls, call)
+	}
+	return newFakeSlackResponse(data), nil
+}
+
+// newFakeSlackResponse returns a successful HTTP response with the given body.
+func newFakeSlackResponse(data string) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(data)),
+	}
+}
+
+// errUnsupportedURL is the error of a fake Slack API for the requests that it
+// cannot reply to.
+func errUnsupportedURL(req *http.Request) error {
+	return fmt.Errorf("testing: http client URL not supported: %s", req.URL)
+}
+
+// newFakeSlackTestContext returns the context of the client "me", connected to
+// a fake Slack API that replies with the given route, if any.
+func newFakeSlackTestContext(route fakeSlackRoute) (*IrcContext, *fakeConn, *fakeSlackAPI) {
+	api := &fakeSlackAPI{route: route}
+	conn := &fakeConn{}
+	ctx := &IrcContext{
+		Conn:        conn,
+		ServerName:  "localhost",
+		User:        &slack.User{ID: "UME", Name: "me"},
+		Users:       NewUsers(0),
+		Channels:    NewChannels(0),
+		SlackClient: slack.New("test-token", slack.OptionHTTPClient(api)),
+	}
+	return ctx, conn, api
+}
@@ -1,15 +1,11 @@
 package ircslack
 
 import (
-	"fmt"
-	"io"
-	"math"
+	"context"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/slack-go/slack"
@@ -22,11 +18,24 @@ const (
 
 // FileHandler downloads files from slack
 type FileHandler struct {
-	SlackAPIKey          string
-	FileDownloadLocation string
-	ProxyPrefix          string
+	SlackAPIKey string
+	// Downloads downloads the files. If nil, files are not downloaded
+	Downloads   *DownloadManager
+	ProxyPrefix string
+	// FileServer, if set, serves the downloaded files, and takes precedence
+	// over ProxyPrefix
+	FileServer *FileServer
+
+	mu sync.Mutex
+	// fileIDs are the IDs of the files downloaded for this client, most
+	// recent last
+	fileIDs []string
 }
 
+// maxRecentDownloads is the number of downloads that a FileHandler remembers
+// for the DOWNLOADS command.
+const maxRecentDownloads = 20
+
 func retryableNetError(err error) bool {
 	if err == nil {
 		return false
@@ -51,53 +60,52 @@ func retryableHTTPError(resp *http.Response) bool {
 }
 
 // Download downloads url contents to a local file and returns a url to either
-// the file on slack's server or a downloaded file
-func (handler *FileHandler) Download(file slack.File) string {
+// the file on slack's server or a downloaded file. The download happens in the
+// background, and is aborted when ctx is done, unless other clients are
+// waiting for the same file.
+func (handler *FileHandler) Download(ctx context.Context, file slack.File) string {
 	fileURL := file.URLPrivate
-	if handler.FileDownloadLocation == "" || file.IsExternal || handler.SlackAPIKey == "" {
+	if handler.Downloads == nil || file.IsExternal || handler.SlackAPIKey == "" {
 		return fileURL
 	}
-	localFileName := fmt.Sprintf("%s_%s", file.ID, file.Title)
-	if !strings.HasSuffix(localFileName, file.Filetype) {
-		localFileName += "." + file.Filetype
+	localFileName, err := handler.Downloads.Enqueue(ctx, handler.SlackAPIKey, file)
+	if err != nil {
+		log.Warningf("Not downloading %s: %v", fileURL, err)
+		return fileURL
 	}
-	localFilePath := filepath.Join(handler.FileDownloadLocation, localFileName)
-	go func() {
-		out, err := os.Create(localFilePath)
-		if err != nil {
-			log.Warningf("Could not create file for download %s: %v", localFilePath, err)
-			return
-		}
-
-		defer out.Close()
-		request, _ := http.NewRequest("GET", fileURL, nil)
-		request.Header.Add("Authorization", "Bearer "+handler.SlackAPIKey)
-		var client = &http.Client{}
-		var resp *http.Response
-		for attempt := 0; attempt < maxHTTPAttempts; attempt++ {
-			resp, err = client.Do(request)
-			if err != nil && retryableNetError(err) || retryableHTTPError(resp) {
-				time.Sleep(retryInterval * time.Duration(math.Pow(float64(attempt), 2)))
-				continue
-			}
-			if err == nil {
-				break
-			}
-			log.Warningf("Error downloading %s: %v", fileURL, err)
-			return
-		}
-		if resp.StatusCode != http.StatusOK {
-			log.Debugf("Got %d while downloading %s", resp.StatusCode, fileURL)
-			return
-		}
-		defer resp.Body.Close()
-		_, err = io.Copy(out, resp.Body)
+	handler.mu.Lock()
+	handler.fileIDs = append(handler.fileIDs, file.ID)
+	if len(handler.fileIDs) > maxRecentDownloads {
+		handler.fileIDs = handler.fileIDs[len(handler.fileIDs)-maxRecentDownloads:]
+	}
+	handler.mu.Unlock()
+	if handler.FileServer != nil {
+		link, err := handler.FileServer.Link(localFileName)
 		if err != nil {
-			log.Warningf("Error writing %s: %v", fileURL, err)
+			log.Warningf("Cannot create a link to %s: %v", localFileName, err)
+			return fileURL
 		}
-	}()
+		return link
+	}
 	if handler.ProxyPrefix != "" {
 		return handler.ProxyPrefix + url.PathEscape(localFileName)
 	}
 	return fileURL
 }
+
+// Recent returns the status of the most recent downloads of this client.
+func (handler *FileHandler) Recent() []DownloadStatus {
+	if handler.Downloads == nil {
+		return nil
+	}
+	handler.mu.Lock()
+	fileIDs := append([]string(nil), handler.fileIDs...)
+	handler.mu.Unlock()
+	statuses := make([]DownloadStatus, 0, len(fileIDs))
+	for _, id := range fileIDs {
+		if status, ok := handler.Downloads.Status(id); ok {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,163 @@
+package ircslack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// Kinds of shared files, that can be previewed differently.
+const (
+	FileKindImage   = "image"
+	FileKindSnippet = "snippet"
+	FileKindPost    = "post"
+	FileKindOther   = "other"
+)
+
+// FileKinds returns a list of the kinds of files that can be configured in
+// FilePreviews.
+func FileKinds() []string {
+	return []string{FileKindImage, FileKindSnippet, FileKindPost, FileKindOther}
+}
+
+// FilePreview configures how shared files of one kind are shown on IRC.
+type FilePreview struct {
+	// Details shows the file's name, type, size, and for images their
+	// dimensions and description. Otherwise only the URL is shown
+	Details bool
+	// Lines is the number of lines of snippets and posts shown inline
+	Lines int
+}
+
+// FilePreviews configures how shared files are shown on IRC, by file kind.
+type FilePreviews map[string]FilePreview
+
+// DefaultFilePreviews is the default configuration of file previews, in the
+// format accepted by ParseFilePreviews.
+const DefaultFilePreviews = "image=details,snippet=5,post=5,other=details"
+
+// ParseFilePreviews parses a comma-separated list of kind=value, where kind is
+// one of FileKinds() and value is "none" to show only the URL, "details" to
+// show the file details, or a number of lines of text to show inline with the
+// details. Kinds that are not listed show only the URL.
+func ParseFilePreviews(s string) (FilePreviews, error) {
+	previews := make(FilePreviews)
+	if s == "" {
+		return previews, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		kind, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid file preview %q, want kind=value", item)
+		}
+		known := false
+		for _, k := range FileKinds() {
+			if kind == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown file kind %q, want one of %v", kind, FileKinds())
+		}
+		switch value {
+		case "none":
+			previews[kind] = FilePreview{}
+		case "details":
+			previews[kind] = FilePreview{Details: true}
+		default:
+			lines, err := strconv.Atoi(value)
+			if err != nil || lines < 0 {
+				return nil, fmt.Errorf("invalid file preview %q for %s, want none, details or a number of lines", value, kind)
+			}
+			previews[kind] = FilePreview{Details: true, Lines: lines}
+		}
+	}
+	return previews, nil
+}
+
+// fileKind returns the kind of a shared file.
+func fileKind(file slack.File) string {
+	switch {
+	case strings.HasPrefix(file.Mimetype, "image/"):
+		return FileKindImage
+	case file.Mode == "snippet":
+		return FileKindSnippet
+	case file.Mode == "post" || file.Mode == "docs" || file.Mode == "quip" || file.Mode == "canvas":
+		return FileKindPost
+	}
+	return FileKindOther
+}
+
+// formatFile returns the text shown on IRC for a shared file, with the given
+// link to the file. The text can span multiple lines, and uses mrkdwn for code
+// blocks.
+func formatFile(file slack.File, link string, preview FilePreview) string {
+	if !preview.Details {
+		return link
+	}
+	name := file.Name
+	if name == "" {
+		name = file.Title
+	}
+	var details []string
+	if file.PrettyType != "" {
+		details = append(details, file.PrettyType)
+	} else if file.Filetype != "" {
+		details = append(details, strings.ToUpper(file.Filetype))
+	}
+	if file.OriginalW > 0 && file.OriginalH > 0 {
+		details = append(details, fmt.Sprintf("%dx%d", file.OriginalW, file.OriginalH))
+	}
+	if file.Size > 0 {
+		details = append(details, formatSize(int64(file.Size)))
+	}
+	text := name
+	if len(details) > 0 {
+		text += " (" + strings.Join(details, ", ") + ")"
+	}
+	// the title is the description of the file, e.g. the alt text of an
+	// image, when it differs from the file name
+	if file.Title != "" && file.Title != name {
+		text += fmt.Sprintf(": %q", file.Title)
+	}
+	text = joinText(text, link, " ")
+	if comment := file.InitialComment.Comment; comment != "" {
+		text += "\n" + comment
+	}
+	if preview.Lines > 0 {
+		text = joinText(text, previewLines(file, preview.Lines), "\n")
+	}
+	return text
+}
+
+// previewLines returns up to maxLines lines of a snippet or post as a code
+// block, followed by the number of lines that are not shown.
+func previewLines(file slack.File, maxLines int) string {
+	content := file.Preview
+	if content == "" {
+		content = file.PreviewPlainText
+	}
+	content = strings.TrimRight(content, "\n")
+	if content == "" {
+		return ""
+	}
+	lines := strings.Split(content, "\n")
+	hidden := file.LinesMore
+	if len(lines) > maxLines {
+		hidden += len(lines) - maxLines
+		lines = lines[:maxLines]
+	}
+	if file.Lines > len(lines) {
+		hidden = file.Lines - len(lines)
+	}
+	text := "```\n" + strings.Join(lines, "\n") + "\n```"
+	if hidden == 1 {
+		text += "\n(1 more line)"
+	} else if hidden > 1 {
+		text += fmt.Sprintf("\n(%d more lines)", hidden)
+	}
+	return text
+}
@@ -0,0 +1,77 @@
+package ircslack
+
+import (
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilePreviews(t *testing.T) {
+	previews, err := ParseFilePreviews(DefaultFilePreviews)
+	require.NoError(t, err)
+	assert.Equal(t, FilePreviews{
+		FileKindImage:   {Details: true},
+		FileKindSnippet: {Details: true, Lines: 5},
+		FileKindPost:    {Details: true, Lines: 5},
+		FileKindOther:   {Details: true},
+	}, previews)
+
+	previews, err = ParseFilePreviews("image=none, snippet=0")
+	require.NoError(t, err)
+	assert.Equal(t, FilePreviews{FileKindImage: {}, FileKindSnippet: {Details: true}}, previews)
+
+	for _, s := range []string{"image", "video=details", "image=all", "snippet=-1"} {
+		_, err := ParseFilePreviews(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFileKind(t *testing.T) {
+	assert.Equal(t, FileKindImage, fileKind(slack.File{Mimetype: "image/png", Mode: "hosted"}))
+	assert.Equal(t, FileKindSnippet, fileKind(slack.File{Mimetype: "text/plain", Mode: "snippet"}))
+	assert.Equal(t, FileKindPost, fileKind(slack.File{Mode: "post"}))
+	assert.Equal(t, FileKindOther, fileKind(slack.File{Mimetype: "application/pdf", Mode: "hosted"}))
+}
+
+func TestFormatFile(t *testing.T) {
+	image := slack.File{
+		Name:       "cat.png",
+		Title:      "A cat on a keyboard",
+		PrettyType: "PNG",
+		Size:       2048,
+		OriginalW:  640,
+		OriginalH:  480,
+	}
+	assert.Equal(t, "https://example.com/cat.png", formatFile(image, "https://example.com/cat.png", FilePreview{}))
+	assert.Equal(t,
+		`cat.png (PNG, 640x480, 2.0 KiB): "A cat on a keyboard" https://example.com/cat.png`,
+		formatFile(image, "https://example.com/cat.png", FilePreview{Details: true}),
+	)
+
+	pdf := slack.File{Name: "report.pdf", Title: "report.pdf", Filetype: "pdf", Size: 100}
+	pdf.InitialComment.Comment = "here is the report"
+	assert.Equal(t,
+		"report.pdf (PDF, 100 B) https://example.com/report.pdf\nhere is the report",
+		formatFile(pdf, "https://example.com/report.pdf", FilePreview{Details: true, Lines: 5}),
+	)
+
+	snippet := slack.File{
+		Name:       "main.go",
+		Title:      "main.go",
+		PrettyType: "Go",
+		Mode:       "snippet",
+		Preview:    "package main\n\nfunc main() {\n}\n",
+		Lines:      10,
+	}
+	assert.Equal(t,
+		"main.go (Go) link\n```\npackage main\n\n```\n(8 more lines)",
+		formatFile(snippet, "link", FilePreview{Details: true, Lines: 2}),
+	)
+	snippet.Lines = 0
+	assert.Equal(t,
+		"main.go (Go) link\n```\npackage main\n\nfunc main() {\n}\n```",
+		formatFile(snippet, "link", FilePreview{Details: true, Lines: 5}),
+	)
+}
@@ -0,0 +1,182 @@
+package ircslack
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFileLinkExpiry is how long links to downloaded files are valid by
+// default.
+const DefaultFileLinkExpiry = 24 * time.Hour
+
+// DefaultMaxFileLinks is the default maximum number of links that a FileServer
+// keeps.
+const DefaultMaxFileLinks = 10000
+
+// fileLink is a link to a file served by a FileServer.
+type fileLink struct {
+	name    string
+	expires time.Time
+}
+
+// linkKey is the key of a link: the SHA-256 hash of its token. Links are looked
+// up by hash, so that the timing of the lookup does not reveal the token.
+type linkKey [sha256.Size]byte
+
+// FileServer serves the files downloaded by a FileHandler over HTTP. Every
+// file is only reachable through a link with an unguessable token, that
+// expires after Expiry. Links are kept in memory, so they do not survive a
+// restart.
+type FileServer struct {
+	// Dir is the directory that files are served from
+	Dir string
+	// BaseURL is the URL that the file server is reachable at, and that
+	// links are relative to
+	BaseURL string
+	// Username and Password enable basic authentication if either is set
+	Username string
+	Password string
+	// Expiry is how long links are valid. If zero, links never expire
+	Expiry time.Duration
+	// MaxLinks is the maximum number of links kept. When it is reached, the
+	// oldest links are removed. If zero, DefaultMaxFileLinks is used
+	MaxLinks int
+
+	mu    sync.Mutex
+	links map[linkKey]fileLink
+	// order holds the keys of the links from the oldest to the newest. It
+	// can also hold the keys of links that were already removed
+	order []linkKey
+}
+
+// Link returns a new link to the given file in Dir.
+func (fs *FileServer) Link(name string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("cannot generate file token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	var expires time.Time
+	if fs.Expiry > 0 {
+		expires = time.Now().Add(fs.Expiry)
+	}
+	key := linkKey(sha256.Sum256([]byte(token)))
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.links == nil {
+		fs.links = make(map[linkKey]fileLink)
+	}
+	// expired links are removed when new links are added. Links expire in
+	// the order they are added, so only the oldest ones need checking
+	now := time.Now()
+	for len(fs.order) > 0 {
+		l, ok := fs.links[fs.order[0]]
+		if ok && !l.expired(now) {
+			break
+		}
+		delete(fs.links, fs.order[0])
+		fs.order = fs.order[1:]
+	}
+	maxLinks := fs.MaxLinks
+	if maxLinks <= 0 {
+		maxLinks = DefaultMaxFileLinks
+	}
+	for len(fs.links) >= maxLinks {
+		delete(fs.links, fs.order[0])
+		fs.order = fs.order[1:]
+	}
+	fs.links[key] = fileLink{name: name, expires: expires}
+	fs.order = append(fs.order, key)
+	return strings.TrimSuffix(fs.BaseURL, "/") + "/" + token + "/" + url.PathEscape(name), nil
+}
+
+func (l fileLink) expired(now time.Time) bool {
+	return !l.expires.IsZero() && now.After(l.expires)
+}
+
+// lookup returns the file name for a token, if the link is valid.
+func (fs *FileServer) lookup(token string) (string, bool) {
+	key := linkKey(sha256.Sum256([]byte(token)))
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	l, ok := fs.links[key]
+	if !ok {
+		return "", false
+	}
+	if l.expired(time.Now()) {
+		delete(fs.links, key)
+		return "", false
+	}
+	return l.name, true
+}
+
+func (fs *FileServer) authorized(r *http.Request) bool {
+	if fs.Username == "" && fs.Password == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(fs.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(fs.Password)) == 1
+	return userOK && passOK
+}
+
+// ServeHTTP serves the files at /<token>/<name>. Content types and range
+// requests are handled by http.ServeContent.
+func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fs.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="irc-slack", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	token, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// the token is the secret, the name only has to match the link
+	linkName, ok := fs.lookup(token)
+	if !ok || name != linkName {
+		http.NotFound(w, r)
+		return
+	}
+	root, err := os.OpenRoot(fs.Dir)
+	if err != nil {
+		log.Warningf("Cannot open file server directory %s: %v", fs.Dir, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer root.Close()
+	f, err := root.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	// files come from Slack users, so do not let browsers run them as
+	// active content on this origin
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
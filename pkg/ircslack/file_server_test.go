@@ -0,0 +1,130 @@
+package ircslack
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFileServer(t *testing.T) (*FileServer, *httptest.Server) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "F1_hello world.txt"), []byte("hello world"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "F2_image.png"), []byte("\x89PNG\r\n\x1a\n"), 0o644))
+	fs := &FileServer{Dir: dir, Expiry: time.Hour}
+	server := httptest.NewServer(fs)
+	t.Cleanup(server.Close)
+	fs.BaseURL = server.URL + "/"
+	return fs, server
+}
+
+func getFile(t *testing.T, link string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest("GET", link, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestFileServer(t *testing.T) {
+	fs, server := newTestFileServer(t)
+	link, err := fs.Link("F1_hello world.txt")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(link, server.URL+"/"))
+	assert.True(t, strings.HasSuffix(link, "/F1_hello%20world.txt"))
+
+	resp, body := getFile(t, link, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "sandbox", resp.Header.Get("Content-Security-Policy"))
+
+	resp, body = getFile(t, link, http.Header{"Range": {"bytes=6-"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "world", body)
+
+	link, err = fs.Link("F2_image.png")
+	require.NoError(t, err)
+	resp, _ = getFile(t, link, nil)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	// a token only gives access to its own file
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	token := strings.Split(u.Path, "/")[1]
+	resp, _ = getFile(t, server.URL+"/"+token+"/F1_hello%20world.txt", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = getFile(t, server.URL+"/invalid/F2_image.png", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestFileServerExpiry(t *testing.T) {
+	fs, _ := newTestFileServer(t)
+	fs.Expiry = time.Nanosecond
+	link, err := fs.Link("F1_hello world.txt")
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	resp, _ := getFile(t, link, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	// expired links are removed when a new link is added
+	_, err = fs.Link("F2_image.png")
+	require.NoError(t, err)
+	assert.Len(t, fs.links, 1)
+}
+
+func TestFileServerMaxLinks(t *testing.T) {
+	fs, _ := newTestFileServer(t)
+	fs.Expiry = 0
+	fs.MaxLinks = 2
+	first, err := fs.Link("F1_hello world.txt")
+	require.NoError(t, err)
+	second, err := fs.Link("F2_image.png")
+	require.NoError(t, err)
+	third, err := fs.Link("F1_hello world.txt")
+	require.NoError(t, err)
+	assert.Len(t, fs.links, 2)
+
+	// the oldest link is removed
+	resp, _ := getFile(t, first, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = getFile(t, second, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = getFile(t, third, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestFileServerBasicAuth(t *testing.T) {
+	fs, _ := newTestFileServer(t)
+	fs.Username, fs.Password = "user", "secret"
+	link, err := fs.Link("F1_hello world.txt")
+	require.NoError(t, err)
+
+	resp, _ := getFile(t, link, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	u.User = url.UserPassword("user", "wrong")
+	resp, _ = getFile(t, u.String(), nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	u.User = url.UserPassword("user", "secret")
+	resp, body := getFile(t, u.String(), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello world", body)
+}
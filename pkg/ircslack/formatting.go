@@ -0,0 +1,293 @@
+package ircslack
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Formatting modes, i.e. how Slack's mrkdwn markup and IRC's formatting
+// control codes are translated between each other.
+const (
+	// FormattingIRC converts mrkdwn to IRC control codes and vice versa.
+	FormattingIRC = "irc"
+	// FormattingStrip removes all the formatting in both directions.
+	FormattingStrip = "strip"
+	// FormattingRaw leaves the text untouched in both directions.
+	FormattingRaw = "raw"
+)
+
+// FormattingModes returns a list of supported formatting modes.
+func FormattingModes() []string {
+	return []string{FormattingIRC, FormattingStrip, FormattingRaw}
+}
+
+// IRC formatting control codes, see https://modern.ircdocs.horse/formatting.html
+const (
+	IrcFormatBold          = "\x02"
+	IrcFormatItalic        = "\x1d"
+	IrcFormatUnderline     = "\x1f"
+	IrcFormatStrikethrough = "\x1e"
+	IrcFormatMonospace     = "\x11"
+	IrcFormatColor         = "\x03"
+	IrcFormatReverse       = "\x16"
+	IrcFormatReset         = "\x0f"
+)
+
+// ircQuoteColor is the IRC color used for block quotes (grey).
+const ircQuoteColor = "14"
+
+// mrkdwnStyle holds the strings to emit when converting each mrkdwn element.
+type mrkdwnStyle struct {
+	bold, italic, strike, code string
+	quoteStart, quoteEnd       string
+}
+
+var (
+	mrkdwnStyleIRC = mrkdwnStyle{
+		bold:       IrcFormatBold,
+		italic:     IrcFormatItalic,
+		strike:     IrcFormatStrikethrough,
+		code:       IrcFormatMonospace,
+		quoteStart: IrcFormatColor + ircQuoteColor + "> ",
+		quoteEnd:   IrcFormatColor,
+	}
+	mrkdwnStyleStrip = mrkdwnStyle{
+		quoteStart: "> ",
+	}
+)
+
+// MrkdwnToIRC converts Slack's mrkdwn markup (bold, italic, strikethrough,
+// inline code, code blocks and block quotes) to IRC formatting control codes.
+// Slack's special entities enclosed in < and > are left untouched.
+func MrkdwnToIRC(text string) string {
+	return convertMrkdwn(text, mrkdwnStyleIRC)
+}
+
+// StripMrkdwn removes Slack's mrkdwn markup from the text.
+func StripMrkdwn(text string) string {
+	return convertMrkdwn(text, mrkdwnStyleStrip)
+}
+
+func convertMrkdwn(text string, style mrkdwnStyle) string {
+	// code blocks can span multiple lines, and their content is not
+	// formatted, so they are handled first.
+	segments := strings.Split(text, "```")
+	if len(segments)%2 == 0 {
+		// unterminated code block, leave the last delimiter as it is
+		segments[len(segments)-2] += "```" + segments[len(segments)-1]
+		segments = segments[:len(segments)-1]
+	}
+	var b strings.Builder
+	for idx, segment := range segments {
+		if idx%2 == 1 {
+			segment = strings.TrimPrefix(segment, "\n")
+			segment = strings.TrimSuffix(segment, "\n")
+			lines := strings.Split(segment, "\n")
+			for lidx, line := range lines {
+				if lidx > 0 {
+					b.WriteString("\n")
+				}
+				if line != "" {
+					b.WriteString(style.code + line + style.code)
+				}
+			}
+			continue
+		}
+		lines := strings.Split(segment, "\n")
+		for lidx, line := range lines {
+			if lidx > 0 {
+				b.WriteString("\n")
+			}
+			quote := ""
+			for _, q := range []string{"&gt; ", "&gt;", "> ", ">"} {
+				if strings.HasPrefix(line, q) && (lidx > 0 || idx == 0) {
+					line, quote = line[len(q):], q
+					break
+				}
+			}
+			if quote != "" {
+				b.WriteString(style.quoteStart + convertMrkdwnInline(line, style) + style.quoteEnd)
+			} else {
+				b.WriteString(convertMrkdwnInline(line, style))
+			}
+		}
+	}
+	return b.String()
+}
+
+// convertMrkdwnInline converts the inline mrkdwn elements of a single line.
+func convertMrkdwnInline(line string, style mrkdwnStyle) string {
+	var b strings.Builder
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch c {
+		case '<':
+			// Slack entities, like links and mentions, are copied verbatim
+			if end := strings.IndexByte(line[i:], '>'); end > 0 {
+				b.WriteString(line[i : i+end+1])
+				i += end + 1
+				continue
+			}
+		case '`':
+			if end := strings.IndexByte(line[i+1:], '`'); end > 0 {
+				b.WriteString(style.code + line[i+1:i+1+end] + style.code)
+				i += end + 2
+				continue
+			}
+		case '*', '_', '~':
+			if end := findMrkdwnClosing(line, i); end > 0 {
+				var marker string
+				switch c {
+				case '*':
+					marker = style.bold
+				case '_':
+					marker = style.italic
+				case '~':
+					marker = style.strike
+				}
+				b.WriteString(marker + convertMrkdwnInline(line[i+1:end], style) + marker)
+				i = end + 1
+				continue
+			}
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String()
+}
+
+// findMrkdwnClosing returns the index of the delimiter closing the one at
+// position `start`, or -1 if the delimiter does not open a formatted span.
+// Like Slack, it requires the opening delimiter to be at a word boundary and
+// immediately followed by a non-space, and the closing one to be immediately
+// preceded by a non-space and followed by a word boundary.
+func findMrkdwnClosing(line string, start int) int {
+	delim := line[start]
+	if start > 0 {
+		if r, _ := utf8.DecodeLastRuneInString(line[:start]); isMrkdwnWordRune(r) {
+			return -1
+		}
+	}
+	if start+1 >= len(line) || line[start+1] == ' ' || line[start+1] == delim {
+		return -1
+	}
+	for i := start + 2; i < len(line); i++ {
+		// don't close spans inside entities or code
+		var skipTo byte
+		switch line[i] {
+		case '<':
+			skipTo = '>'
+		case '`':
+			skipTo = '`'
+		}
+		if skipTo != 0 {
+			if end := strings.IndexByte(line[i+1:], skipTo); end >= 0 {
+				i += end + 1
+				continue
+			}
+		}
+		if line[i] != delim || line[i-1] == ' ' {
+			continue
+		}
+		if i+1 < len(line) {
+			if r, _ := utf8.DecodeRuneInString(line[i+1:]); isMrkdwnWordRune(r) {
+				continue
+			}
+		}
+		return i
+	}
+	return -1
+}
+
+func isMrkdwnWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// IRCToMrkdwn converts IRC formatting control codes to Slack's mrkdwn markup.
+// Formatting that has no mrkdwn equivalent, like colors and underline, is
+// removed.
+func IRCToMrkdwn(text string) string {
+	return convertIRCFormatting(text, true)
+}
+
+// StripIRCFormatting removes all the IRC formatting control codes from the
+// text.
+func StripIRCFormatting(text string) string {
+	return convertIRCFormatting(text, false)
+}
+
+func convertIRCFormatting(text string, toMrkdwn bool) string {
+	markers := map[byte]string{
+		IrcFormatBold[0]:          "*",
+		IrcFormatItalic[0]:        "_",
+		IrcFormatStrikethrough[0]: "~",
+		IrcFormatMonospace[0]:     "`",
+	}
+	var (
+		b    strings.Builder
+		open []byte
+	)
+	closeAll := func() {
+		for i := len(open) - 1; i >= 0; i-- {
+			b.WriteString(markers[open[i]])
+		}
+		open = open[:0]
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case IrcFormatBold[0], IrcFormatItalic[0], IrcFormatStrikethrough[0], IrcFormatMonospace[0]:
+			if !toMrkdwn {
+				continue
+			}
+			// IRC codes toggle the formatting
+			if idx := strings.IndexByte(string(open), c); idx >= 0 {
+				// close the inner spans too, then reopen them, so that the
+				// mrkdwn is properly nested
+				inner := append([]byte{}, open[idx+1:]...)
+				for j := len(open) - 1; j >= idx; j-- {
+					b.WriteString(markers[open[j]])
+				}
+				open = append(open[:idx], inner...)
+				for _, m := range inner {
+					b.WriteString(markers[m])
+				}
+			} else {
+				open = append(open, c)
+				b.WriteString(markers[c])
+			}
+		case IrcFormatUnderline[0], IrcFormatReverse[0]:
+			// no mrkdwn equivalent
+		case IrcFormatReset[0]:
+			if toMrkdwn {
+				closeAll()
+			}
+		case IrcFormatColor[0]:
+			// skip the optional foreground and background color numbers,
+			// i.e. \x03[N[N][,N[N]]]
+			i += skipIRCColorDigits(text[i+1:])
+			if i+2 < len(text) && text[i+1] == ',' {
+				if n := skipIRCColorDigits(text[i+2:]); n > 0 {
+					i += n + 1
+				}
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if toMrkdwn {
+		closeAll()
+	}
+	return b.String()
+}
+
+// skipIRCColorDigits returns how many bytes (up to two) at the beginning of
+// the string are part of a color number.
+func skipIRCColorDigits(s string) int {
+	n := 0
+	for n < 2 && n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
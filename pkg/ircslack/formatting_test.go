@@ -0,0 +1,62 @@
+package ircslack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMrkdwnToIRCInline(t *testing.T) {
+	assert.Equal(t, "a \x02bold\x02 word", MrkdwnToIRC("a *bold* word"))
+	assert.Equal(t, "\x1ditalic\x1d", MrkdwnToIRC("_italic_"))
+	assert.Equal(t, "\x1estrike\x1e.", MrkdwnToIRC("~strike~."))
+	assert.Equal(t, "run \x11ls *.go\x11", MrkdwnToIRC("run `ls *.go`"))
+	assert.Equal(t, "\x02\x1dboth\x1d\x02", MrkdwnToIRC("*_both_*"))
+}
+
+func TestMrkdwnToIRCNotFormatted(t *testing.T) {
+	for _, text := range []string{
+		"snake_case_name",
+		"2*3*4",
+		"a * b * c",
+		"* not bold*",
+		"**",
+		"<http://example.com/a_b_c|a_b_>",
+		"<@U1234> _",
+	} {
+		assert.Equal(t, text, MrkdwnToIRC(text))
+	}
+}
+
+func TestMrkdwnToIRCCodeBlock(t *testing.T) {
+	assert.Equal(t,
+		"look:\n\x11func *main*() {\x11\n\x11}\x11\ndone",
+		MrkdwnToIRC("look:\n```\nfunc *main*() {\n}\n```\ndone"),
+	)
+	// unterminated code block
+	assert.Equal(t, "```a \x02b\x02", MrkdwnToIRC("```a *b*"))
+}
+
+func TestMrkdwnToIRCQuote(t *testing.T) {
+	assert.Equal(t, "\x0314> quoted \x02text\x02\x03\nnot quoted", MrkdwnToIRC("&gt; quoted *text*\nnot quoted"))
+	assert.Equal(t, "a > b", MrkdwnToIRC("a > b"))
+}
+
+func TestStripMrkdwn(t *testing.T) {
+	assert.Equal(t, "bold italic strike code\n> quote\nblock", StripMrkdwn("*bold* _italic_ ~strike~ `code`\n&gt; quote\n```block```"))
+}
+
+func TestIRCToMrkdwn(t *testing.T) {
+	assert.Equal(t, "a *bold* _italic_ ~strike~ `code`", IRCToMrkdwn("a \x02bold\x02 \x1ditalic\x1d \x1estrike\x1e \x11code\x11"))
+	// unterminated and reset formatting is closed
+	assert.Equal(t, "*_bold italic_* plain", IRCToMrkdwn("\x02\x1dbold italic\x0f plain"))
+	assert.Equal(t, "*bold*", IRCToMrkdwn("\x02bold"))
+	// overlapping formatting is nested properly
+	assert.Equal(t, "*a _b_*_ c_", IRCToMrkdwn("\x02a \x1db\x02 c\x1d"))
+	// colors and underline are removed
+	assert.Equal(t, "red on blue, underlined", IRCToMrkdwn("\x0304,12red on blue\x03, \x1funderlined\x1f"))
+}
+
+func TestStripIRCFormatting(t *testing.T) {
+	assert.Equal(t, "bold green x", StripIRCFormatting("\x02bold\x02 \x0303green\x03 \x0301,01x\x0f"))
+}
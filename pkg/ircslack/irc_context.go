@@ -1,9 +1,11 @@
 package ircslack
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/slack-go/slack"
@@ -21,22 +23,136 @@ type IrcContext struct {
 	Conn net.Conn
 	User *slack.User
 	// TODO make RealName a function
-	RealName          string
-	OrigName          string
-	SlackClient       *slack.Client
-	SlackRTM          *slack.RTM
-	SlackAPIKey       string
-	SlackDebug        bool
-	SlackConnected    bool
-	ServerName        string
-	Channels          *Channels
-	Users             *Users
-	ChunkSize         int
+	RealName       string
+	OrigName       string
+	SlackClient    *slack.Client
+	SlackRTM       *slack.RTM
+	SlackAPIKey    string
+	SlackDebug     bool
+	SlackConnected bool
+	ServerName     string
+	Channels       *Channels
+	Users          *Users
+	// RateLimiter schedules all the requests to the Slack API made with this
+	// client's token
+	RateLimiter *RateLimiter
+	UserGroups  *UserGroups
+	ChunkSize   int
+	// BatchWindow is how long to wait for more lines before posting them
+	// to Slack as a single message. If zero, every line is posted as soon as
+	// it is received
+	BatchWindow time.Duration
+	// BatchMaxSize is the maximum size in bytes of a batched message. If
+	// zero, only Slack's limit applies
+	BatchMaxSize int
+	// SnippetLines is the number of lines above which a message is uploaded
+	// as a snippet instead of being posted. If zero, messages are always
+	// posted
+	SnippetLines int
+	// FormatPaste wraps the messages that look like pasted code, stack
+	// traces or logs in a code block
+	FormatPaste bool
+	// UploadDir is the directory that local files can be uploaded from with
+	// the UPLOAD command. If empty, local files cannot be uploaded
+	UploadDir string
+	// UploadURLs enables uploading files from http(s) URLs with the UPLOAD
+	// command. Only public addresses are downloaded from
+	UploadURLs bool
+	// allowPrivateURLs disables the check of the addresses of the URLs, for
+	// testing
+	allowPrivateURLs  bool
 	postMessage       chan SlackPostMessage
 	conversationCache map[string]*slack.Channel
 	FileHandler       *FileHandler
+	// Emoji translates emoji shortcodes to and from Unicode when
+	// TranslateEmoji is set. If nil, emoji are passed through unchanged
+	Emoji *Emoji
+	// TranslateEmoji enables the translation of emoji. The client can
+	// change it with SET, see emoji
+	TranslateEmoji bool
+	// ListArchived includes archived channels in LIST replies
+	ListArchived bool
+	// CreateChannels creates the Slack channels that do not exist when they
+	// are joined
+	CreateChannels bool
+	// FilePreviews configures how shared files are shown. If nil, only
+	// their URL is shown
+	FilePreviews FilePreviews
+	// AwayMode is one of the AwayMode* modes, and determines what AWAY does
+	// besides setting the Slack presence
+	AwayMode string
+	// TopicMode is one of the TopicMode* modes, and determines which Slack
+	// channel attribute is the IRC topic. If empty, it is TopicModePurpose
+	TopicMode string
+	// Formatting is one of the Formatting* modes, and determines how
+	// mrkdwn and IRC formatting are translated. If empty, it is
+	// FormattingRaw. The client can change it with SET, see formatting
+	Formatting string
+	// CacheDir is the directory of the persistent users and channels cache.
+	// If empty, the cache is disabled and Cache is nil
+	CacheDir string
+	Cache    *Cache
 	// set to `true` if we are using a deprecated legacy token, false otherwise
 	usingLegacyToken bool
+	// slackAPIURL overrides the URL of the Slack API, for testing
+	slackAPIURL string
+	// baseCtx is cancelled when the client disconnects, see Context and
+	// Close
+	baseCtx   context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	// drain is closed by Shutdown to ask Start to post the pending messages
+	// and return, and drained is closed when Start returns
+	drain     chan struct{}
+	drained   chan struct{}
+	drainOnce sync.Once
+	// wg tracks the background goroutines of the client, see goBackground
+	wg sync.WaitGroup
+	// caps are the IRCv3 capabilities enabled by the client
+	caps map[string]bool
+	// batches are the multiline batches being received, by reference
+	batches map[string]*multilineBatch
+	// hidden are the IRC names of the conversations that the client parted
+	// without leaving them on Slack. They are shown again on the next
+	// message
+	hiddenMu sync.Mutex
+	hidden   map[string]bool
+	// away are the IDs of the users that are away on Slack, savedStatus is
+	// the Slack status of the client before AWAY, see AwayModeStatus, and
+	// presenceSubs are the IDs of the users whose presence is subscribed to
+	presenceMu   sync.Mutex
+	away         map[string]bool
+	savedStatus  *slackStatus
+	presenceSubs map[string]bool
+	// optionsMu protects the options that the client can change with SET
+	optionsMu sync.Mutex
+}
+
+// Context returns the context of this client, which is cancelled when the
+// client disconnects. It is used for all the requests to the Slack API and for
+// the background goroutines of the client.
+func (ic *IrcContext) Context() context.Context {
+	if ic.baseCtx == nil {
+		return context.Background()
+	}
+	return ic.baseCtx
+}
+
+// Close cancels the context of this client, stopping its background
+// goroutines and aborting its pending requests, and saves the persistent cache.
+// It is safe to call Close more than once.
+func (ic *IrcContext) Close() {
+	ic.closeOnce.Do(func() {
+		if ic.cancel != nil {
+			ic.cancel()
+		}
+		if stats := ic.RateLimiter.String(); stats != "" {
+			log.Debugf("Slack API calls of %s:\n%s", ic.Nick(), stats)
+		}
+		if err := ic.Cache.Flush(); err != nil {
+			log.Warningf("Failed to save cache: %v", err)
+		}
+	})
 }
 
 // Nick returns the nickname of the user, if known
@@ -44,7 +160,18 @@ func (ic *IrcContext) Nick() string {
 	if ic.User == nil {
 		return "<unknown>"
 	}
-	return ic.User.Name
+	return ic.NickOf(ic.User)
+}
+
+// NickOf returns the IRC nickname of a Slack user, as derived by the nick
+// policy. If the user is not in the cache, the Slack user name is returned.
+func (ic *IrcContext) NickOf(user *slack.User) string {
+	if ic.Users != nil {
+		if nick := ic.Users.NickByID(user.ID); nick != "" {
+			return nick
+		}
+	}
+	return user.Name
 }
 
 // UserName returns the user's name. Currently this is equivalent to the user's
@@ -58,9 +185,14 @@ func (ic *IrcContext) UserName() string {
 
 // GetThreadOpener returns text of the first message in a thread that provided message belongs to
 func (ic *IrcContext) GetThreadOpener(channel string, threadTimestamp string) (slack.Message, error) {
-	msgs, _, _, err := ic.SlackClient.GetConversationReplies(&slack.GetConversationRepliesParameters{
-		ChannelID: channel,
-		Timestamp: threadTimestamp,
+	var msgs []slack.Message
+	err := ic.RateLimiter.Do(ic.Context(), "conversations.replies", PriorityHigh, func(ctx context.Context) error {
+		var err error
+		msgs, _, _, err = ic.SlackClient.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+			ChannelID: channel,
+			Timestamp: threadTimestamp,
+		})
+		return err
 	})
 	if err != nil || len(msgs) == 0 {
 		return slack.Message{}, err
@@ -68,53 +200,162 @@ func (ic *IrcContext) GetThreadOpener(channel string, threadTimestamp string) (s
 	return msgs[0], nil
 }
 
-// ExpandUserIds will convert slack user tags with user's nicknames
-func (ic *IrcContext) ExpandUserIds(text string) string {
-	return rxSlackUser.ReplaceAllStringFunc(text, func(subs string) string {
-		uid := subs[2 : len(subs)-1]
-		user := ic.GetUserInfo(uid)
-		if user == nil {
-			return subs
-		}
-		return fmt.Sprintf("@%s", user.Name)
-	})
+// ExpandText expands the Slack-specific markup of a message's text for
+// visualization on IRC. Unlike the ExpandText function, it also expands the
+// entities that need this client's context, like mentions and emoji.
+func (ic *IrcContext) ExpandText(text string) string {
+	switch ic.formatting() {
+	case FormattingIRC:
+		text = MrkdwnToIRC(text)
+	case FormattingStrip:
+		text = StripMrkdwn(text)
+	}
+	text = ic.ExpandEntities(text)
+	text = ExpandText(text)
+	if emoji := ic.emoji(); emoji != nil {
+		text = emoji.ToUnicode(text)
+	}
+	return text
+}
+
+// FormatOutgoingText converts the IRC formatting of a message's text to
+// Slack's mrkdwn, according to the client's formatting mode.
+func (ic *IrcContext) FormatOutgoingText(text string) string {
+	switch ic.formatting() {
+	case FormattingIRC:
+		return IRCToMrkdwn(text)
+	case FormattingStrip:
+		return StripIRCFormatting(text)
+	default:
+		return text
+	}
 }
 
-// Start handles batching of messages to slack
+// Start handles batching of messages to slack. It returns when the client
+// disconnects, or after posting the pending messages when the client is shut
+// down, see Shutdown.
 func (ic *IrcContext) Start() {
-	textBuffer := make(map[string]string)
-	timer := time.NewTimer(time.Second)
-	var message SlackPostMessage
+	if ic.drained != nil {
+		defer close(ic.drained)
+	}
+	batcher := newMessageBatcher(ic.BatchMaxSize)
+	timer := time.NewTimer(ic.BatchWindow)
+	defer timer.Stop()
 	for {
 		select {
-		case message = <-ic.postMessage:
+		case <-ic.Context().Done():
+			return
+		case <-ic.drain:
+			ic.postMessages(batcher.Flush())
+			return
+		case message := <-ic.postMessage:
 			log.Debugf("Got new message %v", message)
-			textBuffer[message.Target] += message.Text + "\n"
-			timer.Reset(time.Second)
+			ic.postMessages(batcher.Add(message))
+			if ic.BatchWindow <= 0 {
+				// batching is disabled
+				ic.postMessages(batcher.Flush())
+				continue
+			}
+			timer.Reset(ic.BatchWindow)
 		case <-timer.C:
-			for target, text := range textBuffer {
-				opts := []slack.MsgOption{}
-				opts = append(opts, slack.MsgOptionAsUser(true))
-				opts = append(opts, slack.MsgOptionText(strings.TrimSpace(text), false))
-				if message.TargetTs != "" {
-					opts = append(opts, slack.MsgOptionTS(message.TargetTs))
-				}
-				if _, _, err := ic.SlackClient.PostMessage(target, opts...); err != nil {
-					log.Warningf("Failed to post message to Slack to target %s: %v", target, err)
-				}
+			ic.postMessages(batcher.Flush())
+		}
+	}
+}
+
+// postMessages posts the batched messages to Slack, in order. Pasted code is
+// wrapped in a code block if FormatPaste is set, and long pastes are uploaded
+// as snippets if SnippetLines is set.
+func (ic *IrcContext) postMessages(messages []SlackPostMessage) {
+	for _, message := range messages {
+		if ic.SnippetLines > 0 && strings.Count(message.Text, "\n")+1 > ic.SnippetLines {
+			err := ic.uploadSnippet(message)
+			if err == nil {
+				continue
 			}
-			textBuffer = make(map[string]string)
+			log.Warningf("Failed to upload snippet, posting it as a message: %v", err)
+		}
+		if ic.FormatPaste {
+			message.Text = formatPaste(message.Text)
+		}
+		opts := []slack.MsgOption{}
+		opts = append(opts, slack.MsgOptionAsUser(true))
+		opts = append(opts, slack.MsgOptionText(message.Text, false))
+		if message.TargetTs != "" {
+			opts = append(opts, slack.MsgOptionTS(message.TargetTs))
+		}
+		err := ic.RateLimiter.Do(ic.Context(), "chat.postMessage", PriorityHigh, func(ctx context.Context) error {
+			_, _, err := ic.SlackClient.PostMessageContext(ctx, message.Target, opts...)
+			return err
+		})
+		if err != nil {
+			log.Warningf("Failed to post message to Slack to target %s: %v", message.Target, err)
 		}
 	}
 }
 
-// PostTextMessage batches all messages that should be posted to slack
+// PostTextMessage batches all messages that should be posted to slack. The
+// message is dropped if the client has disconnected or is shutting down.
 func (ic *IrcContext) PostTextMessage(target, text, targetTs string) {
-	ic.postMessage <- SlackPostMessage{
+	select {
+	case ic.postMessage <- SlackPostMessage{
 		Target:   target,
 		TargetTs: targetTs,
 		Text:     text,
+	}:
+	case <-ic.drain:
+		log.Warningf("Dropping message to %s, the client is shutting down", target)
+	case <-ic.Context().Done():
+	}
+}
+
+// Shutdown gracefully disconnects the client: it notifies the IRC client with
+// the given reason, posts the pending messages to Slack, closes the Slack RTM
+// connection, and finally closes the IRC connection. If ctx is done before
+// the shutdown completes, the connections are closed anyway and ctx's error is
+// returned.
+func (ic *IrcContext) Shutdown(ctx context.Context, reason string) error {
+	ic.SendNotice("%s", reason)
+	errMsg := fmt.Sprintf("ERROR :Closing Link: %s (%s)\r\n", ic.Conn.RemoteAddr(), reason)
+	if _, err := ic.Conn.Write([]byte(errMsg)); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
 	}
+	defer ic.Conn.Close()
+	ic.drainOnce.Do(func() {
+		if ic.drain != nil {
+			close(ic.drain)
+		}
+	})
+	var err error
+	if ic.drained != nil {
+		select {
+		case <-ic.drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	// cancelling the context also closes the Slack RTM connection
+	ic.Close()
+	done := make(chan struct{})
+	go func() {
+		ic.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+// goBackground runs f in a goroutine that Shutdown waits for.
+func (ic *IrcContext) goBackground(f func()) {
+	ic.wg.Add(1)
+	go func() {
+		defer ic.wg.Done()
+		f()
+	}()
 }
 
 // GetUserInfo returns a slack.User instance from a given user ID, or nil if
@@ -137,8 +378,31 @@ func (ic *IrcContext) GetUserInfoByName(username string) *slack.User {
 	return u
 }
 
+// GetUserInfoByNick returns a slack.User instance from a given IRC nickname,
+// or nil if no user with that nickname was found
+func (ic *IrcContext) GetUserInfoByNick(nick string) *slack.User {
+	u := ic.Users.ByNick(nick)
+	if u == nil {
+		log.Warningf("GetUserInfoByNick: unknown nickname '%s'", nick)
+	}
+	return u
+}
+
+// lookupUser returns the user with the given IRC nickname, name or display
+// name, or nil if not found. Unlike GetUserInfoByNick, it doesn't warn about
+// unknown users.
+func (ic *IrcContext) lookupUser(name string) *slack.User {
+	if ic.Users == nil {
+		return nil
+	}
+	if user := ic.Users.ByNick(name); user != nil {
+		return user
+	}
+	return ic.Users.ByNameOrDisplayName(name)
+}
+
 // UserID returns the user's Slack ID
-func (ic IrcContext) UserID() string {
+func (ic *IrcContext) UserID() string {
 	if ic.User == nil {
 		return "<unknown>"
 	}
@@ -146,17 +410,37 @@ func (ic IrcContext) UserID() string {
 }
 
 // Mask returns the IRC mask for the current user
-func (ic IrcContext) Mask() string {
+func (ic *IrcContext) Mask() string {
 	return fmt.Sprintf("%v!%v@%v", ic.Nick(), ic.UserName(), ic.Conn.RemoteAddr().(*net.TCPAddr).IP)
 }
 
+// SendNickChanges notifies the IRC client that the nicknames of some users
+// have changed. The source of each NICK message is the user's old mask.
+func (ic *IrcContext) SendNickChanges(changes []NickChange) {
+	for _, change := range changes {
+		host := ic.ServerName
+		if ic.User != nil && change.UserID == ic.User.ID {
+			host = ic.Conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		}
+		msg := fmt.Sprintf(":%s!%s@%s NICK %s\r\n", change.OldNick, change.UserID, host, change.NewNick)
+		log.Debug(msg)
+		if _, err := ic.Conn.Write([]byte(msg)); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+	}
+}
+
 // GetConversationInfo is cached version of slack.GetConversationInfo
-func (ic IrcContext) GetConversationInfo(conversation string) (*slack.Channel, error) {
+func (ic *IrcContext) GetConversationInfo(conversation string) (*slack.Channel, error) {
 	c, ok := ic.conversationCache[conversation]
 	if ok {
 		return c, nil
 	}
-	c, err := ic.SlackClient.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: conversation, IncludeLocale: true, IncludeNumMembers: true})
+	err := ic.RateLimiter.Do(ic.Context(), "conversations.info", PriorityHigh, func(ctx context.Context) error {
+		var err error
+		c, err = ic.SlackClient.GetConversationInfoContext(ctx, &slack.GetConversationInfoInput{ChannelID: conversation, IncludeLocale: true, IncludeNumMembers: true})
+		return err
+	})
 	if err != nil {
 		return c, err
 	}
@@ -167,8 +451,19 @@ func (ic IrcContext) GetConversationInfo(conversation string) (*slack.Channel, e
 // Maps of user contexts and nicknames
 var (
 	UserContexts = map[net.Addr]*IrcContext{}
+	// userContextsMu protects UserContexts, that is accessed by the
+	// goroutines of all the clients
+	userContextsMu sync.Mutex
 )
 
+// SendNotice sends a NOTICE from the server to the client.
+func (ic *IrcContext) SendNotice(fmtstr string, args ...interface{}) {
+	msg := fmt.Sprintf(":%s NOTICE %s :%s\r\n", ic.ServerName, ic.Nick(), fmt.Sprintf(fmtstr, args...))
+	if _, err := ic.Conn.Write([]byte(msg)); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
 // SendUnknownError sends an IRC 400 (ERR_UNKNOWNERROR) message to the client
 // and prints a warning about it.
 func (ic *IrcContext) SendUnknownError(fmtstr string, args ...interface{}) {
@@ -178,3 +473,25 @@ func (ic *IrcContext) SendUnknownError(fmtstr string, args ...interface{}) {
 		log.Warningf("Failed to send ERR_UNKNOWNERROR (400) to client: %v", err)
 	}
 }
+
+// hide hides a conversation until its next message, see unhide.
+func (ic *IrcContext) hide(channame string) {
+	ic.hiddenMu.Lock()
+	defer ic.hiddenMu.Unlock()
+	if ic.hidden == nil {
+		ic.hidden = make(map[string]bool)
+	}
+	ic.hidden[channame] = true
+}
+
+// unhide shows a conversation again. It returns true if it was hidden, in
+// which case the client has to be notified that it joined it again.
+func (ic *IrcContext) unhide(channame string) bool {
+	ic.hiddenMu.Lock()
+	defer ic.hiddenMu.Unlock()
+	if !ic.hidden[channame] {
+		return false
+	}
+	delete(ic.hidden, channame)
+	return true
+}
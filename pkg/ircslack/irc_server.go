@@ -1,12 +1,15 @@
 package ircslack
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,20 +31,29 @@ type IrcCommandHandler func(*IrcContext, string, string, []string, string)
 
 // IrcCommandHandlers maps each IRC command to its handler function
 var IrcCommandHandlers = map[string]IrcCommandHandler{
-	"CAP":     IrcCapHandler,
-	"NICK":    IrcNickHandler,
-	"USER":    IrcUserHandler,
-	"PING":    IrcPingHandler,
-	"PRIVMSG": IrcPrivMsgHandler,
-	"QUIT":    IrcQuitHandler,
-	"MODE":    IrcModeHandler,
-	"PASS":    IrcPassHandler,
-	"WHOIS":   IrcWhoisHandler,
-	"WHO":     IrcWhoHandler,
-	"JOIN":    IrcJoinHandler,
-	"PART":    IrcPartHandler,
-	"TOPIC":   IrcTopicHandler,
-	"NAMES":   IrcNamesHandler,
+	"BATCH":      IrcBatchHandler,
+	"CAP":        IrcCapHandler,
+	"NICK":       IrcNickHandler,
+	"USER":       IrcUserHandler,
+	"UPLOAD":     IrcUploadHandler,
+	"DOWNLOADS":  IrcDownloadsHandler,
+	"RATELIMITS": IrcRateLimitsHandler,
+	"SET":        IrcSetHandler,
+	"LIST":       IrcListHandler,
+	"PING":       IrcPingHandler,
+	"PRIVMSG":    IrcPrivMsgHandler,
+	"QUIT":       IrcQuitHandler,
+	"MODE":       IrcModeHandler,
+	"PASS":       IrcPassHandler,
+	"WHOIS":      IrcWhoisHandler,
+	"WHO":        IrcWhoHandler,
+	"JOIN":       IrcJoinHandler,
+	"PART":       IrcPartHandler,
+	"INVITE":     IrcInviteHandler,
+	"AWAY":       IrcAwayHandler,
+	"KICK":       IrcKickHandler,
+	"TOPIC":      IrcTopicHandler,
+	"NAMES":      IrcNamesHandler,
 }
 
 // IrcNumericsSafeToChunk is a list of IRC numeric replies that are safe
@@ -91,7 +103,6 @@ func SplitReply(preamble, msg string, chunksize int) []string {
 
 var (
 	rxSlackUrls       = regexp.MustCompile(`<[^>]+>?`)
-	rxSlackUser       = regexp.MustCompile(`<@[UW][A-Z0-9]+>`)
 	rxSlackArchiveURL = regexp.MustCompile(`https?:\\/\\/[a-z0-9\\-]+\\.slack\\.com\\/archives\\/([a-zA-Z0-9]+)\\/p([0-9]{10})([0-9]{6})`)
 )
 
@@ -107,6 +118,11 @@ func ExpandText(text string) string {
 		if !strings.HasPrefix(subs, "<") && !strings.HasSuffix(subs, ">") {
 			return subs
 		}
+		if len(subs) > 1 && strings.ContainsRune("@#!", rune(subs[1])) {
+			// mentions and other special entities are not URLs, see
+			// IrcContext.ExpandEntities
+			return subs
+		}
 
 		// Slack URLs may contain an URL followed by a "|", followed by the
 		// original message. Detect the pipe and only parse the URL.
@@ -153,25 +169,32 @@ func SendIrcNumeric(ctx *IrcContext, code int, args, desc string) error {
 // IrcSendChanInfoAfterJoin sends channel information to the user about a joined
 // channel.
 func IrcSendChanInfoAfterJoin(ctx *IrcContext, ch *Channel, members []slack.User) {
-	IrcSendChanInfoAfterJoinCustom(ctx, ch.IRCName(), ch.ID, ch.Purpose.Value, members)
+	sendChanInfoAfterJoin(ctx, ch.IRCName(), ch.ID, topicOf(ch, ctx.topicMode()), members)
 }
 
 // IrcSendChanInfoAfterJoinCustom sends channel information to the user about a joined
 // channel. It can be used as an alternative to IrcSendChanInfoAfterJoin when
 // you need to specify custom chan name, id, and topic.
 func IrcSendChanInfoAfterJoinCustom(ctx *IrcContext, chanName, chanID, topic string, members []slack.User) {
+	sendChanInfoAfterJoin(ctx, chanName, chanID, channelTopic{Text: topic}, members)
+}
+
+// sendChanInfoAfterJoin sends the JOIN, the topic and the members of a joined
+// channel.
+func sendChanInfoAfterJoin(ctx *IrcContext, chanName, chanID string, topic channelTopic, members []slack.User) {
+	var ch *Channel
+	if ctx.Channels != nil {
+		ch = ctx.Channels.ByID(chanID)
+	}
 	memberNames := make([]string, 0, len(members))
 	for _, m := range members {
-		memberNames = append(memberNames, m.Name)
+		memberNames = append(memberNames, namesPrefix(ch, &m)+ctx.NickOf(&m))
 	}
 	// TODO wrap all these Conn.Write into a function
 	if _, err := ctx.Conn.Write([]byte(fmt.Sprintf(":%s JOIN %s\r\n", ctx.Mask(), chanName))); err != nil {
 		log.Warningf("Failed to send IRC JOIN message: %v", err)
 	}
-	// RPL_TOPIC
-	if err := SendIrcNumeric(ctx, 332, fmt.Sprintf("%s %s", ctx.Nick(), chanName), topic); err != nil {
-		log.Warningf("Failed to send IRC TOPIC message: %v", err)
-	}
+	sendTopic(ctx, chanName, topic, false)
 	// RPL_NAMREPLY
 	if len(members) > 0 {
 		if err := SendIrcNumeric(ctx, 353, fmt.Sprintf("%s = %s", ctx.Nick(), chanName), strings.Join(memberNames, " ")); err != nil {
@@ -188,7 +211,7 @@ func IrcSendChanInfoAfterJoinCustom(ctx *IrcContext, chanName, chanID, topic str
 // joinChannel will join the channel with the given ID, name and topic, and send back a
 // response to the IRC client
 func joinChannel(ctx *IrcContext, ch *Channel) error {
-	log.Infof("%s topic=%s members=%d", ch.IRCName(), ch.Purpose.Value, ch.NumMembers)
+	log.Infof("%s topic=%s members=%d", ch.IRCName(), topicOf(ch, ctx.topicMode()).Text, ch.NumMembers)
 	// the channels are already joined, notify the IRC client of their
 	// existence
 	members, err := ChannelMembers(ctx, ch.ID)
@@ -197,27 +220,34 @@ func joinChannel(ctx *IrcContext, ch *Channel) error {
 		ctx.SendUnknownError("%s", jErr.Error())
 		return jErr
 	}
-	go IrcSendChanInfoAfterJoin(ctx, ch, members)
+	ctx.goBackground(func() { IrcSendChanInfoAfterJoin(ctx, ch, members) })
 	return nil
 }
 
 // joinChannels gets all the available Slack channels and sends an IRC JOIN message
 // for each of the joined channels on Slack
 func joinChannels(ctx *IrcContext) error {
-	for _, sch := range ctx.Channels.AsMap() {
-		ch := Channel(sch)
-		if !ch.IsPublicChannel() && !ch.IsPrivateChannel() {
-			continue
-		}
-		if ch.IsMember {
-			if err := joinChannel(ctx, &ch); err != nil {
-				return err
-			}
+	for _, ch := range joinedChannels(ctx.Channels) {
+		ch := ch
+		if err := joinChannel(ctx, &ch); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// joinedChannels returns the public and private channels that the user is a
+// member of on Slack, by ID.
+func joinedChannels(channels *Channels) map[string]Channel {
+	joined := make(map[string]Channel)
+	for id, ch := range channels.AsMap() {
+		if (ch.IsPublicChannel() || ch.IsPrivateChannel()) && ch.IsMember {
+			joined[id] = ch
+		}
+	}
+	return joined
+}
+
 // IrcAfterLoggingIn is called once the user has successfully logged on IRC
 func IrcAfterLoggingIn(ctx *IrcContext, rtm *slack.RTM) error {
 	if ctx.OrigName != ctx.Nick() {
@@ -231,6 +261,7 @@ func IrcAfterLoggingIn(ctx *IrcContext, rtm *slack.RTM) error {
 	if err := SendIrcNumeric(ctx, 1, ctx.Nick(), fmt.Sprintf("Welcome to the %s IRC chat, %s!", ctx.ServerName, ctx.Nick())); err != nil {
 		log.Warningf("Failed to send IRC message: %v", err)
 	}
+	sendISupport(ctx)
 	// RPL_MOTDSTART
 	if err := SendIrcNumeric(ctx, 375, ctx.Nick(), ""); err != nil {
 		log.Warningf("Failed to send IRC message: %v", err)
@@ -241,10 +272,6 @@ func IrcAfterLoggingIn(ctx *IrcContext, rtm *slack.RTM) error {
 			log.Warningf("Failed to send IRC message: %v", err)
 		}
 	}
-	// RPL_ISUPPORT
-	if err := SendIrcNumeric(ctx, 005, ctx.Nick(), "CHANTYPES="+strings.Join(SupportedChannelPrefixes(), "")); err != nil {
-		log.Warningf("Failed to send IRC message: %v", err)
-	}
 	motd(fmt.Sprintf("This is an IRC-to-Slack gateway, written by %s <%s>.", ProjectAuthor, ProjectAuthorEmail))
 	motd(fmt.Sprintf("More information at %s.", ProjectURL))
 	motd(fmt.Sprintf("Slack team name: %s", ctx.SlackRTM.GetInfo().Team.Name))
@@ -261,41 +288,76 @@ func IrcAfterLoggingIn(ctx *IrcContext, rtm *slack.RTM) error {
 	if err := joinChannels(ctx); err != nil {
 		return err
 	}
+	ids := make([]string, 0, ctx.Users.Count())
+	for id := range ctx.Users.AsMap() {
+		ids = append(ids, id)
+	}
+	subscribePresence(ctx, ids...)
 
-	go eventHandler(ctx, rtm)
+	ctx.goBackground(func() { eventHandler(ctx, rtm) })
 	return nil
 }
 
 // IrcCapHandler is called when a CAP command is sent
 func IrcCapHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
-	if len(args) > 1 {
-		if args[0] == "LS" {
-			reply := fmt.Sprintf(":%s CAP * LS :\r\n", ctx.ServerName)
-			if _, err := ctx.Conn.Write([]byte(reply)); err != nil {
-				log.Warningf("Failed to send IRC message: %v", err)
+	if len(args) < 1 {
+		log.Warningf("Invalid CAP command args: %v %v", args, trailing)
+		return
+	}
+	nick := "*"
+	if ctx.User != nil {
+		nick = ctx.Nick()
+	}
+	var reply string
+	switch strings.ToUpper(args[0]) {
+	case "LS":
+		// capability values are only sent to clients that support CAP
+		// version 302
+		withValues := len(args) > 1 && args[1] >= "302"
+		reply = fmt.Sprintf(":%s CAP %s LS :%s\r\n", ctx.ServerName, nick, capabilitiesList(withValues))
+	case "LIST":
+		enabled := make([]string, 0, len(ctx.caps))
+		for name := range ctx.caps {
+			enabled = append(enabled, name)
+		}
+		sort.Strings(enabled)
+		reply = fmt.Sprintf(":%s CAP %s LIST :%s\r\n", ctx.ServerName, nick, strings.Join(enabled, " "))
+	case "REQ":
+		requested := trailing
+		if len(args) > 1 {
+			requested = args[1]
+		}
+		// capabilities are enabled all together, or not at all
+		supported := Capabilities()
+		ack := true
+		for _, name := range strings.Fields(requested) {
+			if _, ok := supported[strings.TrimPrefix(name, "-")]; !ok {
+				ack = false
+				break
 			}
-		} else {
-			log.Debugf("Got CAP %v", args)
 		}
-	}
-}
-
-// parseMentions parses mentions and converts them to the syntax that
-// Slack will parse, i.e. <@nickname>
-func parseMentions(text string) string {
-	tokens := strings.Split(text, " ")
-	for idx, token := range tokens {
-		if token == "@here" {
-			tokens[idx] = "<!here>"
-		} else if token == "@channel" {
-			tokens[idx] = "<!channel>"
-		} else if token == "@everyone" {
-			tokens[idx] = "<!everyone>"
-		} else if strings.HasPrefix(token, "@") {
-			tokens[idx] = "<" + token + ">"
+		if !ack {
+			reply = fmt.Sprintf(":%s CAP %s NAK :%s\r\n", ctx.ServerName, nick, requested)
+			break
+		}
+		if ctx.caps == nil {
+			ctx.caps = make(map[string]bool)
 		}
+		for _, name := range strings.Fields(requested) {
+			if strings.HasPrefix(name, "-") {
+				delete(ctx.caps, name[1:])
+			} else {
+				ctx.caps[name] = true
+			}
+		}
+		reply = fmt.Sprintf(":%s CAP %s ACK :%s\r\n", ctx.ServerName, nick, requested)
+	default:
+		log.Debugf("Got CAP %v", args)
+		return
+	}
+	if _, err := ctx.Conn.Write([]byte(reply)); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
 	}
-	return strings.Join(tokens, " ")
 }
 
 func getTargetTs(channelName string) string {
@@ -323,11 +385,23 @@ func IrcPrivMsgHandler(ctx *IrcContext, prefix, cmd string, args []string, trail
 		log.Warningf("Invalid PRIVMSG command args: %v %v", args, trailing)
 		return
 	}
+	if strings.HasPrefix(text, "\x01DCC SEND ") && strings.HasSuffix(text, "\x01") {
+		// a file sent via DCC is uploaded to the conversation with
+		// the recipient
+		handleDCCSend(ctx, channelParameter, text[len("\x01DCC SEND "):len(text)-1])
+		return
+	}
 	channel := ctx.Channels.ByName(channelParameter)
 	target := ""
 	if channel != nil {
 		// known channel
 		target = channel.SlackName()
+	} else if user := ctx.lookupUser(channelParameter); user != nil {
+		// private message. Nicknames may differ from Slack user names, so
+		// use the user ID, which Slack resolves to the direct message
+		// channel
+		target = user.ID
+		sendAway(ctx, user)
 	} else {
 		// assume private message
 		target = "@" + channelParameter
@@ -349,7 +423,7 @@ func IrcPrivMsgHandler(ctx *IrcContext, prefix, cmd string, args []string, trail
 
 		// this is a MeMessage
 		// strip off the ACTION and \x01 wrapper
-		text = text[len("\x01ACTION ") : len(text)-1]
+		text = ctx.FormatOutgoingText(text[len("\x01ACTION ") : len(text)-1])
 		/*
 		 * workaround: I believe that there is an issue with the
 		 * slack API for the method chat.meMessage . Until this
@@ -362,10 +436,15 @@ func IrcPrivMsgHandler(ctx *IrcContext, prefix, cmd string, args []string, trail
 		//      and remove the italic text
 		//opts = append(opts, slack.MsgOptionMeMessage())
 		text = "_" + text + "_"
+	} else {
+		text = ctx.FormatOutgoingText(text)
+	}
+	if emoji := ctx.emoji(); emoji != nil {
+		text = emoji.ToShortcodes(text)
 	}
 	ctx.PostTextMessage(
 		target,
-		parseMentions(text),
+		parseMentions(ctx, text),
 		getTargetTs(channelParameter),
 	)
 }
@@ -430,12 +509,15 @@ func connectToSlack(ctx *IrcContext) error {
 	if err != nil {
 		return err
 	}
-	ctx.SlackClient = slack.New(
-		token,
+	opts := []slack.Option{
 		slack.OptionDebug(ctx.SlackDebug),
 		slack.OptionLog(&loggerWrapper{logger.GetLogger("slack-api")}),
 		slack.OptionHTTPClient(&httpClient{cookie: cookie}),
-	)
+	}
+	if ctx.slackAPIURL != "" {
+		opts = append(opts, slack.OptionAPIURL(ctx.slackAPIURL))
+	}
+	ctx.SlackClient = slack.New(token, opts...)
 	if cookie == "" {
 		// legacy token
 		ctx.usingLegacyToken = true
@@ -443,20 +525,31 @@ func connectToSlack(ctx *IrcContext) error {
 	rtm := ctx.SlackClient.NewRTM()
 	ctx.SlackRTM = rtm
 	go rtm.ManageConnection()
+	ctx.goBackground(func() { disconnectRTM(ctx, rtm) })
 	log.Info("Starting Slack client")
-	// Wait until the websocket is connected, then print client info
+	// Wait until the websocket is connected, then print client info. The
+	// info comes from the connected event, since polling rtm.GetInfo races
+	// with the RTM goroutine that sets it
 	var info *slack.Info
 	// FIXME tune the timeout to a value that makes sense
 	timeout := 10 * time.Second
-	start := time.Now()
-	for {
-		if info = rtm.GetInfo(); info != nil {
-			break
-		}
-		if time.Now().After(start.Add(timeout)) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for info == nil {
+		select {
+		case <-ctx.Context().Done():
+			return ctx.Context().Err()
+		case <-timer.C:
 			return fmt.Errorf("Connection to Slack timed out after %v", timeout)
+		case msg := <-rtm.IncomingEvents:
+			switch ev := msg.Data.(type) {
+			case *slack.ConnectedEvent:
+				info = ev.Info
+				ctx.SlackConnected = true
+			case *slack.InvalidAuthEvent:
+				return errors.New("invalid Slack credentials")
+			}
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
 	log.Info("CLIENT INFO:")
 	log.Infof("  URL     : %s", info.URL)
@@ -464,18 +557,114 @@ func connectToSlack(ctx *IrcContext) error {
 	log.Infof("  Team    : %+v", *info.Team)
 	// the users cache is not yet populated at this point, so we call the Slack
 	// API directly.
-	user, err := ctx.SlackClient.GetUserInfo(info.User.ID)
+	var user *slack.User
+	err = ctx.RateLimiter.Do(ctx.Context(), "users.info", PriorityHigh, func(c context.Context) error {
+		var err error
+		user, err = ctx.SlackClient.GetUserInfoContext(c, info.User.ID)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("Cannot get info for user %s (ID: %s): %v", info.User.Name, info.User.ID, err)
 	}
 	ctx.User = user
 	ctx.RealName = user.RealName
-	// do not fetch users here, they will be fetched later upon joining channels
-	if err := ctx.Channels.Fetch(ctx.SlackClient); err != nil {
-		ctx.Conn.Close()
-		return fmt.Errorf("Failed to fetch channels: %v", err)
+	// add ourselves to the users cache, so that our nickname is derived like
+	// everybody else's
+	ctx.Users.Add(*user)
+	if ctx.CacheDir != "" {
+		ctx.Cache = NewCache(ctx.CacheDir, info.Team.ID, ctx.Users, ctx.Channels)
+		if _, err := ctx.Cache.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warningf("Ignoring persistent cache: %v", err)
+		}
+	}
+	// the cached channels are good enough to log in, they are refreshed in
+	// the background afterwards
+	refresh := ctx.Cache != nil && ctx.Channels.Count() > 0
+	if !refresh {
+		// do not fetch users here, they will be fetched later upon joining
+		// channels
+		if err := ctx.Channels.Fetch(ctx.Context(), ctx.SlackClient); err != nil {
+			ctx.Conn.Close()
+			return fmt.Errorf("Failed to fetch channels: %v", err)
+		}
+		ctx.Cache.Invalidate()
+	}
+	// user groups are only used to show their handles, and require
+	// additional permissions, so failing to fetch them is not fatal
+	if err := ctx.UserGroups.Fetch(ctx.Context(), ctx.SlackClient); err != nil {
+		log.Warningf("Failed to fetch user groups: %v", err)
+	}
+	if emoji := ctx.emoji(); emoji != nil {
+		// custom emoji are not fatal, we just won't be able to resolve their
+		// aliases
+		if err := emoji.Fetch(ctx.Context(), ctx.SlackClient); err != nil {
+			log.Warningf("Failed to fetch custom emoji: %v", err)
+		}
+	}
+	if err := IrcAfterLoggingIn(ctx, rtm); err != nil {
+		return err
+	}
+	if refresh {
+		// only once the client joined the cached channels, so that it
+		// can be told about the channels joined or left since then
+		ctx.goBackground(func() { refreshCache(ctx) })
+	}
+	return nil
+}
+
+// refreshCache reloads the channels, and the users loaded from the persistent
+// cache, from Slack. Slack cannot tell what changed since the cache was
+// saved, so this is a full reload. The IRC client is then notified of the
+// nicknames that have changed, and joins or parts the channels that it
+// joined or left on Slack in the meantime. Finally, the cache is saved.
+func refreshCache(ctx *IrcContext) {
+	users, channels := ctx.Users, ctx.Channels
+	joined := joinedChannels(channels)
+	channelsErr := channels.Fetch(ctx.Context(), ctx.SlackClient)
+	if channelsErr != nil {
+		log.Warningf("Failed to refresh channels: %v", channelsErr)
+	}
+	known := users.AsMap()
+	ids := make([]string, 0, len(known))
+	for id := range known {
+		ids = append(ids, id)
+	}
+	_, changes, err := users.FetchByIDs(ctx.Context(), ctx.SlackClient, true, ids...)
+	if err != nil {
+		log.Warningf("Failed to refresh users: %v", err)
+	}
+	if ctx.Context().Err() != nil {
+		// the client disconnected in the meantime
+		return
+	}
+	ctx.SendNickChanges(changes)
+	if channelsErr == nil {
+		sendMembershipChanges(ctx, joined)
+	}
+	if err := ctx.Cache.Save(); err != nil {
+		log.Warningf("Failed to save cache: %v", err)
+	}
+}
+
+// sendMembershipChanges makes the IRC client part the channels in joined that
+// the user is no longer a member of on Slack, and join the channels that the
+// user is now a member of and that are not in joined.
+func sendMembershipChanges(ctx *IrcContext, joined map[string]Channel) {
+	current := joinedChannels(ctx.Channels)
+	for id, ch := range joined {
+		if _, ok := current[id]; !ok {
+			sendPart(ctx, ch.IRCName(), "")
+		}
+	}
+	for id, ch := range current {
+		if _, ok := joined[id]; ok {
+			continue
+		}
+		ch := ch
+		if err := joinChannel(ctx, &ch); err != nil {
+			log.Warningf("Failed to join %s: %v", ch.IRCName(), err)
+		}
 	}
-	return IrcAfterLoggingIn(ctx, rtm)
 }
 
 // IrcNickHandler is called when a NICK command is sent
@@ -544,29 +733,6 @@ func IrcQuitHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing
 	ctx.Conn.Close()
 }
 
-// IrcModeHandler is called when a MODE command is sent
-func IrcModeHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
-	switch len(args) {
-	case 0:
-		log.Warningf("Invalid call to MODE handler: no arguments passed")
-	case 1:
-		// get mode request. Always no mode (for now)
-		mode := "+"
-		// RPL_CHANNELMODEIS
-		if err := SendIrcNumeric(ctx, 324, fmt.Sprintf("%s %s %s", ctx.Nick(), args[0], mode), ""); err != nil {
-			log.Warningf("Failed to send IRC message: %v", err)
-		}
-	default:
-		// more than 1
-		// set mode request. Not handled yet
-		// TODO handle mode set
-		// ERR_UMODEUNKNOWNFLAG
-		if err := SendIrcNumeric(ctx, 501, args[0], fmt.Sprintf("Unknown MODE flags %s", strings.Join(args[1:], " "))); err != nil {
-			log.Warningf("Failed to send IRC message: %v", err)
-		}
-	}
-}
-
 // IrcPassHandler is called when a PASS command is sent
 func IrcPassHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
 	if len(args) != 1 {
@@ -617,8 +783,7 @@ func IrcWhoHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing
 				log.Warningf("Failed to get info for user name '%s'", un)
 				continue
 			}
-			log.Infof("%+v", u.Name)
-			rargs = fmt.Sprintf("%s %s %s %s %s %s *", ctx.Nick(), target, u.ID, ctx.ServerName, ctx.ServerName, u.Name)
+			rargs = fmt.Sprintf("%s %s %s %s %s %s %s", ctx.Nick(), target, u.ID, ctx.ServerName, ctx.ServerName, ctx.NickOf(u), whoFlags(ctx, ch, u))
 			desc = fmt.Sprintf("0 %s", u.RealName)
 			// RPL_WHOREPLY
 			// "<channel> <user> <host> <server> <nick> \
@@ -634,7 +799,7 @@ func IrcWhoHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing
 		}
 		return
 	}
-	user := ctx.GetUserInfoByName(target)
+	user := ctx.GetUserInfoByNick(target)
 	if user == nil {
 		// ERR_NOSUCHNICK
 		if err := SendIrcNumeric(ctx, 401, ctx.Nick(), fmt.Sprintf("No such nick %s", target)); err != nil {
@@ -642,8 +807,7 @@ func IrcWhoHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing
 		}
 		return
 	}
-	// FIXME get channel
-	rargs = fmt.Sprintf("#general %s %s %s %s %s *", ctx.Nick(), user.ID, ctx.ServerName, ctx.ServerName, user.Name)
+	rargs = fmt.Sprintf("%s * %s %s %s %s %s", ctx.Nick(), user.ID, ctx.ServerName, ctx.ServerName, ctx.NickOf(user), whoFlags(ctx, nil, user))
 	desc = fmt.Sprintf("0 %s", user.RealName)
 	// RPL_WHOREPLY
 	// "<channel> <user> <host> <server> <nick> \
@@ -651,6 +815,10 @@ func IrcWhoHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing
 	if err := SendIrcNumeric(ctx, 352, rargs, desc); err != nil {
 		log.Warningf("Failed to send IRC message: %v", err)
 	}
+	// RPL_ENDOFWHO
+	if err := SendIrcNumeric(ctx, 315, fmt.Sprintf("%s %s", ctx.Nick(), target), "End of WHO list"); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
 }
 
 // IrcWhoisHandler is called when a WHOIS command is sent
@@ -666,18 +834,21 @@ func IrcWhoisHandler(ctx *IrcContext, prefix, cmd string, args []string, trailin
 	if len(args) == 2 && args[0] == args[1] {
 		withIdleTime = true
 	}
-	user := ctx.GetUserInfoByName(username)
+	user := ctx.GetUserInfoByNick(username)
 	if user == nil {
 		// ERR_NOSUCHNICK
 		if err := SendIrcNumeric(ctx, 401, ctx.Nick(), fmt.Sprintf("No such nick %s", username)); err != nil {
 			log.Warningf("Failed to send IRC message: %v", err)
 		}
 	} else {
+		// reply with the canonical nickname, the lookup is case-insensitive
+		username = ctx.NickOf(user)
 		// RPL_WHOISUSER
 		// "<nick> <user> <host> * :<real name>"
 		if err := SendIrcNumeric(ctx, 311, fmt.Sprintf("%s %s %s %s *", ctx.Nick(), username, user.ID, ctx.ServerName), user.RealName); err != nil {
 			log.Warningf("Failed to send IRC message: %v", err)
 		}
+		sendAway(ctx, user)
 		// RPL_WHOISSERVER
 		// "<nick> <server> :<server info>"
 		if err := SendIrcNumeric(ctx, 312, fmt.Sprintf("%s %s %s", ctx.Nick(), username, ctx.ServerName), "irc-slack, https://github.com/insomniacslk/irc-slack"); err != nil {
@@ -686,7 +857,11 @@ func IrcWhoisHandler(ctx *IrcContext, prefix, cmd string, args []string, trailin
 		// Send additional user status information, abusing the RPL_WHOISSERVER
 		// reply. If there is a better method, please let us know!
 		if user.Profile.StatusText != "" || user.Profile.StatusEmoji != "" {
-			userStatus := fmt.Sprintf("user status: '%s' %s", user.Profile.StatusText, user.Profile.StatusEmoji)
+			statusEmoji := user.Profile.StatusEmoji
+			if emoji := ctx.emoji(); emoji != nil {
+				statusEmoji = emoji.ToUnicode(statusEmoji)
+			}
+			userStatus := fmt.Sprintf("user status: '%s' %s", user.Profile.StatusText, statusEmoji)
 			if user.Profile.StatusExpiration != 0 {
 				userStatus += " until " + time.Unix(int64(user.Profile.StatusExpiration), 0).String()
 			}
@@ -694,6 +869,16 @@ func IrcWhoisHandler(ctx *IrcContext, prefix, cmd string, args []string, trailin
 				log.Warningf("Failed to send IRC message: %v", err)
 			}
 		}
+		if isChannelOperator(nil, user) {
+			// RPL_WHOISOPERATOR
+			if err := SendIrcNumeric(ctx, 313, fmt.Sprintf("%s %s", ctx.Nick(), username), "is a workspace admin or owner"); err != nil {
+				log.Warningf("Failed to send IRC message: %v", err)
+			}
+		}
+		// RPL_WHOISMODES
+		if err := SendIrcNumeric(ctx, 379, fmt.Sprintf("%s %s", ctx.Nick(), username), "is using modes "+UserModesOf(user)); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
 		// RPL_WHOISCHANNELS
 		// "<nick> :{[@|+]<channel><space>}"
 		var channels []string
@@ -719,7 +904,9 @@ func IrcWhoisHandler(ctx *IrcContext, prefix, cmd string, args []string, trailin
 	}
 }
 
-// IrcJoinHandler is called when a JOIN command is sent
+// IrcJoinHandler is called when a JOIN command is sent. Channels that the
+// user is not a member of are joined on Slack, and channels that do not exist
+// are created if CreateChannels is set.
 func IrcJoinHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
 	if len(args) != 1 {
 		ctx.SendUnknownError("Invalid JOIN command")
@@ -731,95 +918,130 @@ func IrcJoinHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing
 	// separately.
 	channames := strings.Split(args[0], ",")
 	for _, channame := range channames {
-		if strings.HasPrefix(channame, ChannelPrefixMpIM) || strings.HasPrefix(channame, ChannelPrefixThread) {
-			log.Debugf("JOIN: ignoring channel `%s`, cannot join multi-party IMs or threads", channame)
+		if channame == "" {
 			continue
 		}
-		sch, _, _, err := ctx.SlackClient.JoinConversation(channame)
-		if err != nil {
-			log.Warningf("Cannot join channel %s: %v", channame, err)
+		if strings.HasPrefix(channame, ChannelPrefixThread) {
+			log.Debugf("JOIN: ignoring channel `%s`, cannot join threads", channame)
 			continue
 		}
-		log.Infof("Joined channel %s", channame)
-		ch := Channel(*sch)
-		if err := joinChannel(ctx, &ch); err != nil {
+		ch := ctx.Channels.ByName(channame)
+		if ch == nil {
+			if !HasChannelPrefix(channame) || strings.HasPrefix(channame, ChannelPrefixMpIM) || !ctx.CreateChannels {
+				sendNoSuchChannel(ctx, channame)
+				continue
+			}
+			createChannel(ctx, channame)
+			continue
+		}
+		if ch.IsMpIM {
+			// multi-party IMs cannot be joined, but they can be shown again
+			// after a PART
+			ctx.unhide(channame)
+		} else if !ch.IsMember {
+			var sch *slack.Channel
+			err := ctx.RateLimiter.Do(ctx.Context(), "conversations.join", PriorityHigh, func(c context.Context) error {
+				var err error
+				sch, _, _, err = ctx.SlackClient.JoinConversationContext(c, ch.ID)
+				return err
+			})
+			if err != nil {
+				log.Warningf("Cannot join channel %s: %v", channame, err)
+				sendSlackError(ctx, err, channame, "")
+				continue
+			}
+			log.Infof("Joined channel %s", channame)
+			joined := Channel(*sch)
+			joined.IsMember = true
+			ctx.Channels.Add(joined)
+			ch = &joined
+		}
+		if err := joinChannel(ctx, ch); err != nil {
 			log.Warningf("Failed to join channel `%s`: %v", ch.Name, err)
 			continue
 		}
 	}
 }
 
-// IrcPartHandler is called when a PART command is sent
+// IrcPartHandler is called when a PART command is sent. The syntax is
+// `PART <channel>{,<channel>} [:reason]`. Public and private channels are left
+// on Slack, while multi-party IMs and threads, that cannot be left, are only
+// hidden until their next message.
 func IrcPartHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
-	if len(args) != 1 {
-		ctx.SendUnknownError("Invalid PART command")
-		return
-	}
-	channame := StripChannelPrefix(args[0])
-	// Slack needs the channel ID to leave it, not the channel name. The only
-	// way to get the channel ID from the name is retrieving the whole channel
-	// list and finding the one whose name is the one we want to leave
-	if err := ctx.Channels.Fetch(ctx.SlackClient); err != nil {
-		log.Warningf("Cannot leave channel %s: %v", channame, err)
-		ctx.SendUnknownError("Cannot leave channel: %v", err)
+	if len(args) < 1 || len(args) > 2 {
+		// ERR_NEEDMOREPARAMS
+		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "PART :Not enough parameters"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
 		return
 	}
-	var chanID string
-	for _, ch := range ctx.Channels.AsMap() {
-		if ch.Name == channame {
-			chanID = ch.ID
-			log.Debugf("Trying to leave channel: %+v", ch)
-			break
-		}
+	reason := trailing
+	if len(args) == 2 {
+		reason = args[1]
 	}
-	if chanID == "" {
-		// ERR_USERNOTINCHANNEL
-		if err := SendIrcNumeric(ctx, 441, ctx.Nick(), fmt.Sprintf("User is not in channel %s", channame)); err != nil {
-			log.Warningf("Failed to send IRC message: %v", err)
-			return
-		}
-		notInChan, err := ctx.SlackClient.LeaveConversation(chanID)
-		if err != nil {
-			log.Warningf("Cannot leave channel %s (id: %s): %v", channame, chanID, err)
-			return
-		}
-		if notInChan {
-			// ERR_USERNOTINCHANNEL
-			if err := SendIrcNumeric(ctx, 441, ctx.Nick(), fmt.Sprintf("User is not in channel %s", channame)); err != nil {
-				log.Warningf("Failed to send IRC message: %v", err)
-			}
-			return
-		}
-		log.Debugf("Left channel %s", channame)
-		if _, err := ctx.Conn.Write([]byte(fmt.Sprintf(":%v PART #%v\r\n", ctx.Mask(), channame))); err != nil {
-			log.Warningf("Failed to send IRC message: %v", err)
+	for _, channame := range strings.Split(args[0], ",") {
+		if channame != "" {
+			partChannel(ctx, channame, reason)
 		}
 	}
 }
 
-// IrcTopicHandler is called when a TOPIC command is sent
-func IrcTopicHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
-	if len(args) < 1 {
-		// ERR_NEEDMOREPARAMS
-		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "TOPIC :Not enough parameters"); err != nil {
-			log.Warningf("Failed to send IRC message: %v", err)
-		}
+// partChannel parts a single channel, see IrcPartHandler.
+func partChannel(ctx *IrcContext, channame, reason string) {
+	if _, _, ok := SplitThreadName(channame); ok {
+		ctx.hide(channame)
+		sendPart(ctx, channame, reason)
 		return
 	}
-	channame := args[0]
-	topic := trailing
-	channel := ctx.Channels.ByName(channame)
-	if channel == nil {
-		log.Warningf("IrcTopicHandler: unknown channel %s", channame)
+	ch := ctx.Channels.ByName(channame)
+	if ch == nil || !HasChannelPrefix(channame) {
+		sendNoSuchChannel(ctx, channame)
 		return
 	}
-	newTopic, err := ctx.SlackClient.SetPurposeOfConversation(channel.ID, topic)
+	if ch.IsMpIM || ch.IsIM {
+		ctx.hide(ch.IRCName())
+		sendPart(ctx, ch.IRCName(), reason)
+		return
+	}
+	if !ch.IsMember {
+		sendNotOnChannel(ctx, channame)
+		return
+	}
+	var notInChan bool
+	err := ctx.RateLimiter.Do(ctx.Context(), "conversations.leave", PriorityHigh, func(c context.Context) error {
+		var err error
+		notInChan, err = ctx.SlackClient.LeaveConversationContext(c, ch.ID)
+		return err
+	})
 	if err != nil {
-		ctx.SendUnknownError("%s :Cannot set topic: %v", channame, err)
+		ctx.SendUnknownError("Cannot leave channel %s: %v", channame, err)
+		return
+	}
+	ch.IsMember = false
+	ctx.Channels.Add(*ch)
+	if notInChan {
+		sendNotOnChannel(ctx, channame)
 		return
 	}
-	// RPL_TOPIC
-	if err := SendIrcNumeric(ctx, 332, fmt.Sprintf("%s :%s", ctx.Nick(), channame), newTopic.Purpose.Value); err != nil {
+	log.Debugf("Left channel %s", channame)
+	sendPart(ctx, ch.IRCName(), reason)
+}
+
+// sendPart notifies the client that it left a channel.
+func sendPart(ctx *IrcContext, channame, reason string) {
+	msg := fmt.Sprintf(":%s PART %s", ctx.Mask(), channame)
+	if reason != "" {
+		msg += " :" + reason
+	}
+	if _, err := ctx.Conn.Write([]byte(msg + "\r\n")); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// sendNotOnChannel sends an ERR_NOTONCHANNEL reply.
+func sendNotOnChannel(ctx *IrcContext, channame string) {
+	// ERR_NOTONCHANNEL
+	if err := SendIrcNumeric(ctx, 442, fmt.Sprintf("%s %s", ctx.Nick(), channame), "You're not on that channel"); err != nil {
 		log.Warningf("Failed to send IRC message: %v", err)
 	}
 }
@@ -847,7 +1069,7 @@ func IrcNamesHandler(ctx *IrcContext, prefix, cmd string, args []string, trailin
 	}
 	memberNames := make([]string, 0, len(members))
 	for _, m := range members {
-		memberNames = append(memberNames, m.Name)
+		memberNames = append(memberNames, namesPrefix(ch, &m)+ctx.NickOf(&m))
 	}
 	log.Printf("Found %d members in %s: %v", len(memberNames), ch.IRCName(), memberNames)
 	// RPL_NAMREPLY
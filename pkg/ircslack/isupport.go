@@ -0,0 +1,106 @@
+package ircslack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits of Slack conversations, see
+// https://api.slack.com/methods/conversations.create and
+// https://api.slack.com/methods/conversations.setPurpose .
+const (
+	SlackMaxChannelNameLength = 80
+	SlackMaxTopicLength       = 250
+)
+
+// maxISupportTokens is the maximum number of tokens in a RPL_ISUPPORT reply,
+// so that with the client nick and the trailing text it has at most 15
+// parameters.
+const maxISupportTokens = 13
+
+// isupportTargMax are the maximum number of targets of the commands that
+// accept a comma-separated list of them. An empty value means no limit.
+const isupportTargMax = "JOIN:,LIST:,NAMES:1,PART:,PRIVMSG:1,WHOIS:1"
+
+// escapeISupportValue escapes the characters that are not allowed in the
+// value of a RPL_ISUPPORT token, see https://modern.ircdocs.horse/#rplisupport-005 .
+func escapeISupportValue(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c <= ' ' || c == '\\' || c == '=' || c == 0x7f {
+			fmt.Fprintf(&b, "\\x%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ISupportTokens returns the RPL_ISUPPORT tokens that describe the features
+// and the limits of the gateway.
+func ISupportTokens(ctx *IrcContext) []string {
+	chantypes := strings.Join(SupportedChannelPrefixes(), "")
+	lineLen := 512
+	if ctx.ChunkSize > lineLen {
+		lineLen = ctx.ChunkSize
+	}
+	tokens := []string{
+		fmt.Sprintf("AWAYLEN=%d", SlackMaxStatusLength),
+		// nicknames and channel names are compared with foldCase, that
+		// only folds ASCII letters
+		"CASEMAPPING=ascii",
+		"CHANLIMIT=" + chantypes + ":",
+		"CHANMODES=b,,," + ChannelModes,
+		fmt.Sprintf("CHANNELLEN=%d", len(ChannelPrefixPublicChannel)+SlackMaxChannelNameLength),
+		"CHANTYPES=" + chantypes,
+		"ELIST=" + ListConditions,
+		fmt.Sprintf("LINELEN=%d", lineLen),
+	}
+	if ctx.SlackRTM != nil && ctx.SlackRTM.GetInfo() != nil && ctx.SlackRTM.GetInfo().Team != nil {
+		tokens = append(tokens, "NETWORK="+escapeISupportValue(ctx.SlackRTM.GetInfo().Team.Name))
+	}
+	tokens = append(tokens,
+		fmt.Sprintf("NICKLEN=%d", MaxNickLength),
+		"PREFIX="+ChannelPrefixes,
+		// LIST replies come from the channel cache, and do not flood the
+		// client
+		"SAFELIST",
+		"TARGMAX="+isupportTargMax,
+		fmt.Sprintf("TOPICLEN=%d", SlackMaxTopicLength),
+		"UTF8ONLY",
+	)
+	return tokens
+}
+
+// sendISupport sends the RPL_ISUPPORT tokens to the client, split across as
+// many replies as needed to respect the limits on the number of parameters
+// and on the line length.
+func sendISupport(ctx *IrcContext) {
+	const desc = "are supported by this server"
+	// the length of a reply without tokens, including the separators
+	// and <CR><LF>
+	baseLen := len(fmt.Sprintf(":%s 005 %s  :%s\r\n", ctx.ServerName, ctx.Nick(), desc))
+	var line []string
+	lineLen := baseLen
+	flush := func() {
+		if len(line) == 0 {
+			return
+		}
+		// RPL_ISUPPORT
+		if err := SendIrcNumeric(ctx, 5, ctx.Nick()+" "+strings.Join(line, " "), desc); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		line, lineLen = nil, baseLen
+	}
+	for _, token := range ISupportTokens(ctx) {
+		if len(line) == maxISupportTokens || (len(line) > 0 && lineLen+1+len(token) > 512) {
+			flush()
+		}
+		if len(line) > 0 {
+			lineLen++
+		}
+		line = append(line, token)
+		lineLen += len(token)
+	}
+	flush()
+}
@@ -0,0 +1,85 @@
+package ircslack
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscapeISupportValue(t *testing.T) {
+	assert.Equal(t, "Acme", escapeISupportValue("Acme"))
+	assert.Equal(t, `Acme\x20Inc.\x5C\x3D`, escapeISupportValue(`Acme Inc.\=`))
+}
+
+func TestISupportTokens(t *testing.T) {
+	ctx := &IrcContext{ChunkSize: 1024}
+	tokens := ISupportTokens(ctx)
+	for _, token := range []string{
+		"CASEMAPPING=ascii",
+		"CHANMODES=b,,,AEGmp",
+		"CHANNELLEN=81",
+		"CHANTYPES=#@&+",
+		"ELIST=CMNTU",
+		"LINELEN=1024",
+		"NICKLEN=50",
+		"PREFIX=(o)@",
+		"TOPICLEN=250",
+		"UTF8ONLY",
+	} {
+		assert.Contains(t, tokens, token)
+	}
+
+	tokens = ISupportTokens(&IrcContext{})
+	assert.Contains(t, tokens, "LINELEN=512")
+}
+
+func TestSendISupport(t *testing.T) {
+	for _, serverName := range []string{"localhost", strings.Repeat("x", 400)} {
+		conn := &fakeConn{}
+		ctx := &IrcContext{Conn: conn, ServerName: serverName, User: &slack.User{ID: "UME", Name: "me"}}
+		sendISupport(ctx)
+		lines := strings.Split(strings.TrimSuffix(conn.buf.String(), "\r\n"), "\r\n")
+		if len(serverName) > 100 {
+			// long lines are split
+			assert.True(t, len(lines) > 1)
+		}
+		preamble := ":" + serverName + " 005 me "
+		var tokens []string
+		for _, line := range lines {
+			assert.True(t, len(line)+2 <= 512, line)
+			require.True(t, strings.HasPrefix(line, preamble), line)
+			require.True(t, strings.HasSuffix(line, " :are supported by this server"), line)
+			params := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(line, preamble), " :are supported by this server"))
+			assert.True(t, len(params) <= maxISupportTokens, line)
+			tokens = append(tokens, params...)
+		}
+		assert.Equal(t, ISupportTokens(ctx), tokens)
+	}
+}
+
+func TestHandleMsgInvalidUTF8(t *testing.T) {
+	s := Server{Name: "localhost"}
+	server, client := net.Pipe()
+	defer client.Close()
+	reply := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		reply <- line
+	}()
+	s.HandleMsg(server, "PRIVMSG #general :\xff\r\n")
+	select {
+	case line := <-reply:
+		assert.Equal(t, ":localhost FAIL PRIVMSG INVALID_UTF8 :Message rejected, your IRC software MUST use UTF-8 encoding on this network\r\n", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply to an invalid UTF-8 message")
+	}
+	userContextsMu.Lock()
+	defer userContextsMu.Unlock()
+	assert.NotContains(t, UserContexts, server.RemoteAddr())
+}
@@ -0,0 +1,215 @@
+package ircslack
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListConditions are the ELIST conditions supported by LIST, see
+// https://modern.ircdocs.horse/#elist-parameter .
+const ListConditions = "CMNTU"
+
+// archivedTopicPrefix is prepended to the topic of archived channels in LIST
+// replies.
+const archivedTopicPrefix = "[archived] "
+
+// listFilter selects the channels returned by LIST.
+type listFilter struct {
+	// names are the channel names requested explicitly
+	names []string
+	// masks and notMasks are the M and N conditions
+	masks, notMasks []string
+	// minUsers and maxUsers are the U conditions, i.e. exclusive bounds of
+	// the number of members. -1 means no limit
+	minUsers, maxUsers int
+	// createdBefore and createdAfter are the C conditions
+	createdBefore, createdAfter time.Time
+	// topicBefore and topicAfter are the T conditions
+	topicBefore, topicAfter time.Time
+}
+
+// parseListFilter parses the comma-separated channel names and ELIST
+// conditions of a LIST command. Times in C and T conditions are in minutes
+// ago, relative to now.
+func parseListFilter(param string, now time.Time) (*listFilter, error) {
+	f := listFilter{minUsers: -1, maxUsers: -1}
+	minutesAgo := func(s string) (time.Time, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid number of minutes %q", s)
+		}
+		return now.Add(-time.Duration(n) * time.Minute), nil
+	}
+	for _, cond := range strings.Split(param, ",") {
+		if cond == "" {
+			continue
+		}
+		var err error
+		switch {
+		case cond[0] == '>' || cond[0] == '<':
+			var n int
+			n, err = strconv.Atoi(cond[1:])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid user count condition %q", cond)
+			}
+			if cond[0] == '>' {
+				f.minUsers = n
+			} else {
+				f.maxUsers = n
+			}
+		case len(cond) > 2 && (cond[0] == 'C' || cond[0] == 'T') && (cond[1] == '>' || cond[1] == '<'):
+			var t time.Time
+			t, err = minutesAgo(cond[2:])
+			if err != nil {
+				return nil, err
+			}
+			// "C<n" means created less than n minutes ago, i.e. after
+			// the time n minutes ago
+			switch cond[:2] {
+			case "C<":
+				f.createdAfter = t
+			case "C>":
+				f.createdBefore = t
+			case "T<":
+				f.topicAfter = t
+			case "T>":
+				f.topicBefore = t
+			}
+		case cond[0] == '!':
+			f.notMasks = append(f.notMasks, cond[1:])
+		case strings.ContainsAny(cond, "*?"):
+			f.masks = append(f.masks, cond)
+		default:
+			f.names = append(f.names, cond)
+		}
+	}
+	return &f, nil
+}
+
+// match returns true if a channel satisfies all the conditions of the filter.
+func (f *listFilter) match(ch *Channel) bool {
+	name := ch.IRCName()
+	if len(f.names) > 0 {
+		found := false
+		for _, n := range f.names {
+			if equalFold(n, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, mask := range f.masks {
+		if !matchMask(mask, name) {
+			return false
+		}
+	}
+	for _, mask := range f.notMasks {
+		if matchMask(mask, name) {
+			return false
+		}
+	}
+	if f.minUsers >= 0 && ch.NumMembers <= f.minUsers {
+		return false
+	}
+	if f.maxUsers >= 0 && ch.NumMembers >= f.maxUsers {
+		return false
+	}
+	created := ch.Created.Time()
+	if !f.createdAfter.IsZero() && !created.After(f.createdAfter) {
+		return false
+	}
+	if !f.createdBefore.IsZero() && !created.Before(f.createdBefore) {
+		return false
+	}
+	topicSet := ch.Topic.LastSet.Time()
+	if !f.topicAfter.IsZero() && (ch.Topic.LastSet == 0 || !topicSet.After(f.topicAfter)) {
+		return false
+	}
+	if !f.topicBefore.IsZero() && (ch.Topic.LastSet == 0 || !topicSet.Before(f.topicBefore)) {
+		return false
+	}
+	return true
+}
+
+// matchMask returns true if name matches the IRC mask, where '*' matches any
+// sequence of characters and '?' matches a single character. The comparison
+// is case-insensitive.
+func matchMask(mask, name string) bool {
+	m, n := []rune(foldCase(mask)), []rune(foldCase(name))
+	// star and match are the positions to backtrack to after the last '*'
+	star, match := -1, 0
+	i, j := 0, 0
+	for j < len(n) {
+		switch {
+		case i < len(m) && (m[i] == '?' || m[i] == n[j]):
+			i++
+			j++
+		case i < len(m) && m[i] == '*':
+			star, match = i, j
+			i++
+		case star >= 0:
+			i = star + 1
+			match++
+			j = match
+		default:
+			return false
+		}
+	}
+	for i < len(m) && m[i] == '*' {
+		i++
+	}
+	return i == len(m)
+}
+
+// IrcListHandler is called when a LIST command is sent. The syntax is
+// `LIST [<channels and conditions> [<server>]]`. It lists the cached Slack
+// conversations with their number of members and topic, filtered by channel
+// names and ELIST conditions. The target server, if any, is ignored. Archived
+// channels are only listed if ListArchived is set, and their topic is
+// prefixed with "[archived]".
+func IrcListHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	param := trailing
+	if len(args) > 0 {
+		param = args[0]
+	}
+	filter, err := parseListFilter(param, time.Now())
+	if err != nil {
+		ctx.SendUnknownError("Invalid LIST command: %v", err)
+		return
+	}
+	var channels []Channel
+	for _, ch := range ctx.Channels.AsMap() {
+		if ch.IsArchived && !ctx.ListArchived {
+			continue
+		}
+		if filter.match(&ch) {
+			channels = append(channels, ch)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].IRCName() < channels[j].IRCName() })
+
+	// RPL_LISTSTART
+	if err := SendIrcNumeric(ctx, 321, fmt.Sprintf("%s Channel", ctx.Nick()), "Users  Name"); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+	for _, ch := range channels {
+		topic := topicText(ctx, topicOf(&ch, ctx.topicMode()).Text)
+		if ch.IsArchived {
+			topic = archivedTopicPrefix + topic
+		}
+		// RPL_LIST
+		if err := SendIrcNumeric(ctx, 322, fmt.Sprintf("%s %s %d", ctx.Nick(), ch.IRCName(), ch.NumMembers), topic); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+	}
+	// RPL_LISTEND
+	if err := SendIrcNumeric(ctx, 323, ctx.Nick(), "End of /LIST"); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
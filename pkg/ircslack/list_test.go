@@ -0,0 +1,101 @@
+package ircslack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchMask(t *testing.T) {
+	assert.True(t, matchMask("*", "#general"))
+	assert.True(t, matchMask("#gen*", "#General"))
+	assert.True(t, matchMask("*eral", "#general"))
+	assert.True(t, matchMask("#g?n*l", "#general"))
+	assert.True(t, matchMask("*e*e*", "#general"))
+	assert.False(t, matchMask("#gen", "#general"))
+	assert.False(t, matchMask("*x*", "#general"))
+	assert.False(t, matchMask("#general?", "#general"))
+}
+
+func newListTestChannel(name string, members int, created, topicSet time.Time, purpose string) Channel {
+	ch := Channel{IsChannel: true}
+	ch.ID = "C" + name
+	ch.Name = name
+	ch.NumMembers = members
+	ch.Created = slack.JSONTime(created.Unix())
+	ch.Topic.LastSet = slack.JSONTime(topicSet.Unix())
+	ch.Purpose.Value = purpose
+	return ch
+}
+
+func TestListFilter(t *testing.T) {
+	now := time.Now()
+	general := newListTestChannel("general", 100, now.Add(-48*time.Hour), now.Add(-time.Hour), "")
+	random := newListTestChannel("random", 3, now.Add(-10*time.Minute), now.Add(-5*time.Minute), "")
+
+	for _, tt := range []struct {
+		param           string
+		general, random bool
+	}{
+		{"", true, true},
+		{"#general", true, false},
+		{"#random,#general", true, true},
+		{"#gen*", true, false},
+		{"!#gen*", false, true},
+		{">10", true, false},
+		{"<10", false, true},
+		{"C<60", false, true},
+		{"C>60", true, false},
+		{"T<30", false, true},
+		{"T>30", true, false},
+		{"*,>2,<4", false, true},
+		{"<0", false, false},
+		{">0", true, true},
+	} {
+		f, err := parseListFilter(tt.param, now)
+		require.NoError(t, err, tt.param)
+		assert.Equal(t, tt.general, f.match(&general), tt.param)
+		assert.Equal(t, tt.random, f.match(&random), tt.param)
+	}
+
+	for _, param := range []string{">x", "C<x", "T>-1", "<-1"} {
+		_, err := parseListFilter(param, now)
+		assert.Error(t, err, param)
+	}
+}
+
+func TestIrcListHandler(t *testing.T) {
+	conn := &fakeConn{}
+	ctx := &IrcContext{Conn: conn, ServerName: "localhost", User: &slack.User{ID: "UME", Name: "me"}, Channels: NewChannels(0)}
+	now := time.Now()
+	archived := newListTestChannel("old", 2, now, now, "old stuff")
+	archived.IsArchived = true
+	ctx.Channels.Add(
+		newListTestChannel("general", 100, now, now, "Company-wide\nannouncements"),
+		newListTestChannel("random", 3, now, now, ""),
+		archived,
+	)
+
+	IrcListHandler(ctx, "", "LIST", nil, "")
+	assert.Equal(t,
+		":localhost 321 me Channel :Users  Name\r\n"+
+			":localhost 322 me #general 100 :Company-wide announcements\r\n"+
+			":localhost 322 me #random 3 :\r\n"+
+			":localhost 323 me :End of /LIST\r\n",
+		conn.buf.String(),
+	)
+	conn.buf.Reset()
+
+	// the target server is ignored
+	ctx.ListArchived = true
+	IrcListHandler(ctx, "", "LIST", []string{"#o*", ">1000"}, "")
+	assert.Equal(t,
+		":localhost 321 me Channel :Users  Name\r\n"+
+			":localhost 322 me #old 2 :[archived] old stuff\r\n"+
+			":localhost 323 me :End of /LIST\r\n",
+		conn.buf.String(),
+	)
+}
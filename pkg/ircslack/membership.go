@@ -0,0 +1,198 @@
+package ircslack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// slackErrorNumerics maps the error codes returned by the Slack conversations
+// API to IRC numeric replies and their descriptions.
+var slackErrorNumerics = map[string]struct {
+	code int
+	desc string
+}{
+	"channel_not_found":                     {403, "No such channel"},
+	"is_archived":                           {403, "Channel is archived"},
+	"user_not_found":                        {401, "No such nick/channel"},
+	"not_in_channel":                        {442, "You're not on that channel"},
+	"user_not_in_channel":                   {441, "They aren't on that channel"},
+	"already_in_channel":                    {443, "is already on channel"},
+	"cant_invite_self":                      {443, "is already on channel"},
+	"name_taken":                            {473, "Cannot join channel (+i)"},
+	"method_not_supported_for_channel_type": {473, "Cannot join channel (+i)"},
+	"invalid_name":                          {479, "Illegal channel name"},
+	"invalid_name_maxlength":                {479, "Illegal channel name"},
+	"invalid_name_punctuation":              {479, "Illegal channel name"},
+	"invalid_name_required":                 {479, "Illegal channel name"},
+	"invalid_name_specials":                 {479, "Illegal channel name"},
+	"restricted_action":                     {482, "You're not channel operator"},
+	"not_authorized":                        {482, "You're not channel operator"},
+	"cant_invite":                           {482, "You're not channel operator"},
+	"cant_kick_self":                        {482, "You're not channel operator"},
+	"cant_kick_from_general":                {482, "You're not channel operator"},
+	"cant_kick_from_last_channel":           {482, "You're not channel operator"},
+}
+
+// sendSlackError replies to a failed Slack conversations API call with the IRC
+// numeric corresponding to the Slack error code, or with ERR_UNKNOWNERROR if
+// there is none. The nick is used by the numerics that refer to a user.
+func sendSlackError(ctx *IrcContext, err error, channame, nick string) {
+	var slackErr slack.SlackErrorResponse
+	if !errors.As(err, &slackErr) {
+		ctx.SendUnknownError("%s: %v", channame, err)
+		return
+	}
+	numeric, ok := slackErrorNumerics[slackErr.Err]
+	if !ok {
+		ctx.SendUnknownError("%s: %v", channame, err)
+		return
+	}
+	var args string
+	switch numeric.code {
+	case 401:
+		// ERR_NOSUCHNICK
+		args = fmt.Sprintf("%s %s", ctx.Nick(), nick)
+	case 441, 443:
+		// ERR_USERNOTINCHANNEL, ERR_USERONCHANNEL
+		args = fmt.Sprintf("%s %s %s", ctx.Nick(), nick, channame)
+	default:
+		args = fmt.Sprintf("%s %s", ctx.Nick(), channame)
+	}
+	if err := SendIrcNumeric(ctx, numeric.code, args, numeric.desc); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// sendNoSuchChannel sends an ERR_NOSUCHCHANNEL reply.
+func sendNoSuchChannel(ctx *IrcContext, channame string) {
+	// ERR_NOSUCHCHANNEL
+	if err := SendIrcNumeric(ctx, 403, fmt.Sprintf("%s %s", ctx.Nick(), channame), "No such channel"); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// sendNoSuchNick sends an ERR_NOSUCHNICK reply.
+func sendNoSuchNick(ctx *IrcContext, nick string) {
+	// ERR_NOSUCHNICK
+	if err := SendIrcNumeric(ctx, 401, fmt.Sprintf("%s %s", ctx.Nick(), nick), "No such nick/channel"); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// createChannel creates a public channel, or a private channel if the name
+// has the private channel prefix, and joins it.
+func createChannel(ctx *IrcContext, channame string) {
+	isPrivate := strings.HasPrefix(channame, ChannelPrefixPrivateChannel)
+	var sch *slack.Channel
+	err := ctx.RateLimiter.Do(ctx.Context(), "conversations.create", PriorityHigh, func(c context.Context) error {
+		var err error
+		sch, err = ctx.SlackClient.CreateConversationContext(c, slack.CreateConversationParams{
+			ChannelName: StripChannelPrefix(channame),
+			IsPrivate:   isPrivate,
+		})
+		return err
+	})
+	if err != nil {
+		log.Warningf("Cannot create channel %s: %v", channame, err)
+		sendSlackError(ctx, err, channame, "")
+		return
+	}
+	log.Infof("Created channel %s", channame)
+	ch := Channel(*sch)
+	ch.IsMember = true
+	ctx.Channels.Add(ch)
+	if err := joinChannel(ctx, &ch); err != nil {
+		log.Warningf("Failed to join channel `%s`: %v", ch.Name, err)
+	}
+}
+
+// IrcInviteHandler is called when an INVITE command is sent. The syntax is
+// `INVITE <nick> <channel>`.
+func IrcInviteHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if len(args) == 1 && trailing != "" {
+		args = append(args, trailing)
+	}
+	if len(args) != 2 {
+		// ERR_NEEDMOREPARAMS
+		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "INVITE :Not enough parameters"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	nick, channame := args[0], args[1]
+	user := ctx.lookupUser(nick)
+	if user == nil {
+		sendNoSuchNick(ctx, nick)
+		return
+	}
+	ch := ctx.Channels.ByName(channame)
+	if ch == nil || !HasChannelPrefix(channame) {
+		sendNoSuchChannel(ctx, channame)
+		return
+	}
+	err := ctx.RateLimiter.Do(ctx.Context(), "conversations.invite", PriorityHigh, func(c context.Context) error {
+		_, err := ctx.SlackClient.InviteUsersToConversationContext(c, ch.ID, user.ID)
+		return err
+	})
+	if err != nil {
+		log.Warningf("Cannot invite %s to %s: %v", nick, channame, err)
+		sendSlackError(ctx, err, channame, nick)
+		return
+	}
+	// RPL_INVITING
+	if err := SendIrcNumeric(ctx, 341, fmt.Sprintf("%s %s", ctx.Nick(), nick), channame); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// IrcKickHandler is called when a KICK command is sent. The syntax is
+// `KICK <channel> <nick>{,<nick>} [:reason]`. Slack does not support kick
+// reasons, so the reason is only echoed back to the client.
+func IrcKickHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if len(args) < 2 || len(args) > 3 {
+		// ERR_NEEDMOREPARAMS
+		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "KICK :Not enough parameters"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	channame := args[0]
+	reason := trailing
+	if len(args) == 3 {
+		reason = args[2]
+	}
+	ch := ctx.Channels.ByName(channame)
+	if ch == nil || !HasChannelPrefix(channame) {
+		sendNoSuchChannel(ctx, channame)
+		return
+	}
+	for _, nick := range strings.Split(args[1], ",") {
+		if nick == "" {
+			continue
+		}
+		user := ctx.lookupUser(nick)
+		if user == nil {
+			sendNoSuchNick(ctx, nick)
+			continue
+		}
+		err := ctx.RateLimiter.Do(ctx.Context(), "conversations.kick", PriorityHigh, func(c context.Context) error {
+			return ctx.SlackClient.KickUserFromConversationContext(c, ch.ID, user.ID)
+		})
+		if err != nil {
+			log.Warningf("Cannot kick %s from %s: %v", nick, channame, err)
+			sendSlackError(ctx, err, channame, nick)
+			continue
+		}
+		msg := fmt.Sprintf(":%s KICK %s %s", ctx.Mask(), channame, nick)
+		if reason != "" {
+			msg += " :" + reason
+		}
+		if _, err := ctx.Conn.Write([]byte(msg + "\r\n")); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package ircslack
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+// routeMembership replies to the conversations API methods used by JOIN,
+// INVITE and KICK, and records the calls as "method channel [user|name]".
+// Slack errors are returned for the channel IDs, user IDs and names in
+// errors.
+func routeMembership(errors map[string]string) fakeSlackRoute {
+	return func(req *http.Request) (string, string, error) {
+		form := req.PostForm
+		var call, key, data string
+		switch req.URL.Path {
+		case "/api/conversations.join":
+			key = form.Get("channel")
+			call = "join " + key
+			data = fmt.Sprintf(`{"ok": true, "channel": {"id": "%s", "name": "joined", "is_channel": true}}`, key)
+		case "/api/conversations.create":
+			key = form.Get("name")
+			call = fmt.Sprintf("create %s private=%s", key, form.Get("is_private"))
+			data = fmt.Sprintf(`{"ok": true, "channel": {"id": "CNEW", "name": "%s", "is_channel": true, "is_private": %s}}`, key, form.Get("is_private"))
+		case "/api/conversations.invite":
+			key = form.Get("users")
+			call = fmt.Sprintf("invite %s %s", form.Get("channel"), key)
+			data = `{"ok": true, "channel": {}}`
+		case "/api/conversations.kick":
+			key = form.Get("user")
+			call = fmt.Sprintf("kick %s %s", form.Get("channel"), key)
+			data = `{"ok": true}`
+		case "/api/conversations.members":
+			// fail, so that joined channels are not announced
+			// asynchronously
+			data = `{"ok": false, "error": "fatal_error"}`
+		default:
+			return "", "", errUnsupportedURL(req)
+		}
+		if slackErr, ok := errors[key]; ok {
+			data = fmt.Sprintf(`{"ok": false, "error": "%s"}`, slackErr)
+		}
+		return call, data, nil
+	}
+}
+
+func newMembershipTestContext(errors map[string]string) (*IrcContext, *fakeConn, *fakeSlackAPI) {
+	ctx, conn, httpClient := newFakeSlackTestContext(routeMembership(errors))
+	ctx.Users.Add(slack.User{ID: "UBOB", Name: "bob"}, slack.User{ID: "UALICE", Name: "alice"})
+	general := Channel{IsChannel: true}
+	general.ID, general.Name, general.IsMember = "CGENERAL", "general", true
+	random := Channel{IsChannel: true}
+	random.ID, random.Name = "CRANDOM", "random"
+	ctx.Channels.Add(general, random)
+	return ctx, conn, httpClient
+}
+
+func TestIrcJoinHandler(t *testing.T) {
+	ctx, conn, httpClient := newMembershipTestContext(nil)
+	IrcJoinHandler(ctx, "", "JOIN", []string{"#random,#nonexistent,+general-1234.5678"}, "")
+	assert.Equal(t, []string{"join CRANDOM"}, httpClient.calls)
+	assert.True(t, ctx.Channels.ByID("CRANDOM").IsMember)
+	assert.Contains(t, conn.buf.String(), ":localhost 403 me #nonexistent :No such channel\r\n")
+}
+
+func TestIrcJoinHandlerCreate(t *testing.T) {
+	ctx, conn, httpClient := newMembershipTestContext(map[string]string{"taken": "name_taken"})
+	ctx.CreateChannels = true
+	IrcJoinHandler(ctx, "", "JOIN", []string{"#new"}, "")
+	IrcJoinHandler(ctx, "", "JOIN", []string{"@secret"}, "")
+	assert.Equal(t, []string{"create new private=false", "create secret private=true"}, httpClient.calls)
+	ch := ctx.Channels.ByName("@secret")
+	if assert.NotNil(t, ch) {
+		assert.True(t, ch.IsMember)
+		assert.True(t, ch.IsPrivate)
+	}
+	conn.buf.Reset()
+
+	IrcJoinHandler(ctx, "", "JOIN", []string{"#taken"}, "")
+	assert.Equal(t, ":localhost 473 me #taken :Cannot join channel (+i)\r\n", conn.buf.String())
+}
+
+func TestIrcInviteHandler(t *testing.T) {
+	ctx, conn, httpClient := newMembershipTestContext(map[string]string{"UALICE": "already_in_channel"})
+	IrcInviteHandler(ctx, "", "INVITE", []string{"bob", "#general"}, "")
+	assert.Equal(t, []string{"invite CGENERAL UBOB"}, httpClient.calls)
+	assert.Equal(t, ":localhost 341 me bob :#general\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcInviteHandler(ctx, "", "INVITE", []string{"alice", "#general"}, "")
+	assert.Equal(t, ":localhost 443 me alice #general :is already on channel\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcInviteHandler(ctx, "", "INVITE", []string{"nobody", "#general"}, "")
+	assert.Equal(t, ":localhost 401 me nobody :No such nick/channel\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcInviteHandler(ctx, "", "INVITE", []string{"bob"}, "")
+	assert.Equal(t, ":localhost 461 me :INVITE :Not enough parameters\r\n", conn.buf.String())
+}
+
+func TestIrcKickHandler(t *testing.T) {
+	ctx, conn, httpClient := newMembershipTestContext(map[string]string{"UALICE": "restricted_action"})
+	IrcKickHandler(ctx, "", "KICK", []string{"#general", "bob,alice,nobody"}, "spam")
+	assert.Equal(t, []string{"kick CGENERAL UBOB", "kick CGENERAL UALICE"}, httpClient.calls)
+	assert.Equal(t,
+		":me!UME@127.0.0.1 KICK #general bob :spam\r\n"+
+			":localhost 482 me #general :You're not channel operator\r\n"+
+			":localhost 401 me nobody :No such nick/channel\r\n",
+		conn.buf.String(),
+	)
+	conn.buf.Reset()
+
+	IrcKickHandler(ctx, "", "KICK", []string{"#nonexistent", "bob"}, "")
+	assert.Equal(t, ":localhost 403 me #nonexistent :No such channel\r\n", conn.buf.String())
+}
+
+func TestSendSlackError(t *testing.T) {
+	conn := &fakeConn{}
+	ctx := &IrcContext{Conn: conn, ServerName: "localhost", User: &slack.User{ID: "UME", Name: "me"}}
+	sendSlackError(ctx, slack.SlackErrorResponse{Err: "user_not_in_channel"}, "#general", "bob")
+	assert.Equal(t, ":localhost 441 me bob #general :They aren't on that channel\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	sendSlackError(ctx, slack.SlackErrorResponse{Err: "something_else"}, "#general", "bob")
+	assert.Equal(t, ":localhost 400 me :#general: something_else\r\n", conn.buf.String())
+}
@@ -0,0 +1,85 @@
+package ircslack
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// rxIrcMention matches @user, @usergroup, @here and #channel mentions.
+	// The first group is whatever precedes the mention, since Go regular
+	// expressions don't support look-behind assertions.
+	rxIrcMention = regexp.MustCompile(`(^|[\s(*_~])([@#])([\w.'-]+)`)
+	// rxIrcHighlight matches the IRC-style "nick: message" highlight at the
+	// beginning of a message.
+	rxIrcHighlight = regexp.MustCompile(`^([^\s:,@#]+)([:,])(\s|$)`)
+)
+
+// parseMentions resolves the mentions in a message to be sent to Slack into
+// the syntax that Slack understands:
+//   - "nick: hello" and "nick, hello" at the beginning of the message, and
+//     @nick anywhere, become <@U1234>. Users are matched by name or display
+//     name, case-insensitively
+//   - @here, @channel and @everyone become <!here>, <!channel> and <!everyone>
+//   - @handle becomes <!subteam^S1234> for user groups
+//   - #channel becomes <#C1234>
+//
+// Unknown names, and anything within inline code or code blocks, are left
+// untouched.
+func parseMentions(ctx *IrcContext, text string) string {
+	if m := rxIrcHighlight.FindStringSubmatch(text); m != nil {
+		if user := ctx.lookupUser(m[1]); user != nil {
+			text = "<@" + user.ID + ">" + text[len(m[1]):]
+		}
+	}
+	// code is not formatted by Slack, mentions included
+	segments := strings.Split(text, "`")
+	for idx := range segments {
+		// odd segments are code, unless the last backtick is unterminated
+		if idx%2 == 1 && idx < len(segments)-1 {
+			continue
+		}
+		segments[idx] = rxIrcMention.ReplaceAllStringFunc(segments[idx], func(subs string) string {
+			m := rxIrcMention.FindStringSubmatch(subs)
+			before, kind, name := m[1], m[2], m[3]
+			// allow for punctuation after a mention, e.g. "thanks @nick."
+			for trimmed := name; trimmed != ""; trimmed = trimmed[:len(trimmed)-1] {
+				if resolved := ctx.resolveMention(kind, trimmed); resolved != "" {
+					return before + resolved + name[len(trimmed):]
+				}
+				if !strings.ContainsAny(trimmed[len(trimmed)-1:], ".'-") {
+					break
+				}
+			}
+			return subs
+		})
+	}
+	return strings.Join(segments, "`")
+}
+
+// resolveMention returns the Slack syntax for the given @ or # mention, or an
+// empty string if it cannot be resolved.
+func (ic *IrcContext) resolveMention(kind, name string) string {
+	if kind == ChannelPrefixPublicChannel {
+		if ic.Channels == nil {
+			return ""
+		}
+		if ch := ic.Channels.ByName(name); ch != nil {
+			return "<#" + ch.ID + ">"
+		}
+		return ""
+	}
+	switch name {
+	case "here", "channel", "everyone":
+		return "<!" + name + ">"
+	}
+	if user := ic.lookupUser(name); user != nil {
+		return "<@" + user.ID + ">"
+	}
+	if ic.UserGroups != nil {
+		if group := ic.UserGroups.ByHandle(name); group != nil {
+			return "<!subteam^" + group.ID + ">"
+		}
+	}
+	return ""
+}
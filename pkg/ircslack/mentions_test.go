@@ -0,0 +1,65 @@
+package ircslack
+
+import (
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMentionsTestContext() *IrcContext {
+	ctx := &IrcContext{
+		Users:      NewUsers(0),
+		Channels:   NewChannels(0),
+		UserGroups: NewUserGroups(),
+	}
+	ctx.Users.Add(slack.User{ID: "U1234", Name: "insomniac", Profile: slack.UserProfile{DisplayName: "Andrea"}})
+	ctx.Users.Add(slack.User{ID: "U5678", Name: "john.doe"})
+	ctx.Channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: "general", Conversation: slack.Conversation{ID: "C1234"}}, IsChannel: true})
+	ctx.UserGroups.Update(slack.UserGroup{ID: "S1234", Handle: "oncall"})
+	return ctx
+}
+
+func TestParseMentionsHighlight(t *testing.T) {
+	ctx := newMentionsTestContext()
+	assert.Equal(t, "<@U1234>: hello", parseMentions(ctx, "insomniac: hello"))
+	assert.Equal(t, "<@U1234>, hello", parseMentions(ctx, "Insomniac, hello"))
+	assert.Equal(t, "<@U1234>:", parseMentions(ctx, "andrea:"))
+	// only at the beginning, and only for known users
+	assert.Equal(t, "hello insomniac: hi", parseMentions(ctx, "hello insomniac: hi"))
+	assert.Equal(t, "note: this", parseMentions(ctx, "note: this"))
+	assert.Equal(t, "http://example.com", parseMentions(ctx, "http://example.com"))
+}
+
+func TestParseMentionsUsers(t *testing.T) {
+	ctx := newMentionsTestContext()
+	assert.Equal(t, "hi <@U1234>", parseMentions(ctx, "hi @insomniac"))
+	assert.Equal(t, "hi <@U1234> and <@U5678>.", parseMentions(ctx, "hi @ANDREA and @john.doe."))
+	assert.Equal(t, "(<@U1234>)", parseMentions(ctx, "(@insomniac)"))
+	assert.Equal(t, "*<@U1234>*", parseMentions(ctx, "*@insomniac*"))
+	assert.Equal(t, "hi @nobody", parseMentions(ctx, "hi @nobody"))
+	assert.Equal(t, "user@insomniac.org", parseMentions(ctx, "user@insomniac.org"))
+}
+
+func TestParseMentionsSpecial(t *testing.T) {
+	ctx := newMentionsTestContext()
+	assert.Equal(t, "<!here> <!channel> <!everyone>", parseMentions(ctx, "@here @channel @everyone"))
+}
+
+func TestParseMentionsUserGroups(t *testing.T) {
+	ctx := newMentionsTestContext()
+	assert.Equal(t, "ping <!subteam^S1234>", parseMentions(ctx, "ping @oncall"))
+}
+
+func TestParseMentionsChannels(t *testing.T) {
+	ctx := newMentionsTestContext()
+	assert.Equal(t, "see <#C1234>!", parseMentions(ctx, "see #general!"))
+	assert.Equal(t, "see #random", parseMentions(ctx, "see #random"))
+	assert.Equal(t, "issue#general", parseMentions(ctx, "issue#general"))
+}
+
+func TestParseMentionsCode(t *testing.T) {
+	ctx := newMentionsTestContext()
+	assert.Equal(t, "run `echo @insomniac` <@U1234>", parseMentions(ctx, "run `echo @insomniac` @insomniac"))
+	assert.Equal(t, "a ` <@U1234>", parseMentions(ctx, "a ` @insomniac"))
+}
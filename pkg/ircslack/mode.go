@@ -0,0 +1,188 @@
+package ircslack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// Channel modes derived from the properties of Slack conversations. They are
+// read-only, and cannot be changed from IRC.
+const (
+	// ChannelModeArchived is set on archived channels
+	ChannelModeArchived = 'A'
+	// ChannelModeShared is set on channels shared with other workspaces or
+	// organizations
+	ChannelModeShared = 'E'
+	// ChannelModeGeneral is set on the default channel of the workspace,
+	// that every member is in
+	ChannelModeGeneral = 'G'
+	// ChannelModeModerated is set on channels where not everyone can post,
+	// i.e. archived, read-only and posting-restricted channels
+	ChannelModeModerated = 'm'
+	// ChannelModePrivate is set on private channels and multi-party IMs
+	ChannelModePrivate = 'p'
+)
+
+// User modes derived from the Slack user's role in the workspace.
+const (
+	// UserModeAdmin is set on workspace admins and owners
+	UserModeAdmin = 'o'
+	// UserModeBot is set on bot users
+	UserModeBot = 'B'
+	// UserModeGuest is set on single- and multi-channel guests
+	UserModeGuest = 'G'
+)
+
+// ChannelModes are the channel modes supported by irc-slack, in the order
+// they are reported.
+const ChannelModes = "AEGmp"
+
+// UserModes are the user modes supported by irc-slack, in the order they are
+// reported.
+const UserModes = "BGo"
+
+// ChannelPrefixes maps the channel membership modes to their prefix in NAMES
+// replies, in the PREFIX ISUPPORT format. Channel operators are the creators
+// of the channel and the workspace admins and owners, that can manage it.
+const ChannelPrefixes = "(o)@"
+
+// ChannelModesOf returns the modes of a channel, e.g. "+mp".
+func ChannelModesOf(ch *Channel) string {
+	modes := map[rune]bool{
+		ChannelModeArchived:  ch.IsArchived,
+		ChannelModeShared:    ch.IsShared || ch.IsExtShared || ch.IsOrgShared,
+		ChannelModeGeneral:   ch.IsGeneral,
+		ChannelModeModerated: ch.IsArchived || ch.IsReadOnly || (ch.Properties != nil && len(ch.Properties.PostingRestrictedTo.Type) > 0),
+		ChannelModePrivate:   ch.IsPrivate || ch.IsMpIM,
+	}
+	return formatModes(ChannelModes, modes)
+}
+
+// UserModesOf returns the modes of a user, e.g. "+o".
+func UserModesOf(user *slack.User) string {
+	modes := map[rune]bool{
+		UserModeAdmin: user.IsAdmin || user.IsOwner || user.IsPrimaryOwner,
+		UserModeBot:   user.IsBot,
+		UserModeGuest: user.IsRestricted || user.IsUltraRestricted,
+	}
+	return formatModes(UserModes, modes)
+}
+
+// formatModes returns the set modes, in the order of all.
+func formatModes(all string, modes map[rune]bool) string {
+	var b strings.Builder
+	b.WriteByte('+')
+	for _, mode := range all {
+		if modes[mode] {
+			b.WriteRune(mode)
+		}
+	}
+	return b.String()
+}
+
+// isChannelOperator returns true if the user can manage the channel, i.e. if
+// they created it or are a workspace admin or owner. The channel can be nil,
+// e.g. for threads.
+func isChannelOperator(ch *Channel, user *slack.User) bool {
+	if user.IsAdmin || user.IsOwner || user.IsPrimaryOwner {
+		return true
+	}
+	return ch != nil && ch.Creator != "" && ch.Creator == user.ID
+}
+
+// namesPrefix returns the prefix of a user in the NAMES replies of a channel.
+func namesPrefix(ch *Channel, user *slack.User) string {
+	if isChannelOperator(ch, user) {
+		return "@"
+	}
+	return ""
+}
+
+// IrcModeHandler is called when a MODE command is sent. Channel and user
+// modes are derived from Slack and can be queried, but not changed.
+func IrcModeHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if len(args) == 0 {
+		// ERR_NEEDMOREPARAMS
+		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "MODE :Not enough parameters"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	if HasChannelPrefix(args[0]) {
+		channelMode(ctx, args[0], args[1:])
+	} else {
+		userMode(ctx, args[0], args[1:])
+	}
+}
+
+// channelMode replies to a MODE command for a channel. Threads have the modes
+// of their channel.
+func channelMode(ctx *IrcContext, channame string, modes []string) {
+	var ch *Channel
+	if name, _, ok := SplitThreadName(channame); ok {
+		ch = ctx.Channels.ByName(name)
+	} else {
+		ch = ctx.Channels.ByName(channame)
+	}
+	if ch == nil {
+		sendNoSuchChannel(ctx, channame)
+		return
+	}
+	switch {
+	case len(modes) == 0:
+		// RPL_CHANNELMODEIS
+		if err := SendIrcNumeric(ctx, 324, fmt.Sprintf("%s %s", ctx.Nick(), channame), ChannelModesOf(ch)); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		if ch.Created != 0 {
+			// RPL_CREATIONTIME
+			if err := SendIrcNumeric(ctx, 329, fmt.Sprintf("%s %s", ctx.Nick(), channame), fmt.Sprintf("%d", ch.Created)); err != nil {
+				log.Warningf("Failed to send IRC message: %v", err)
+			}
+		}
+	case len(modes) == 1 && (modes[0] == "b" || modes[0] == "+b"):
+		// ban list query, sent by many clients on join. Slack has no bans
+		// RPL_ENDOFBANLIST
+		if err := SendIrcNumeric(ctx, 368, fmt.Sprintf("%s %s", ctx.Nick(), channame), "End of channel ban list"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+	default:
+		// ERR_CHANOPRIVSNEEDED
+		if err := SendIrcNumeric(ctx, 482, fmt.Sprintf("%s %s", ctx.Nick(), channame), "Channel modes cannot be changed from IRC"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+	}
+}
+
+// userMode replies to a MODE command for a user. Only the modes of the
+// current user can be queried, the modes of the others are shown by WHOIS.
+func userMode(ctx *IrcContext, nick string, modes []string) {
+	if !equalFold(nick, ctx.Nick()) {
+		if ctx.lookupUser(nick) == nil {
+			sendNoSuchNick(ctx, nick)
+			return
+		}
+		// ERR_USERSDONTMATCH
+		if err := SendIrcNumeric(ctx, 502, ctx.Nick(), "Can't view or change modes for other users"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	if len(modes) > 0 {
+		// ERR_UMODEUNKNOWNFLAG
+		if err := SendIrcNumeric(ctx, 501, ctx.Nick(), fmt.Sprintf("Unknown MODE flags %s", strings.Join(modes, " "))); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	mode := "+"
+	if ctx.User != nil {
+		mode = UserModesOf(ctx.User)
+	}
+	// RPL_UMODEIS
+	if err := SendIrcNumeric(ctx, 221, ctx.Nick(), mode); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
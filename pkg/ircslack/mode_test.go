@@ -0,0 +1,99 @@
+package ircslack
+
+import (
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelModesOf(t *testing.T) {
+	var ch Channel
+	assert.Equal(t, "+", ChannelModesOf(&ch))
+
+	ch.IsGeneral = true
+	ch.Properties = &slack.Properties{PostingRestrictedTo: slack.RestrictedTo{Type: []string{"admin"}}}
+	assert.Equal(t, "+Gm", ChannelModesOf(&ch))
+
+	var archived Channel
+	archived.IsArchived, archived.IsPrivate, archived.IsExtShared = true, true, true
+	assert.Equal(t, "+AEmp", ChannelModesOf(&archived))
+}
+
+func TestUserModesOf(t *testing.T) {
+	assert.Equal(t, "+", UserModesOf(&slack.User{}))
+	assert.Equal(t, "+o", UserModesOf(&slack.User{IsOwner: true}))
+	assert.Equal(t, "+G", UserModesOf(&slack.User{IsUltraRestricted: true}))
+	assert.Equal(t, "+Bo", UserModesOf(&slack.User{IsBot: true, IsAdmin: true}))
+}
+
+func TestNamesPrefix(t *testing.T) {
+	var ch Channel
+	ch.Creator = "UBOB"
+	assert.Equal(t, "@", namesPrefix(&ch, &slack.User{ID: "UBOB"}))
+	assert.Equal(t, "@", namesPrefix(&ch, &slack.User{ID: "UALICE", IsAdmin: true}))
+	assert.Equal(t, "", namesPrefix(&ch, &slack.User{ID: "UALICE"}))
+	assert.Equal(t, "", namesPrefix(nil, &slack.User{ID: "UBOB"}))
+}
+
+func newModeTestContext() (*IrcContext, *fakeConn) {
+	ctx, conn, _ := newFakeSlackTestContext(nil)
+	ctx.User.IsAdmin = true
+	ctx.Users.Add(slack.User{ID: "UBOB", Name: "bob"})
+	ch := Channel{IsChannel: true}
+	ch.ID, ch.Name, ch.IsPrivate, ch.Created = "CSECRET", "secret", true, 1600000000
+	ctx.Channels.Add(ch)
+	return ctx, conn
+}
+
+func TestIrcModeHandlerChannel(t *testing.T) {
+	ctx, conn := newModeTestContext()
+	IrcModeHandler(ctx, "", "MODE", []string{"#secret"}, "")
+	assert.Equal(t,
+		":localhost 324 me #secret :+p\r\n"+
+			":localhost 329 me #secret :1600000000\r\n",
+		conn.buf.String(),
+	)
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", []string{"+secret-1234.5678"}, "")
+	assert.Equal(t,
+		":localhost 324 me +secret-1234.5678 :+p\r\n"+
+			":localhost 329 me +secret-1234.5678 :1600000000\r\n",
+		conn.buf.String(),
+	)
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", []string{"#secret", "b"}, "")
+	assert.Equal(t, ":localhost 368 me #secret :End of channel ban list\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", []string{"#secret", "-p"}, "")
+	assert.Equal(t, ":localhost 482 me #secret :Channel modes cannot be changed from IRC\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", []string{"#nonexistent"}, "")
+	assert.Equal(t, ":localhost 403 me #nonexistent :No such channel\r\n", conn.buf.String())
+}
+
+func TestIrcModeHandlerUser(t *testing.T) {
+	ctx, conn := newModeTestContext()
+	IrcModeHandler(ctx, "", "MODE", []string{"me"}, "")
+	assert.Equal(t, ":localhost 221 me :+o\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", []string{"me", "+i"}, "")
+	assert.Equal(t, ":localhost 501 me :Unknown MODE flags +i\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", []string{"bob"}, "")
+	assert.Equal(t, ":localhost 502 me :Can't view or change modes for other users\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", []string{"nobody"}, "")
+	assert.Equal(t, ":localhost 401 me nobody :No such nick/channel\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcModeHandler(ctx, "", "MODE", nil, "")
+	assert.Equal(t, ":localhost 461 me :MODE :Not enough parameters\r\n", conn.buf.String())
+}
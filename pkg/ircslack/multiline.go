@@ -0,0 +1,178 @@
+package ircslack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Limits of the IRCv3 draft/multiline batches accepted from clients, see
+// https://ircv3.net/specs/extensions/multiline .
+const (
+	MultilineMaxBytes = SlackMaxMessageLength
+	MultilineMaxLines = 1000
+)
+
+// Capabilities returns the IRCv3 capabilities supported by irc-slack, with
+// their values if any.
+func Capabilities() map[string]string {
+	return map[string]string{
+		"away-notify":     "",
+		"batch":           "",
+		"draft/multiline": fmt.Sprintf("max-bytes=%d,max-lines=%d", MultilineMaxBytes, MultilineMaxLines),
+	}
+}
+
+// capabilitiesList returns the supported capabilities in the format of a CAP LS
+// reply.
+func capabilitiesList(withValues bool) string {
+	caps := make([]string, 0, len(Capabilities()))
+	for name, value := range Capabilities() {
+		if withValues && value != "" {
+			name += "=" + value
+		}
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return strings.Join(caps, " ")
+}
+
+// HasCap returns true if the client enabled the given IRCv3 capability.
+func (ic *IrcContext) HasCap(name string) bool {
+	return ic.caps[name]
+}
+
+// parseTags parses the IRCv3 message tags, without the leading '@'. Tag values
+// are unescaped, see https://ircv3.net/specs/extensions/message-tags .
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(tag, "=")
+		tags[key] = unescapeTagValue(value)
+	}
+	return tags
+}
+
+// unescapeTagValue unescapes the value of a message tag.
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			// a trailing backslash is dropped
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// multilineBatch is a draft/multiline batch that is being received from the
+// client.
+type multilineBatch struct {
+	target string
+	text   strings.Builder
+	lines  int
+	failed bool
+}
+
+// addToBatch adds a message to the multiline batch with the given reference.
+// It returns false if there is no such batch, in which case the message has
+// to be handled as usual.
+func (ic *IrcContext) addToBatch(ref, cmd string, tags map[string]string, args []string, trailing string) bool {
+	batch, ok := ic.batches[ref]
+	if !ok {
+		return false
+	}
+	if batch.failed {
+		return true
+	}
+	if cmd != "PRIVMSG" || len(args) < 1 || len(args) > 2 {
+		log.Warningf("Ignoring %s %v in multiline batch %s", cmd, args, ref)
+		return true
+	}
+	text := trailing
+	if len(args) == 2 {
+		text = args[1]
+	}
+	if batch.lines > 0 {
+		if _, concat := tags["draft/multiline-concat"]; !concat {
+			batch.text.WriteString("\n")
+		}
+	}
+	batch.text.WriteString(text)
+	batch.lines++
+	var code, desc string
+	switch {
+	case batch.lines > MultilineMaxLines:
+		code, desc = fmt.Sprintf("MULTILINE_MAX_LINES %d", MultilineMaxLines), "Multiline batch max-lines exceeded"
+	case batch.text.Len() > MultilineMaxBytes:
+		code, desc = fmt.Sprintf("MULTILINE_MAX_BYTES %d", MultilineMaxBytes), "Multiline batch max-bytes exceeded"
+	default:
+		return true
+	}
+	batch.failed = true
+	if _, err := ic.Conn.Write([]byte(fmt.Sprintf(":%s FAIL BATCH %s :%s\r\n", ic.ServerName, code, desc))); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+	return true
+}
+
+// IrcBatchHandler is called when a BATCH command is sent. Only the
+// draft/multiline batch type is supported: the lines of the batch are sent to
+// Slack as a single message.
+func IrcBatchHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if len(args) < 1 || len(args[0]) < 2 {
+		// ERR_NEEDMOREPARAMS
+		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "BATCH :Not enough parameters"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	ref := args[0][1:]
+	switch args[0][0] {
+	case '+':
+		if len(args) < 3 || args[1] != "draft/multiline" {
+			log.Warningf("Unsupported BATCH: %v", args)
+			return
+		}
+		if ctx.batches == nil {
+			ctx.batches = make(map[string]*multilineBatch)
+		}
+		ctx.batches[ref] = &multilineBatch{target: args[2]}
+	case '-':
+		batch, ok := ctx.batches[ref]
+		if !ok {
+			log.Warningf("BATCH: unknown reference %s", ref)
+			return
+		}
+		delete(ctx.batches, ref)
+		if batch.failed || batch.lines == 0 {
+			return
+		}
+		IrcPrivMsgHandler(ctx, prefix, "PRIVMSG", []string{batch.target}, batch.text.String())
+	default:
+		log.Warningf("Invalid BATCH reference %s", args[0])
+	}
+}
@@ -0,0 +1,84 @@
+package ircslack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTags(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"batch":                  "abc",
+		"draft/multiline-concat": "",
+		"escaped":                "a;b c\\d",
+	}, parseTags(`batch=abc;draft/multiline-concat;escaped=a\:b\sc\\d;`))
+	assert.Equal(t, "trailing", unescapeTagValue(`trailing\`))
+	assert.Equal(t, "x", unescapeTagValue(`\x`))
+}
+
+func TestIrcCapHandler(t *testing.T) {
+	conn := &fakeConn{}
+	ctx := &IrcContext{Conn: conn, ServerName: "localhost"}
+
+	IrcCapHandler(ctx, "", "CAP", []string{"LS"}, "")
+	assert.Equal(t, ":localhost CAP * LS :away-notify batch draft/multiline\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcCapHandler(ctx, "", "CAP", []string{"REQ"}, "batch draft/multiline")
+	assert.Equal(t, ":localhost CAP * ACK :batch draft/multiline\r\n", conn.buf.String())
+	assert.True(t, ctx.HasCap("draft/multiline"))
+	conn.buf.Reset()
+
+	// unknown capabilities are refused, and nothing is enabled
+	IrcCapHandler(ctx, "", "CAP", []string{"REQ"}, "-batch unknown")
+	assert.Equal(t, ":localhost CAP * NAK :-batch unknown\r\n", conn.buf.String())
+	assert.True(t, ctx.HasCap("batch"))
+	conn.buf.Reset()
+
+	IrcCapHandler(ctx, "", "CAP", []string{"REQ"}, "-batch")
+	assert.False(t, ctx.HasCap("batch"))
+	conn.buf.Reset()
+
+	IrcCapHandler(ctx, "", "CAP", []string{"LIST"}, "")
+	assert.Equal(t, ":localhost CAP * LIST :draft/multiline\r\n", conn.buf.String())
+}
+
+func newMultilineTestContext() (*IrcContext, *fakeConn) {
+	ctx, conn, _ := newFakeSlackTestContext(nil)
+	ctx.postMessage = make(chan SlackPostMessage, 1)
+	ctx.Channels.Add(Channel{GroupConversation: slack.GroupConversation{Name: "general", Conversation: slack.Conversation{ID: "C1234"}}, IsChannel: true})
+	return ctx, conn
+}
+
+func TestMultilineBatch(t *testing.T) {
+	ctx, _ := newMultilineTestContext()
+	IrcBatchHandler(ctx, "", "BATCH", []string{"+ref1", "draft/multiline", "#general"}, "")
+	assert.True(t, ctx.addToBatch("ref1", "PRIVMSG", map[string]string{"batch": "ref1"}, []string{"#general"}, "line one"))
+	assert.True(t, ctx.addToBatch("ref1", "PRIVMSG", map[string]string{"batch": "ref1"}, []string{"#general"}, "line two, "))
+	assert.True(t, ctx.addToBatch("ref1", "PRIVMSG", map[string]string{"batch": "ref1", "draft/multiline-concat": ""}, []string{"#general"}, "continued"))
+	// unknown batches are not handled
+	assert.False(t, ctx.addToBatch("ref2", "PRIVMSG", map[string]string{"batch": "ref2"}, []string{"#general"}, "other"))
+	require.Empty(t, ctx.postMessage)
+
+	IrcBatchHandler(ctx, "", "BATCH", []string{"-ref1"}, "")
+	require.Len(t, ctx.postMessage, 1)
+	msg := <-ctx.postMessage
+	assert.Equal(t, "general", msg.Target)
+	assert.Equal(t, "line one\nline two, continued", msg.Text)
+	assert.Empty(t, ctx.batches)
+}
+
+func TestMultilineBatchMaxLines(t *testing.T) {
+	ctx, conn := newMultilineTestContext()
+	IrcBatchHandler(ctx, "", "BATCH", []string{"+ref1", "draft/multiline", "#general"}, "")
+	for i := 0; i <= MultilineMaxLines; i++ {
+		ctx.addToBatch("ref1", "PRIVMSG", map[string]string{"batch": "ref1"}, []string{"#general"}, "line")
+	}
+	assert.True(t, strings.HasPrefix(conn.buf.String(), ":localhost FAIL BATCH MULTILINE_MAX_LINES "))
+	IrcBatchHandler(ctx, "", "BATCH", []string{"-ref1"}, "")
+	// the failed batch is discarded
+	assert.Empty(t, ctx.postMessage)
+}
@@ -0,0 +1,136 @@
+package ircslack
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/slack-go/slack"
+)
+
+// Nick policies, i.e. which Slack user attribute is used to derive the IRC
+// nickname of a user.
+const (
+	// NickPolicyUsername uses the Slack user name, i.e. the legacy handle.
+	NickPolicyUsername = "username"
+	// NickPolicyDisplayName uses the Slack display name, falling back to the
+	// user name if not set.
+	NickPolicyDisplayName = "displayname"
+	// NickPolicyRealName uses the Slack real name, falling back to the user
+	// name if not set.
+	NickPolicyRealName = "realname"
+)
+
+// MaxNickLength is the maximum length in bytes of an IRC nickname. Longer
+// nicknames derived from Slack users are truncated.
+const MaxNickLength = 50
+
+// NickPolicies returns a list of supported nick policies.
+func NickPolicies() []string {
+	return []string{NickPolicyUsername, NickPolicyDisplayName, NickPolicyRealName}
+}
+
+// foldCase folds the case of a nickname or a channel name, so that they can be
+// compared case-insensitively. Only the ASCII letters are folded, as per the
+// ascii casemapping advertised in RPL_ISUPPORT, so that the gateway and the
+// clients agree on which names are equivalent.
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// equalFold returns true if two nicknames or channel names are equal after
+// folding their case with foldCase.
+func equalFold(a, b string) bool {
+	return foldCase(a) == foldCase(b)
+}
+
+// truncateNick truncates a nickname to at most n bytes, without splitting a
+// multi-byte character.
+func truncateNick(nick string, n int) string {
+	for len(nick) > n {
+		_, size := utf8.DecodeLastRuneInString(nick)
+		nick = nick[:len(nick)-size]
+	}
+	return nick
+}
+
+// isNickSpecial returns true for the non-alphanumeric characters that are
+// allowed in IRC nicknames, as per RFC2812.
+func isNickSpecial(r rune) bool {
+	return strings.ContainsRune("[]\\`_^{|}", r)
+}
+
+// SanitizeNick converts a string to a valid IRC nickname. Characters that
+// are not allowed are replaced by underscores, and a nickname cannot start
+// with a digit or a dash. Non-ASCII letters and digits are preserved, since
+// the gateway speaks UTF-8. An empty string is returned if nothing is left.
+func SanitizeNick(name string) string {
+	var b strings.Builder
+	lastUnderscore := false
+	for _, r := range strings.TrimSpace(name) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || (isNickSpecial(r) && r != '_'):
+			b.WriteRune(r)
+			lastUnderscore = false
+		default:
+			// squeeze consecutive invalid characters and underscores
+			if !lastUnderscore {
+				b.WriteRune('_')
+				lastUnderscore = true
+			}
+		}
+	}
+	nick := strings.Trim(b.String(), "_")
+	if nick == "" {
+		return ""
+	}
+	if first := []rune(nick)[0]; unicode.IsDigit(first) || first == '-' {
+		nick = "_" + nick
+	}
+	return nick
+}
+
+// DeriveNick returns the IRC nickname of a Slack user according to the given
+// nick policy, before resolving collisions with other users. See
+// Users.NickByID for the actual nickname of a user.
+func DeriveNick(user *slack.User, policy string) string {
+	return truncateNick(deriveNick(user, policy), MaxNickLength)
+}
+
+// deriveNick is DeriveNick without the length limit.
+func deriveNick(user *slack.User, policy string) string {
+	var name string
+	switch policy {
+	case NickPolicyDisplayName:
+		name = user.Profile.DisplayName
+	case NickPolicyRealName:
+		name = user.RealName
+		if name == "" {
+			name = user.Profile.RealName
+		}
+	}
+	if nick := SanitizeNick(name); nick != "" {
+		return nick
+	}
+	if nick := SanitizeNick(user.Name); nick != "" {
+		return nick
+	}
+	return user.ID
+}
+
+// disambiguateNick returns the nickname to use for a user whose derived nick
+// collides with the one of another user. The suffix is derived from the user
+// ID, so it does not depend on the order in which users are known. The
+// nickname is truncated to make room for the suffix.
+func disambiguateNick(nick, userID string, full bool) string {
+	suffix := userID
+	if !full && len(userID) > 4 {
+		suffix = userID[len(userID)-4:]
+	}
+	return truncateNick(nick, MaxNickLength-len(suffix)-1) + "|" + suffix
+}
@@ -0,0 +1,190 @@
+package ircslack
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeNick(t *testing.T) {
+	assert.Equal(t, "insomniac", SanitizeNick("insomniac"))
+	assert.Equal(t, "Andrea_Barberio", SanitizeNick("Andrea Barberio"))
+	assert.Equal(t, "john_doe", SanitizeNick("john.doe"))
+	assert.Equal(t, "a_b", SanitizeNick(" a => b "))
+	assert.Equal(t, "[away]|x^", SanitizeNick("[away]|x^"))
+	assert.Equal(t, "_42cats", SanitizeNick("42cats"))
+	assert.Equal(t, "_-dash", SanitizeNick("-dash"))
+	assert.Equal(t, "Zoë", SanitizeNick("Zoë"))
+	assert.Equal(t, "", SanitizeNick("🎉 !"))
+	assert.Equal(t, "", SanitizeNick(""))
+}
+
+func TestFoldCase(t *testing.T) {
+	assert.Equal(t, "alice[away]", foldCase("ALICE[away]"))
+	// only ASCII letters are folded
+	assert.Equal(t, "Éric", foldCase("ÉRIC"))
+	assert.True(t, equalFold("Zoë", "zoë"))
+	assert.False(t, equalFold("ZOË", "zoë"))
+}
+
+func TestTruncateNick(t *testing.T) {
+	assert.Equal(t, "alice", truncateNick("alice", 9))
+	assert.Equal(t, "ali", truncateNick("alice", 3))
+	// multi-byte characters are not split
+	assert.Equal(t, "Zo", truncateNick("Zoë", 3))
+}
+
+func TestDeriveNick(t *testing.T) {
+	user := slack.User{
+		ID:       "U1234",
+		Name:     "insomniac",
+		RealName: "Andrea Barberio",
+		Profile:  slack.UserProfile{DisplayName: "andrea"},
+	}
+	assert.Equal(t, "insomniac", DeriveNick(&user, NickPolicyUsername))
+	assert.Equal(t, "andrea", DeriveNick(&user, NickPolicyDisplayName))
+	assert.Equal(t, "Andrea_Barberio", DeriveNick(&user, NickPolicyRealName))
+
+	// fall back to the user name, then to the ID
+	user.Profile.DisplayName = "🎉"
+	assert.Equal(t, "insomniac", DeriveNick(&user, NickPolicyDisplayName))
+	user.Name = ""
+	assert.Equal(t, "U1234", DeriveNick(&user, NickPolicyDisplayName))
+
+	// long nicknames are truncated, including the collision suffix
+	user.RealName = strings.Repeat("x", 60)
+	assert.Equal(t, strings.Repeat("x", MaxNickLength), DeriveNick(&user, NickPolicyRealName))
+	assert.Equal(t, strings.Repeat("x", MaxNickLength-11)+"|U123456789", disambiguateNick(user.RealName, "U123456789", true))
+}
+
+func TestUsersNickCollisions(t *testing.T) {
+	alice1 := slack.User{ID: "U0002ABCD", Name: "alice1", Profile: slack.UserProfile{DisplayName: "Alice"}}
+	alice2 := slack.User{ID: "U0001WXYZ", Name: "alice2", Profile: slack.UserProfile{DisplayName: "alice"}}
+
+	// the result doesn't depend on the order in which users are added
+	for _, order := range [][]slack.User{{alice1, alice2}, {alice2, alice1}} {
+		users := NewUsers(0)
+		users.SetNickPolicy(NickPolicyDisplayName)
+		users.Add(order...)
+		assert.Equal(t, "alice", users.NickByID("U0001WXYZ"))
+		assert.Equal(t, "Alice|ABCD", users.NickByID("U0002ABCD"))
+		u := users.ByNick("ALICE")
+		require.NotNil(t, u)
+		assert.Equal(t, "U0001WXYZ", u.ID)
+		u = users.ByNick("alice|abcd")
+		require.NotNil(t, u)
+		assert.Equal(t, "U0002ABCD", u.ID)
+	}
+}
+
+func TestUsersNickCollisionsWithSuffix(t *testing.T) {
+	// bob|WXYZ is the nick that the second bob would get
+	bob1 := slack.User{ID: "U0001ABCD", Name: "bob"}
+	bob2 := slack.User{ID: "U0002WXYZ", Name: "Bob"}
+	suffixed := slack.User{ID: "U0003EFGH", Name: "bob|wxyz"}
+
+	for _, order := range [][]slack.User{{bob1, bob2, suffixed}, {suffixed, bob2, bob1}, {bob2, suffixed, bob1}} {
+		users := NewUsers(0)
+		for _, user := range order {
+			users.Add(user)
+		}
+		// the real nick wins over the suffixed one
+		assert.Equal(t, "bob", users.NickByID("U0001ABCD"))
+		assert.Equal(t, "bob|wxyz", users.NickByID("U0003EFGH"))
+		assert.Equal(t, "Bob|U0002WXYZ", users.NickByID("U0002WXYZ"))
+		for _, id := range []string{"U0001ABCD", "U0002WXYZ", "U0003EFGH"} {
+			u := users.ByNick(users.NickByID(id))
+			require.NotNil(t, u)
+			assert.Equal(t, id, u.ID)
+		}
+	}
+}
+
+func TestUsersNickChange(t *testing.T) {
+	users := NewUsers(0)
+	users.SetNickPolicy(NickPolicyDisplayName)
+	users.Add(
+		slack.User{ID: "U1", Name: "bob", Profile: slack.UserProfile{DisplayName: "bob"}},
+		slack.User{ID: "U2", Name: "bobby", Profile: slack.UserProfile{DisplayName: "bob"}},
+	)
+	assert.Equal(t, "bob|U2", users.NickByID("U2"))
+
+	// the collision goes away when the first user changes display name
+	users.Add(slack.User{ID: "U1", Name: "bob", Profile: slack.UserProfile{DisplayName: "robert"}})
+	assert.Equal(t, "robert", users.NickByID("U1"))
+	assert.Equal(t, "bob", users.NickByID("U2"))
+	assert.Nil(t, users.ByNick("bob|U2"))
+	assert.Equal(t, []string{"robert", "bob"}, users.IDsToNames("U1", "U2"))
+
+	// changing the policy recomputes all the nicknames
+	users.SetNickPolicy(NickPolicyUsername)
+	assert.Equal(t, []string{"bob", "bobby"}, users.IDsToNames("U1", "U2"))
+}
+
+func TestNickOf(t *testing.T) {
+	ctx := &IrcContext{Users: NewUsers(0)}
+	ctx.Users.SetNickPolicy(NickPolicyRealName)
+	user := slack.User{ID: "U1234", Name: "insomniac", RealName: "Andrea Barberio"}
+	// unknown users fall back to their Slack name
+	assert.Equal(t, "insomniac", ctx.NickOf(&user))
+	ctx.Users.Add(user)
+	assert.Equal(t, "Andrea_Barberio", ctx.NickOf(&user))
+	assert.Equal(t, "hi @Andrea_Barberio", ctx.ExpandEntities("hi <@U1234>"))
+	assert.Equal(t, "hi <@U1234>", parseMentions(ctx, "hi @andrea_barberio"))
+}
+
+func TestUsersAddNickChanges(t *testing.T) {
+	users := NewUsers(0)
+	users.SetNickPolicy(NickPolicyDisplayName)
+	// new users are not nick changes
+	assert.Empty(t, users.Add(
+		slack.User{ID: "U1", Name: "bob", Profile: slack.UserProfile{DisplayName: "bob"}},
+		slack.User{ID: "U2", Name: "bobby", Profile: slack.UserProfile{DisplayName: "bob"}},
+	))
+	// unrelated changes are not nick changes either
+	assert.Empty(t, users.Add(slack.User{ID: "U1", Name: "bob", RealName: "Bob", Profile: slack.UserProfile{DisplayName: "bob"}}))
+	// renaming the first user also renames the one it collided with
+	changes := users.Add(slack.User{ID: "U1", Name: "bob", Profile: slack.UserProfile{DisplayName: "robert"}})
+	assert.ElementsMatch(t, []NickChange{
+		{UserID: "U1", OldNick: "bob", NewNick: "robert"},
+		{UserID: "U2", OldNick: "bob|U2", NewNick: "bob"},
+	}, changes)
+	// case changes are nick changes
+	changes = users.Add(slack.User{ID: "U1", Name: "bob", Profile: slack.UserProfile{DisplayName: "Robert"}})
+	assert.Equal(t, []NickChange{{UserID: "U1", OldNick: "robert", NewNick: "Robert"}}, changes)
+	u := users.ByNick("robert")
+	require.NotNil(t, u)
+	assert.Equal(t, "U1", u.ID)
+}
+
+type fakeConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func TestSendNickChanges(t *testing.T) {
+	conn := &fakeConn{}
+	ctx := &IrcContext{
+		Conn:       conn,
+		ServerName: "localhost",
+		User:       &slack.User{ID: "UME"},
+	}
+	ctx.SendNickChanges([]NickChange{
+		{UserID: "U1", OldNick: "bob", NewNick: "robert"},
+		{UserID: "UME", OldNick: "me", NewNick: "myself"},
+	})
+	assert.Equal(t, ":bob!U1@localhost NICK robert\r\n:me!UME@127.0.0.1 NICK myself\r\n", conn.buf.String())
+}
@@ -0,0 +1,121 @@
+package ircslack
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// clientOption is an option that the client can change for its own
+// connection with SET, overriding the server's default. get and set are
+// called with optionsMu held.
+type clientOption struct {
+	// values are the accepted values
+	values []string
+	get    func(ctx *IrcContext) string
+	set    func(ctx *IrcContext, value string)
+}
+
+// clientOptions are the options that can be changed with SET, by name.
+var clientOptions = map[string]clientOption{
+	"emoji": {
+		values: []string{"on", "off"},
+		get: func(ctx *IrcContext) string {
+			if ctx.TranslateEmoji {
+				return "on"
+			}
+			return "off"
+		},
+		set: func(ctx *IrcContext, value string) {
+			enable := value == "on"
+			if enable && !ctx.TranslateEmoji && ctx.Emoji != nil && ctx.SlackClient != nil {
+				// custom emoji are only fetched while emoji are translated
+				ctx.goBackground(func() {
+					if err := ctx.Emoji.Fetch(ctx.Context(), ctx.SlackClient); err != nil {
+						log.Warningf("Failed to fetch custom emoji: %v", err)
+					}
+				})
+			}
+			ctx.TranslateEmoji = enable
+		},
+	},
+	"formatting": {
+		values: FormattingModes(),
+		get: func(ctx *IrcContext) string {
+			if ctx.Formatting == "" {
+				return FormattingRaw
+			}
+			return ctx.Formatting
+		},
+		set: func(ctx *IrcContext, value string) {
+			ctx.Formatting = value
+		},
+	},
+}
+
+// emoji returns the emoji translator of the client, or nil if the client does
+// not translate emoji.
+func (ic *IrcContext) emoji() *Emoji {
+	ic.optionsMu.Lock()
+	defer ic.optionsMu.Unlock()
+	if !ic.TranslateEmoji {
+		return nil
+	}
+	return ic.Emoji
+}
+
+// formatting returns the formatting mode of the client.
+func (ic *IrcContext) formatting() string {
+	ic.optionsMu.Lock()
+	defer ic.optionsMu.Unlock()
+	return ic.Formatting
+}
+
+// getOption returns the current value of an option.
+func (ic *IrcContext) getOption(opt clientOption) string {
+	ic.optionsMu.Lock()
+	defer ic.optionsMu.Unlock()
+	return opt.get(ic)
+}
+
+// IrcSetHandler is called when a SET command is sent. It shows or changes the
+// options of the client's connection: without arguments it shows all of
+// them, with a name it shows one, and with a name and a value it changes it,
+// e.g. `SET emoji off`.
+func IrcSetHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if trailing != "" {
+		args = append(args, trailing)
+	}
+	names := make([]string, 0, len(clientOptions))
+	for name := range clientOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(args) == 0 {
+		for _, name := range names {
+			ctx.SendNotice("%s = %s", name, ctx.getOption(clientOptions[name]))
+		}
+		return
+	}
+	if len(args) > 2 {
+		ctx.SendUnknownError("Invalid SET command. Syntax: SET [<option> [<value>]]")
+		return
+	}
+	name := strings.ToLower(args[0])
+	opt, ok := clientOptions[name]
+	if !ok {
+		ctx.SendNotice("Unknown option %s. Options are %v", args[0], names)
+		return
+	}
+	if len(args) == 2 {
+		value := strings.ToLower(args[1])
+		if !slices.Contains(opt.values, value) {
+			ctx.SendNotice("Invalid value %s for %s. Values are %v", args[1], name, opt.values)
+			return
+		}
+		ctx.optionsMu.Lock()
+		opt.set(ctx, value)
+		ctx.optionsMu.Unlock()
+	}
+	ctx.SendNotice("%s = %s", name, ctx.getOption(opt))
+}
@@ -0,0 +1,54 @@
+package ircslack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIrcSetHandlerEmoji(t *testing.T) {
+	ctx, conn, _ := newFakeSlackTestContext(nil)
+	ctx.Emoji = NewEmoji()
+	assert.Equal(t, ":+1:", ctx.ExpandText(":+1:"))
+
+	IrcSetHandler(ctx, "", "SET", []string{"emoji", "on"}, "")
+	assert.Equal(t, ":localhost NOTICE me :emoji = on\r\n", conn.buf.String())
+	assert.Equal(t, "👍", ctx.ExpandText(":+1:"))
+	conn.buf.Reset()
+
+	IrcSetHandler(ctx, "", "SET", []string{"EMOJI"}, "off")
+	assert.Equal(t, ":localhost NOTICE me :emoji = off\r\n", conn.buf.String())
+	assert.Equal(t, ":+1:", ctx.ExpandText(":+1:"))
+	conn.buf.Reset()
+
+	IrcSetHandler(ctx, "", "SET", nil, "")
+	assert.Equal(t, ":localhost NOTICE me :emoji = off\r\n:localhost NOTICE me :formatting = raw\r\n", conn.buf.String())
+}
+
+func TestIrcSetHandlerFormatting(t *testing.T) {
+	ctx, conn, _ := newFakeSlackTestContext(nil)
+	assert.Equal(t, "*bold*", ctx.ExpandText("*bold*"))
+	assert.Equal(t, "\x02bold\x02", ctx.FormatOutgoingText("\x02bold\x02"))
+
+	IrcSetHandler(ctx, "", "SET", []string{"formatting", "irc"}, "")
+	assert.Equal(t, ":localhost NOTICE me :formatting = irc\r\n", conn.buf.String())
+	assert.Equal(t, "\x02bold\x02", ctx.ExpandText("*bold*"))
+	assert.Equal(t, "*bold*", ctx.FormatOutgoingText("\x02bold\x02"))
+	conn.buf.Reset()
+
+	IrcSetHandler(ctx, "", "SET", []string{"formatting", "strip"}, "")
+	assert.Equal(t, ":localhost NOTICE me :formatting = strip\r\n", conn.buf.String())
+	assert.Equal(t, "bold", ctx.ExpandText("*bold*"))
+	assert.Equal(t, "bold", ctx.FormatOutgoingText("\x02bold\x02"))
+}
+
+func TestIrcSetHandlerInvalid(t *testing.T) {
+	ctx, conn, _ := newFakeSlackTestContext(nil)
+	IrcSetHandler(ctx, "", "SET", []string{"colors"}, "")
+	assert.Equal(t, ":localhost NOTICE me :Unknown option colors. Options are [emoji formatting]\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcSetHandler(ctx, "", "SET", []string{"emoji", "maybe"}, "")
+	assert.Equal(t, ":localhost NOTICE me :Invalid value maybe for emoji. Values are [on off]\r\n", conn.buf.String())
+	assert.False(t, ctx.TranslateEmoji)
+}
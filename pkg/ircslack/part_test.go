@@ -0,0 +1,92 @@
+package ircslack
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// routeLeave replies to conversations.leave, and records the IDs of the
+// channels that were left.
+func routeLeave(req *http.Request) (string, string, error) {
+	switch req.URL.Path {
+	case "/api/conversations.leave":
+		channel := req.PostForm.Get("channel")
+		// reply as per https://api.slack.com/methods/conversations.leave
+		if channel == "CNOTIN" {
+			return channel, `{"ok": true, "not_in_channel": true}`, nil
+		}
+		return channel, `{"ok": true}`, nil
+	default:
+		return "", "", errUnsupportedURL(req)
+	}
+}
+
+func newPartTestContext() (*IrcContext, *fakeConn, *fakeSlackAPI) {
+	ctx, conn, httpClient := newFakeSlackTestContext(routeLeave)
+	member := func(id, name string) Channel {
+		ch := Channel{IsChannel: true}
+		ch.ID, ch.Name, ch.IsMember = id, name, true
+		return ch
+	}
+	notMember := member("CRANDOM", "random")
+	notMember.IsMember = false
+	var mpim Channel
+	mpim.ID, mpim.Name, mpim.IsMpIM = "G1234", "mpdm-me--bob--alice-1", true
+	ctx.Channels.Add(
+		member("CGENERAL", "general"),
+		member("CDEV", "dev"),
+		member("CNOTIN", "stale"),
+		notMember,
+		mpim,
+	)
+	return ctx, conn, httpClient
+}
+
+func TestIrcPartHandler(t *testing.T) {
+	ctx, conn, httpClient := newPartTestContext()
+	IrcPartHandler(ctx, "", "PART", []string{"#general,#dev"}, "bye")
+	assert.Equal(t, []string{"CGENERAL", "CDEV"}, httpClient.calls)
+	assert.Equal(t,
+		":me!UME@127.0.0.1 PART #general :bye\r\n"+
+			":me!UME@127.0.0.1 PART #dev :bye\r\n",
+		conn.buf.String(),
+	)
+	assert.False(t, ctx.Channels.ByName("#general").IsMember)
+}
+
+func TestIrcPartHandlerErrors(t *testing.T) {
+	ctx, conn, httpClient := newPartTestContext()
+	IrcPartHandler(ctx, "", "PART", []string{"#nonexistent"}, "")
+	assert.Equal(t, ":localhost 403 me #nonexistent :No such channel\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcPartHandler(ctx, "", "PART", []string{"#random"}, "")
+	assert.Equal(t, ":localhost 442 me #random :You're not on that channel\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcPartHandler(ctx, "", "PART", []string{"#stale"}, "")
+	assert.Equal(t, ":localhost 442 me #stale :You're not on that channel\r\n", conn.buf.String())
+	assert.Equal(t, []string{"CNOTIN"}, httpClient.calls)
+	conn.buf.Reset()
+
+	IrcPartHandler(ctx, "", "PART", nil, "")
+	assert.Equal(t, ":localhost 461 me :PART :Not enough parameters\r\n", conn.buf.String())
+}
+
+func TestIrcPartHandlerHide(t *testing.T) {
+	ctx, conn, httpClient := newPartTestContext()
+	mpim := ctx.Channels.ByID("G1234").IRCName()
+	IrcPartHandler(ctx, "", "PART", []string{mpim + ",+general-1234.5678"}, "")
+	// multi-party IMs and threads are not left on Slack
+	assert.Empty(t, httpClient.calls)
+	assert.Equal(t,
+		":me!UME@127.0.0.1 PART "+mpim+"\r\n"+
+			":me!UME@127.0.0.1 PART +general-1234.5678\r\n",
+		conn.buf.String(),
+	)
+	assert.True(t, ctx.unhide(mpim))
+	assert.False(t, ctx.unhide(mpim))
+	assert.True(t, ctx.unhide("+general-1234.5678"))
+}
@@ -0,0 +1,97 @@
+package ircslack
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// minCodeLines is the minimum number of lines that have to look like code for
+// a text to be formatted as code.
+const minCodeLines = 2
+
+// stackTracePrefixes are the prefixes of the unindented lines of stack traces.
+var stackTracePrefixes = []string{
+	"Traceback (most recent call last):", "goroutine ", "panic: ",
+	"Caused by: ", "Exception in thread ",
+}
+
+// logLineRegexp matches the timestamps and levels that log lines start with,
+// e.g. "2024-01-02 15:04:05", "15:04:05.000" or "[ERROR]".
+var logLineRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}|\d{2}:\d{2}:\d{2}[.,]\d+|\[?(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL)\]?[: ])`)
+
+// looksLikeCode returns true if a multi-line text looks like pasted code, a
+// stack trace or a log, rather than prose. At least minCodeLines lines, and
+// half of the non-empty lines, have to look like code.
+func looksLikeCode(text string) bool {
+	if !strings.Contains(text, "\n") || strings.Contains(text, "```") {
+		return false
+	}
+	var lines, codeLines int
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines++
+		if isCodeLine(line) {
+			codeLines++
+		}
+	}
+	return codeLines >= minCodeLines && codeLines*2 >= lines
+}
+
+// isCodeLine returns true if a line looks like code: it is indented, it opens
+// or closes a block, or it is part of a stack trace or a log.
+func isCodeLine(line string) bool {
+	if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "  ") {
+		return true
+	}
+	trimmed := strings.TrimRight(line, " \t")
+	if strings.HasSuffix(trimmed, " {") || strings.Trim(trimmed, "});") == "" {
+		return true
+	}
+	for _, prefix := range stackTracePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return logLineRegexp.MatchString(line)
+}
+
+// formatPaste wraps pasted code in a Slack code block, so that indentation and
+// formatting characters are preserved. Other texts are returned unchanged.
+func formatPaste(text string) string {
+	if !looksLikeCode(text) {
+		return text
+	}
+	return "```\n" + text + "\n```"
+}
+
+// uploadSnippet uploads a long message as a text snippet instead of posting
+// it, so that it does not flood the conversation.
+func (ic *IrcContext) uploadSnippet(message SlackPostMessage) error {
+	ch := ic.Channels.ByName(message.Target)
+	if ch == nil {
+		ch = ic.Channels.ByID(message.Target)
+	}
+	if ch == nil {
+		return fmt.Errorf("cannot upload a snippet to %s: unknown conversation", message.Target)
+	}
+	lines := strings.Count(message.Text, "\n") + 1
+	return ic.RateLimiter.Do(ic.Context(), "files.completeUploadExternal", PriorityHigh, func(ctx context.Context) error {
+		_, err := ic.SlackClient.UploadFileContext(ctx, slack.UploadFileParameters{
+			Channel:         ch.ID,
+			ThreadTimestamp: message.TargetTs,
+			Content:         message.Text,
+			FileSize:        len(message.Text),
+			Filename:        fmt.Sprintf("paste-%s.txt", time.Now().Format("20060102-150405")),
+			Title:           fmt.Sprintf("Pasted text (%d lines)", lines),
+			SnippetType:     "text",
+		})
+		return err
+	})
+}
@@ -0,0 +1,91 @@
+package ircslack
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLooksLikeCode(t *testing.T) {
+	assert.False(t, looksLikeCode("single line;"))
+	assert.False(t, looksLikeCode("hello there\nhow are you?"))
+	assert.False(t, looksLikeCode("```\nalready fenced;\n```"))
+	assert.True(t, looksLikeCode("func main() {\n\tfmt.Println(\"hi\")\n}"))
+	assert.True(t, looksLikeCode("Traceback (most recent call last):\n  File \"x.py\", line 1, in <module>\nNameError: name 'x' is not defined"))
+	assert.True(t, looksLikeCode("java.lang.NullPointerException\n\tat com.example.Foo.bar(Foo.java:42)\n\tat com.example.Main.main(Main.java:7)"))
+	assert.True(t, looksLikeCode("2024-01-02 15:04:05 INFO starting\n2024-01-02 15:04:06 ERROR failed\nretrying"))
+	assert.True(t, looksLikeCode("[ERROR] cannot connect\n[WARN] retrying in 5s"))
+}
+
+func TestLooksLikeCodeProse(t *testing.T) {
+	// smileys and parentheses
+	assert.False(t, looksLikeCode("hi :)\nsure (later)"))
+	assert.False(t, looksLikeCode("that broke :(\nagain (sigh)\nsee [1]"))
+	// prose starting like code
+	assert.False(t, looksLikeCode("at home today\nreturn the keys please\nException: none"))
+	assert.False(t, looksLikeCode("# agenda\nimport the data\nclass starts at 10"))
+	// a single indented line
+	assert.False(t, looksLikeCode("see below\n  this one\nthanks"))
+}
+
+func TestFormatPaste(t *testing.T) {
+	assert.Equal(t, "hello\nworld", formatPaste("hello\nworld"))
+	assert.Equal(t, "```\nif x {\n  return\n}\n```", formatPaste("if x {\n  return\n}"))
+}
+
+func TestPostMessagesFormatPasteDisabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "if x {\n  return\n}", r.FormValue("text"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok": true, "channel": "C1234", "ts": "1234.5678"}`))
+	}))
+	defer server.Close()
+
+	ctx, _ := newMultilineTestContext()
+	ctx.SlackClient = slack.New("test-token", slack.OptionAPIURL(server.URL+"/api/"))
+	ctx.postMessages([]SlackPostMessage{{Target: "general", Text: "if x {\n  return\n}"}})
+}
+
+func TestPostMessagesSnippet(t *testing.T) {
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/files.getUploadURLExternal":
+			_, _ = w.Write([]byte(`{"ok": true, "upload_url": "http://` + r.Host + `/upload", "file_id": "F1234"}`))
+		case "/upload":
+			w.WriteHeader(http.StatusOK)
+		case "/api/files.completeUploadExternal":
+			assert.Equal(t, "C1234", r.FormValue("channel_id"))
+			_, _ = w.Write([]byte(`{"ok": true, "files": [{"id": "F1234", "title": "paste"}]}`))
+		case "/api/chat.postMessage":
+			assert.Equal(t, "general", r.FormValue("channel"))
+			assert.Equal(t, "```\nif x {\n  return\n}\n```", r.FormValue("text"))
+			_, _ = w.Write([]byte(`{"ok": true, "channel": "C1234", "ts": "1234.5678"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx, _ := newMultilineTestContext()
+	ctx.SlackClient = slack.New("test-token", slack.OptionAPIURL(server.URL+"/api/"))
+	ctx.SnippetLines = 3
+	ctx.FormatPaste = true
+	ctx.postMessages([]SlackPostMessage{
+		{Target: "general", Text: "if x {\n  return\n}"},
+		{Target: "general", Text: strings.Repeat("log line\n", 10)},
+	})
+	require.Equal(t, []string{
+		"/api/chat.postMessage",
+		"/api/files.getUploadURLExternal",
+		"/upload",
+		"/api/files.completeUploadExternal",
+	}, calls)
+}
@@ -0,0 +1,304 @@
+package ircslack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// Away modes, i.e. what the AWAY command does on Slack besides setting the
+// presence to away.
+const (
+	// AwayModePresence only sets the Slack presence.
+	AwayModePresence = "presence"
+	// AwayModeStatus also sets the away message as Slack custom status, and
+	// restores the previous status when back.
+	AwayModeStatus = "status"
+	// AwayModeDND also pauses the Slack notifications until back.
+	AwayModeDND = "dnd"
+)
+
+// AwayModes returns a list of supported away modes.
+func AwayModes() []string {
+	return []string{AwayModePresence, AwayModeStatus, AwayModeDND}
+}
+
+// SlackMaxStatusLength is the maximum length of a Slack custom status, see
+// https://api.slack.com/methods/users.profile.set .
+const SlackMaxStatusLength = 100
+
+// awaySnoozeMinutes is how long notifications are paused for with
+// AwayModeDND, unless the client comes back earlier.
+const awaySnoozeMinutes = 24 * 60
+
+// defaultAwayMessage is the away message of users without a Slack status.
+const defaultAwayMessage = "Away"
+
+// slackStatus is a Slack custom status.
+type slackStatus struct {
+	Text       string
+	Emoji      string
+	Expiration int64
+}
+
+// isAway returns true if a user is away on Slack. Users whose presence is not
+// known yet are not away.
+func (ic *IrcContext) isAway(userID string) bool {
+	ic.presenceMu.Lock()
+	defer ic.presenceMu.Unlock()
+	return ic.away[userID]
+}
+
+// setAway records whether a user is away, and returns true if this changed.
+func (ic *IrcContext) setAway(userID string, away bool) bool {
+	ic.presenceMu.Lock()
+	defer ic.presenceMu.Unlock()
+	if ic.away == nil {
+		ic.away = make(map[string]bool)
+	}
+	if ic.away[userID] == away {
+		return false
+	}
+	if away {
+		ic.away[userID] = true
+	} else {
+		delete(ic.away, userID)
+	}
+	return true
+}
+
+// awayMessage returns the away message of a user, i.e. their Slack status.
+func awayMessage(ctx *IrcContext, user *slack.User) string {
+	status := strings.TrimSpace(user.Profile.StatusText)
+	if status == "" {
+		return defaultAwayMessage
+	}
+	if user.Profile.StatusEmoji != "" {
+		emoji := user.Profile.StatusEmoji
+		if e := ctx.emoji(); e != nil {
+			emoji = e.ToUnicode(emoji)
+		}
+		status = emoji + " " + status
+	}
+	return status
+}
+
+// sendAway sends RPL_AWAY for a user that is away.
+func sendAway(ctx *IrcContext, user *slack.User) {
+	if !ctx.isAway(user.ID) {
+		return
+	}
+	// RPL_AWAY
+	if err := SendIrcNumeric(ctx, 301, fmt.Sprintf("%s %s", ctx.Nick(), ctx.NickOf(user)), awayMessage(ctx, user)); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// whoFlags returns the flags of a user in a RPL_WHOREPLY, i.e. H (here) or G
+// (gone), followed by their channel prefix.
+func whoFlags(ctx *IrcContext, ch *Channel, user *slack.User) string {
+	flags := "H"
+	if ctx.isAway(user.ID) {
+		flags = "G"
+	}
+	return flags + namesPrefix(ch, user)
+}
+
+// addPresenceSubs adds users to the presence subscriptions. Since every
+// subscription request replaces the previous one, it returns the IDs of all
+// the subscribed users if any was added, or nil otherwise. The caller must
+// hold presenceMu.
+func (ic *IrcContext) addPresenceSubs(ids []string) []string {
+	if ic.presenceSubs == nil {
+		ic.presenceSubs = make(map[string]bool)
+	}
+	added := false
+	for _, id := range ids {
+		if !ic.presenceSubs[id] {
+			ic.presenceSubs[id] = true
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	all := make([]string, 0, len(ic.presenceSubs))
+	for id := range ic.presenceSubs {
+		all = append(all, id)
+	}
+	sort.Strings(all)
+	return all
+}
+
+// subscribePresence subscribes to the presence changes of the given users,
+// e.g. when they are added to the users cache. Slack sends their current
+// presence right away.
+func subscribePresence(ctx *IrcContext, ids ...string) {
+	if ctx.SlackRTM == nil {
+		return
+	}
+	// the lock is held while sending, so that an older subscription request
+	// cannot replace a newer one
+	ctx.presenceMu.Lock()
+	defer ctx.presenceMu.Unlock()
+	all := ctx.addPresenceSubs(ids)
+	if len(all) == 0 {
+		return
+	}
+	log.Infof("Subscribing to the presence of %d users", len(all))
+	ctx.SlackRTM.SendMessage(ctx.SlackRTM.NewSubscribeUserPresence(all))
+}
+
+// handlePresenceChange handles a presence_change event from Slack. If the
+// client enabled the away-notify capability, it is notified of the users
+// that went away or came back.
+func handlePresenceChange(ctx *IrcContext, ev *slack.PresenceChangeEvent) {
+	ids := ev.Users
+	if ev.User != "" {
+		ids = append(ids, ev.User)
+	}
+	away := ev.Presence == "away"
+	for _, id := range ids {
+		if !ctx.setAway(id, away) || id == ctx.UserID() || !ctx.HasCap("away-notify") {
+			continue
+		}
+		user := ctx.Users.ByID(id)
+		if user == nil {
+			continue
+		}
+		msg := fmt.Sprintf(":%s!%s@%s AWAY", ctx.NickOf(user), user.ID, ctx.ServerName)
+		if away {
+			msg += " :" + awayMessage(ctx, user)
+		}
+		if _, err := ctx.Conn.Write([]byte(msg + "\r\n")); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+	}
+}
+
+// IrcAwayHandler is called when an AWAY command is sent. The syntax is
+// `AWAY [:message]`. With a message, the Slack presence is set to away, and
+// depending on the away mode the message is set as status or notifications
+// are paused. Without a message, all of this is undone.
+func IrcAwayHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	message := trailing
+	if message == "" && len(args) > 0 {
+		message = strings.Join(args, " ")
+	}
+	if message != "" {
+		setAway(ctx, message)
+	} else {
+		setBack(ctx)
+	}
+}
+
+// setAway sets the Slack presence of the client to away.
+func setAway(ctx *IrcContext, message string) {
+	err := ctx.RateLimiter.Do(ctx.Context(), "users.setPresence", PriorityHigh, func(c context.Context) error {
+		return ctx.SlackClient.SetUserPresenceContext(c, "away")
+	})
+	if err != nil {
+		ctx.SendUnknownError("Cannot set presence to away: %v", err)
+		return
+	}
+	switch ctx.AwayMode {
+	case AwayModeStatus:
+		if len([]rune(message)) > SlackMaxStatusLength {
+			message = string([]rune(message)[:SlackMaxStatusLength])
+		}
+		if err = saveStatus(ctx); err == nil {
+			err = ctx.RateLimiter.Do(ctx.Context(), "users.profile.set", PriorityHigh, func(c context.Context) error {
+				return ctx.SlackClient.SetUserCustomStatusContext(c, message, "", 0)
+			})
+		}
+	case AwayModeDND:
+		err = ctx.RateLimiter.Do(ctx.Context(), "dnd.setSnooze", PriorityHigh, func(c context.Context) error {
+			_, err := ctx.SlackClient.SetSnoozeContext(c, awaySnoozeMinutes)
+			return err
+		})
+	}
+	if err != nil {
+		ctx.SendUnknownError("Cannot set away: %v", err)
+	}
+	ctx.setAway(ctx.UserID(), true)
+	// RPL_NOWAWAY
+	if err := SendIrcNumeric(ctx, 306, ctx.Nick(), "You have been marked as being away"); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// saveStatus saves the Slack status of the client, so that setBack can restore
+// it. The status is read from Slack, since it may have changed since the
+// login. An already saved status is kept, so that the message of a previous
+// AWAY is not saved instead.
+func saveStatus(ctx *IrcContext) error {
+	ctx.presenceMu.Lock()
+	saved := ctx.savedStatus != nil
+	ctx.presenceMu.Unlock()
+	if saved {
+		return nil
+	}
+	var profile *slack.UserProfile
+	err := ctx.RateLimiter.Do(ctx.Context(), "users.profile.get", PriorityHigh, func(c context.Context) error {
+		var err error
+		profile, err = ctx.SlackClient.GetUserProfileContext(c, &slack.GetUserProfileParameters{UserID: ctx.UserID()})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot get the current status: %w", err)
+	}
+	ctx.presenceMu.Lock()
+	ctx.savedStatus = &slackStatus{
+		Text:       profile.StatusText,
+		Emoji:      profile.StatusEmoji,
+		Expiration: int64(profile.StatusExpiration),
+	}
+	ctx.presenceMu.Unlock()
+	return nil
+}
+
+// setBack sets the Slack presence of the client back to auto, and undoes what
+// setAway did according to the away mode.
+func setBack(ctx *IrcContext) {
+	err := ctx.RateLimiter.Do(ctx.Context(), "users.setPresence", PriorityHigh, func(c context.Context) error {
+		return ctx.SlackClient.SetUserPresenceContext(c, "auto")
+	})
+	if err != nil {
+		ctx.SendUnknownError("Cannot set presence to auto: %v", err)
+		return
+	}
+	switch ctx.AwayMode {
+	case AwayModeStatus:
+		ctx.presenceMu.Lock()
+		saved := ctx.savedStatus
+		ctx.savedStatus = nil
+		ctx.presenceMu.Unlock()
+		if saved != nil {
+			err = ctx.RateLimiter.Do(ctx.Context(), "users.profile.set", PriorityHigh, func(c context.Context) error {
+				return ctx.SlackClient.SetUserCustomStatusContext(c, saved.Text, saved.Emoji, saved.Expiration)
+			})
+		}
+	case AwayModeDND:
+		err = ctx.RateLimiter.Do(ctx.Context(), "dnd.endSnooze", PriorityHigh, func(c context.Context) error {
+			_, err := ctx.SlackClient.EndSnoozeContext(c)
+			return err
+		})
+		var slackErr slack.SlackErrorResponse
+		if errors.As(err, &slackErr) && slackErr.Err == "snooze_not_active" {
+			// notifications were resumed on Slack already
+			err = nil
+		}
+	}
+	if err != nil {
+		ctx.SendUnknownError("Cannot set back: %v", err)
+	}
+	ctx.setAway(ctx.UserID(), false)
+	// RPL_UNAWAY
+	if err := SendIrcNumeric(ctx, 305, ctx.Nick(), "You are no longer marked as being away"); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
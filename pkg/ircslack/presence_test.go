@@ -0,0 +1,139 @@
+package ircslack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+// routePresence replies to the methods used by AWAY, and records the calls as
+// "method argument".
+func routePresence(req *http.Request) (string, string, error) {
+	switch req.URL.Path {
+	case "/api/users.profile.get":
+		// the status changed since the login
+		return "users.profile.get " + req.PostForm.Get("user"), `{"ok": true, "profile": {"status_text": "Commuting", "status_emoji": ":train:"}}`, nil
+	case "/api/users.setPresence":
+		return "users.setPresence " + req.PostForm.Get("presence"), `{"ok": true}`, nil
+	case "/api/users.profile.set":
+		var profile struct {
+			StatusText  string `json:"status_text"`
+			StatusEmoji string `json:"status_emoji"`
+		}
+		if err := json.Unmarshal([]byte(req.PostForm.Get("profile")), &profile); err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("users.profile.set %s %s", profile.StatusText, profile.StatusEmoji), `{"ok": true, "profile": {}}`, nil
+	case "/api/dnd.setSnooze":
+		return "dnd.setSnooze " + req.PostForm.Get("num_minutes"), `{"ok": true}`, nil
+	case "/api/dnd.endSnooze":
+		return "dnd.endSnooze", `{"ok": false, "error": "snooze_not_active"}`, nil
+	default:
+		return "", "", errUnsupportedURL(req)
+	}
+}
+
+func newPresenceTestContext(mode string) (*IrcContext, *fakeConn, *fakeSlackAPI) {
+	ctx, conn, httpClient := newFakeSlackTestContext(routePresence)
+	ctx.User.Profile.StatusText, ctx.User.Profile.StatusEmoji = "In a meeting", ":calendar:"
+	ctx.AwayMode = mode
+	bob := slack.User{ID: "UBOB", Name: "bob", RealName: "Bob"}
+	bob.Profile.StatusText = "On vacation"
+	ctx.Users.Add(*ctx.User, bob, slack.User{ID: "UALICE", Name: "alice", RealName: "Alice"})
+	general := Channel{IsChannel: true}
+	general.ID, general.Name, general.Members = "CGENERAL", "general", []string{"UBOB", "UALICE"}
+	ctx.Channels.Add(general)
+	return ctx, conn, httpClient
+}
+
+func TestHandlePresenceChange(t *testing.T) {
+	ctx, conn, _ := newPresenceTestContext("")
+	handlePresenceChange(ctx, &slack.PresenceChangeEvent{Presence: "away", Users: []string{"UBOB"}})
+	// without away-notify, the presence is only recorded
+	assert.True(t, ctx.isAway("UBOB"))
+	assert.Empty(t, conn.buf.String())
+
+	ctx.caps = map[string]bool{"away-notify": true}
+	handlePresenceChange(ctx, &slack.PresenceChangeEvent{Presence: "away", Users: []string{"UBOB", "UALICE", "UME"}})
+	assert.Equal(t, ":alice!UALICE@localhost AWAY :Away\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	handlePresenceChange(ctx, &slack.PresenceChangeEvent{Presence: "active", User: "UBOB"})
+	assert.Equal(t, ":bob!UBOB@localhost AWAY\r\n", conn.buf.String())
+	assert.False(t, ctx.isAway("UBOB"))
+}
+
+func TestAddPresenceSubs(t *testing.T) {
+	ctx, _, _ := newPresenceTestContext("")
+	assert.Equal(t, []string{"UALICE", "UBOB"}, ctx.addPresenceSubs([]string{"UBOB", "UALICE"}))
+	// nothing to do for users already subscribed to
+	assert.Nil(t, ctx.addPresenceSubs([]string{"UALICE"}))
+	// the subscription request includes all the users
+	assert.Equal(t, []string{"UALICE", "UBOB", "UCAROL"}, ctx.addPresenceSubs([]string{"UCAROL", "UBOB"}))
+}
+
+func TestWhoAndRplAway(t *testing.T) {
+	ctx, conn, _ := newPresenceTestContext("")
+	ctx.setAway("UBOB", true)
+	IrcWhoHandler(ctx, "", "WHO", []string{"#general"}, "")
+	assert.Equal(t,
+		":localhost 352 me #general UBOB localhost localhost bob G :0 Bob\r\n"+
+			":localhost 352 me #general UALICE localhost localhost alice H :0 Alice\r\n"+
+			":localhost 315 me #general :End of WHO list\r\n",
+		conn.buf.String(),
+	)
+	conn.buf.Reset()
+
+	sendAway(ctx, ctx.Users.ByID("UBOB"))
+	sendAway(ctx, ctx.Users.ByID("UALICE"))
+	assert.Equal(t, ":localhost 301 me bob :On vacation\r\n", conn.buf.String())
+}
+
+func TestIrcAwayHandler(t *testing.T) {
+	ctx, conn, httpClient := newPresenceTestContext(AwayModePresence)
+	IrcAwayHandler(ctx, "", "AWAY", nil, "gone fishing")
+	assert.Equal(t, []string{"users.setPresence away"}, httpClient.calls)
+	assert.Equal(t, ":localhost 306 me :You have been marked as being away\r\n", conn.buf.String())
+	assert.True(t, ctx.isAway("UME"))
+	conn.buf.Reset()
+
+	IrcAwayHandler(ctx, "", "AWAY", nil, "")
+	assert.Equal(t, []string{"users.setPresence away", "users.setPresence auto"}, httpClient.calls)
+	assert.Equal(t, ":localhost 305 me :You are no longer marked as being away\r\n", conn.buf.String())
+	assert.False(t, ctx.isAway("UME"))
+}
+
+func TestIrcAwayHandlerStatus(t *testing.T) {
+	ctx, _, httpClient := newPresenceTestContext(AwayModeStatus)
+	IrcAwayHandler(ctx, "", "AWAY", nil, "gone fishing")
+	IrcAwayHandler(ctx, "", "AWAY", nil, "still fishing")
+	IrcAwayHandler(ctx, "", "AWAY", nil, "")
+	// the status before the first AWAY is restored
+	assert.Equal(t, []string{
+		"users.setPresence away",
+		"users.profile.get UME",
+		"users.profile.set gone fishing ",
+		"users.setPresence away",
+		"users.profile.set still fishing ",
+		"users.setPresence auto",
+		"users.profile.set Commuting :train:",
+	}, httpClient.calls)
+}
+
+func TestIrcAwayHandlerDND(t *testing.T) {
+	ctx, conn, httpClient := newPresenceTestContext(AwayModeDND)
+	IrcAwayHandler(ctx, "", "AWAY", []string{"brb"}, "")
+	IrcAwayHandler(ctx, "", "AWAY", nil, "")
+	assert.Equal(t, []string{
+		"users.setPresence away",
+		"dnd.setSnooze 1440",
+		"users.setPresence auto",
+		"dnd.endSnooze",
+	}, httpClient.calls)
+	// snooze_not_active is not an error
+	assert.NotContains(t, conn.buf.String(), " 400 ")
+}
@@ -0,0 +1,335 @@
+package ircslack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Slack API rate limit tiers, see https://api.slack.com/docs/rate-limits .
+const (
+	// TierSpecial is used by methods with their own limits, like
+	// chat.postMessage that allows roughly one message per second.
+	TierSpecial = iota
+	Tier1
+	Tier2
+	Tier3
+	Tier4
+)
+
+// DefaultSlackAPITimeout is the default timeout of a single request to the
+// Slack API.
+const DefaultSlackAPITimeout = 30 * time.Second
+
+// tierRequestsPerMinute is the number of requests per minute allowed by each
+// tier.
+var tierRequestsPerMinute = map[int]float64{
+	TierSpecial: 60,
+	Tier1:       1,
+	Tier2:       20,
+	Tier3:       50,
+	Tier4:       100,
+}
+
+// SlackMethodTiers maps the Slack API methods used by irc-slack to their rate
+// limit tier. Unknown methods are assumed to be Tier3.
+var SlackMethodTiers = map[string]int{
+	"chat.postMessage":             TierSpecial,
+	"chat.meMessage":               TierSpecial,
+	"conversations.create":         Tier2,
+	"conversations.history":        Tier3,
+	"conversations.info":           Tier3,
+	"conversations.invite":         Tier3,
+	"conversations.join":           Tier3,
+	"conversations.kick":           Tier3,
+	"conversations.leave":          Tier3,
+	"conversations.list":           Tier2,
+	"conversations.open":           Tier3,
+	"conversations.members":        Tier4,
+	"conversations.replies":        Tier3,
+	"conversations.setPurpose":     Tier2,
+	"conversations.setTopic":       Tier2,
+	"dnd.endSnooze":                Tier2,
+	"dnd.setSnooze":                Tier2,
+	"files.completeUploadExternal": Tier4,
+	"emoji.list":                   Tier2,
+	"usergroups.list":              Tier2,
+	"users.info":                   Tier4,
+	"users.list":                   Tier2,
+	"users.profile.get":            Tier4,
+	"users.profile.set":            Tier3,
+	"users.setPresence":            Tier2,
+}
+
+// SlackMethodTimeouts overrides the timeout of every attempt for the Slack API
+// methods that can take longer than the RateLimiter's Timeout. Zero means no
+// timeout other than the one of the context passed to Do.
+var SlackMethodTimeouts = map[string]time.Duration{
+	// uploads take as long as the file size requires
+	"files.completeUploadExternal": 0,
+}
+
+// Priority is the priority of a request to the Slack API. When several
+// requests to the same method are waiting, the ones with higher priority are
+// sent first.
+type Priority int
+
+// Request priorities.
+const (
+	// PriorityLow is for background requests, like fetching users and
+	// channels.
+	PriorityLow Priority = iota
+	// PriorityHigh is for user-facing requests, like sending messages.
+	PriorityHigh
+	numPriorities
+)
+
+// RateLimitStats holds the metrics of the requests to a Slack API method.
+type RateLimitStats struct {
+	// Calls is the number of requests sent to Slack, including retries
+	Calls uint64
+	// RateLimited is the number of requests that Slack rejected because of
+	// rate limiting
+	RateLimited uint64
+	// Failures is the number of requests that failed for other reasons, or
+	// that exceeded the maximum number of attempts
+	Failures uint64
+	// Waited is the total time spent waiting for the rate limiter
+	Waited time.Duration
+	// Waiting is the number of requests currently waiting for the rate
+	// limiter
+	Waiting int
+}
+
+// methodLimiter is a token bucket for a single Slack API method.
+type methodLimiter struct {
+	rate        float64 // tokens per second
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	waiting     [numPriorities]int
+	stats       RateLimitStats
+}
+
+// RateLimiter schedules the requests to the Slack API, honouring the rate
+// limit tier of every method and the Retry-After delay that Slack returns when
+// a request is rate limited. Rate limits are applied per method, so a single
+// RateLimiter should be shared by all the requests made with the same token.
+type RateLimiter struct {
+	// MaxAttempts is the maximum number of attempts for a rate-limited
+	// request
+	MaxAttempts int
+	// Timeout is the timeout of every attempt, unless the method has its own
+	// in SlackMethodTimeouts. If zero, there is no timeout other than the
+	// one of the context passed to Do
+	Timeout time.Duration
+	mu      sync.Mutex
+	methods map[string]*methodLimiter
+}
+
+// NewRateLimiter creates a new RateLimiter object.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		MaxAttempts: MaxSlackAPIAttempts,
+		Timeout:     DefaultSlackAPITimeout,
+		methods:     make(map[string]*methodLimiter),
+	}
+}
+
+// limiter returns the token bucket of a method, creating it if needed. The
+// caller must hold the lock.
+func (r *RateLimiter) limiter(method string) *methodLimiter {
+	if ml, ok := r.methods[method]; ok {
+		return ml
+	}
+	tier, ok := SlackMethodTiers[method]
+	if !ok {
+		tier = Tier3
+	}
+	perMinute := tierRequestsPerMinute[tier]
+	ml := &methodLimiter{
+		rate:   perMinute / 60,
+		burst:  perMinute,
+		tokens: perMinute,
+		last:   time.Now(),
+	}
+	r.methods[method] = ml
+	return ml
+}
+
+// higherWaiting returns true if requests with a higher priority than prio are
+// waiting.
+func (ml *methodLimiter) higherWaiting(prio Priority) bool {
+	for p := prio + 1; p < numPriorities; p++ {
+		if ml.waiting[p] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until a request to the given method can be sent, or the context
+// is done.
+func (r *RateLimiter) wait(ctx context.Context, method string, prio Priority) error {
+	start := time.Now()
+	r.mu.Lock()
+	ml := r.limiter(method)
+	ml.waiting[prio]++
+	defer func() {
+		ml.waiting[prio]--
+		ml.stats.Waited += time.Since(start)
+		r.mu.Unlock()
+	}()
+	for {
+		now := time.Now()
+		ml.tokens += now.Sub(ml.last).Seconds() * ml.rate
+		if ml.tokens > ml.burst {
+			ml.tokens = ml.burst
+		}
+		ml.last = now
+		var delay time.Duration
+		switch {
+		case now.Before(ml.pausedUntil):
+			delay = ml.pausedUntil.Sub(now)
+		case ml.higherWaiting(prio):
+			// let the requests with higher priority go first
+			delay = time.Duration(float64(time.Second) / ml.rate)
+		case ml.tokens >= 1:
+			ml.tokens--
+			return nil
+		default:
+			delay = time.Duration((1 - ml.tokens) / ml.rate * float64(time.Second))
+		}
+		r.mu.Unlock()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.mu.Lock()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		r.mu.Lock()
+	}
+}
+
+// pause stops all the requests to a method for the given duration, after Slack
+// rate limited one of them.
+func (r *RateLimiter) pause(method string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ml := r.limiter(method)
+	if until := time.Now().Add(d); until.After(ml.pausedUntil) {
+		ml.pausedUntil = until
+	}
+	ml.tokens = 0
+}
+
+// Do calls a Slack API method when allowed by the rate limits. If the call is
+// rate limited, it is retried after the delay requested by Slack, up to
+// MaxAttempts times. The method name, e.g. "users.info", is used to determine
+// the rate limit tier. The context passed to the call is cancelled when ctx is
+// done or when the attempt times out. If r is nil, the call is made directly,
+// without rate limiting.
+func (r *RateLimiter) Do(ctx context.Context, method string, prio Priority, call func(ctx context.Context) error) error {
+	if r == nil {
+		return call(ctx)
+	}
+	for attempt := 1; ; attempt++ {
+		if err := r.wait(ctx, method, prio); err != nil {
+			return err
+		}
+		err := r.call(ctx, method, call)
+		r.mu.Lock()
+		ml := r.limiter(method)
+		ml.stats.Calls++
+		var rlErr *slack.RateLimitedError
+		isRateLimited := errors.As(err, &rlErr)
+		if isRateLimited {
+			ml.stats.RateLimited++
+		}
+		if err != nil && (!isRateLimited || attempt >= r.MaxAttempts) {
+			ml.stats.Failures++
+		}
+		r.mu.Unlock()
+		if !isRateLimited {
+			return err
+		}
+		if attempt >= r.MaxAttempts {
+			return fmt.Errorf("%s: exceeded the maximum number of attempts (%d) with the Slack API: %w", method, r.MaxAttempts, err)
+		}
+		log.Warningf("Hit Slack API rate limiter on %s, attempt %d of %d. Waiting %v", method, attempt, r.MaxAttempts, rlErr.RetryAfter)
+		r.pause(method, rlErr.RetryAfter)
+	}
+}
+
+// call makes a single attempt, with the timeout of the method.
+func (r *RateLimiter) call(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	timeout := r.Timeout
+	if t, ok := SlackMethodTimeouts[method]; ok {
+		timeout = t
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return call(ctx)
+}
+
+// Stats returns the metrics of every Slack API method called so far. If r is
+// nil, there are none.
+func (r *RateLimiter) Stats() map[string]RateLimitStats {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string]RateLimitStats, len(r.methods))
+	for method, ml := range r.methods {
+		s := ml.stats
+		for _, n := range ml.waiting {
+			s.Waiting += n
+		}
+		stats[method] = s
+	}
+	return stats
+}
+
+// String returns a human-readable summary of the metrics, one method per
+// line.
+func (r *RateLimiter) String() string {
+	stats := r.Stats()
+	methods := make([]string, 0, len(stats))
+	for method := range stats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	lines := make([]string, 0, len(methods))
+	for _, method := range methods {
+		s := stats[method]
+		lines = append(lines, fmt.Sprintf("%s: calls=%d rate_limited=%d failures=%d waited=%v waiting=%d", method, s.Calls, s.RateLimited, s.Failures, s.Waited, s.Waiting))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// IrcRateLimitsHandler is called when a RATELIMITS command is sent. It replies
+// with the metrics of the Slack API methods called by the client, one NOTICE
+// per method.
+func IrcRateLimitsHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	summary := ctx.RateLimiter.String()
+	if summary == "" {
+		ctx.SendNotice("No Slack API calls")
+		return
+	}
+	for _, line := range strings.Split(summary, "\n") {
+		ctx.SendNotice("%s", line)
+	}
+}
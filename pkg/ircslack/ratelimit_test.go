@@ -0,0 +1,216 @@
+package ircslack
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRateLimitedSlackServer returns a Slack API stand-in that rate limits the
+// first `limited` requests to users.info with a Retry-After of zero seconds.
+func newRateLimitedSlackServer(t *testing.T, limited int32) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/users.info":
+			if atomic.AddInt32(&calls, 1) <= limited {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"ok": true, "users": [{"id": "UABCD", "name": "insomniac"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+// speedUp makes the rate limiter of a method fast enough for tests, since a
+// rate limited request empties the token bucket.
+func speedUp(r *RateLimiter, method string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limiter(method).rate = 1000
+}
+
+func TestRateLimiterRetry(t *testing.T) {
+	server, calls := newRateLimitedSlackServer(t, 2)
+	client := slack.New("test-token", slack.OptionAPIURL(server.URL+"/api/"))
+	users := NewUsers(0)
+	speedUp(users.RateLimiter, "users.info")
+	fetched, _, err := users.FetchByIDs(context.Background(), client, false, "UABCD")
+	require.NoError(t, err)
+	require.Len(t, fetched, 1)
+	assert.Equal(t, "insomniac", fetched[0].Name)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+
+	stats := users.RateLimiter.Stats()["users.info"]
+	assert.Equal(t, uint64(3), stats.Calls)
+	assert.Equal(t, uint64(2), stats.RateLimited)
+	assert.Equal(t, uint64(0), stats.Failures)
+}
+
+func TestRateLimiterMaxAttempts(t *testing.T) {
+	server, calls := newRateLimitedSlackServer(t, 100)
+	client := slack.New("test-token", slack.OptionAPIURL(server.URL+"/api/"))
+	users := NewUsers(0)
+	speedUp(users.RateLimiter, "users.info")
+	_, _, err := users.FetchByIDs(context.Background(), client, false, "UABCD")
+	require.Error(t, err)
+	var rlErr *slack.RateLimitedError
+	assert.True(t, errors.As(err, &rlErr))
+	// the attempts are capped
+	assert.Equal(t, int32(MaxSlackAPIAttempts), atomic.LoadInt32(calls))
+	stats := users.RateLimiter.Stats()["users.info"]
+	assert.Equal(t, uint64(MaxSlackAPIAttempts), stats.RateLimited)
+	assert.Equal(t, uint64(1), stats.Failures)
+}
+
+func TestRateLimiterOtherErrors(t *testing.T) {
+	r := NewRateLimiter()
+	calls := 0
+	err := r.Do(context.Background(), "users.info", PriorityLow, func(context.Context) error {
+		calls++
+		return errors.New("user_not_found")
+	})
+	assert.EqualError(t, err, "user_not_found")
+	// only rate limited calls are retried
+	assert.Equal(t, 1, calls)
+}
+
+func TestRateLimiterNil(t *testing.T) {
+	var r *RateLimiter
+	called := false
+	require.NoError(t, r.Do(context.Background(), "users.info", PriorityLow, func(context.Context) error {
+		called = true
+		return nil
+	}))
+	assert.True(t, called)
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	r := NewRateLimiter()
+	r.pause("users.info", time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := r.Do(ctx, "users.info", PriorityLow, func(context.Context) error { return nil })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// other methods are not affected
+	require.NoError(t, r.Do(context.Background(), "users.list", PriorityLow, func(context.Context) error { return nil }))
+}
+
+func TestRateLimiterTimeout(t *testing.T) {
+	r := NewRateLimiter()
+	r.Timeout = 10 * time.Millisecond
+	err := r.Do(context.Background(), "users.info", PriorityLow, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRateLimiterMethodTimeout(t *testing.T) {
+	SlackMethodTimeouts["test.method"] = 0
+	defer delete(SlackMethodTimeouts, "test.method")
+	r := NewRateLimiter()
+	r.Timeout = 10 * time.Millisecond
+	err := r.Do(context.Background(), "test.method", PriorityLow, func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	})
+	assert.NoError(t, err)
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	// a fast tier with no burst, so that requests are queued
+	SlackMethodTiers["test.method"] = Tier4
+	defer delete(SlackMethodTiers, "test.method")
+	r := NewRateLimiter()
+	r.mu.Lock()
+	ml := r.limiter("test.method")
+	ml.rate, ml.burst, ml.tokens = 50, 1, 0
+	r.mu.Unlock()
+
+	var (
+		mu    sync.Mutex
+		order []Priority
+		wg    sync.WaitGroup
+	)
+	start := func(prio Priority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = r.Do(context.Background(), "test.method", prio, func(context.Context) error {
+				mu.Lock()
+				order = append(order, prio)
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		start(PriorityLow)
+	}
+	// make sure the low priority requests are waiting
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		start(PriorityHigh)
+	}
+	wg.Wait()
+	require.Len(t, order, 6)
+	// all the high priority requests that were queued before a token was
+	// available go first
+	assert.Equal(t, []Priority{PriorityHigh, PriorityHigh, PriorityHigh}, order[:3])
+}
+
+func TestIrcRateLimitsHandler(t *testing.T) {
+	ctx, conn, _ := newFakeSlackTestContext(nil)
+	ctx.RateLimiter = NewRateLimiter()
+	IrcRateLimitsHandler(ctx, "", "RATELIMITS", nil, "")
+	assert.Equal(t, ":localhost NOTICE me :No Slack API calls\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	require.NoError(t, ctx.RateLimiter.Do(context.Background(), "users.info", PriorityLow, func(context.Context) error {
+		return nil
+	}))
+	require.Error(t, ctx.RateLimiter.Do(context.Background(), "chat.postMessage", PriorityHigh, func(context.Context) error {
+		return errors.New("channel_not_found")
+	}))
+	// a request that is waiting for the rate limiter is counted
+	ctx.RateLimiter.pause("conversations.list", time.Hour)
+	waitCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ctx.RateLimiter.Do(waitCtx, "conversations.list", PriorityLow, func(context.Context) error {
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		return ctx.RateLimiter.Stats()["conversations.list"].Waiting == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	IrcRateLimitsHandler(ctx, "", "RATELIMITS", nil, "")
+	lines := strings.Split(strings.TrimSuffix(conn.buf.String(), "\r\n"), "\r\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], ":localhost NOTICE me :chat.postMessage: calls=1 rate_limited=0 failures=1 "), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], ":localhost NOTICE me :conversations.list: calls=0 "), lines[1])
+	assert.True(t, strings.HasSuffix(lines[1], " waiting=1"), lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], ":localhost NOTICE me :users.info: calls=1 rate_limited=0 failures=0 "), lines[2])
+}
@@ -2,11 +2,16 @@ package ircslack
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/slack-go/slack"
 )
@@ -19,43 +24,199 @@ type Server struct {
 	SlackAPIKey          string
 	SlackDebug           bool
 	ChunkSize            int
+	BatchWindow          time.Duration
+	BatchMaxSize         int
+	SnippetLines         int
+	FormatPaste          bool
+	UploadDir            string
+	UploadURLs           bool
 	FileDownloadLocation string
+	DownloadWorkers      int
+	MaxDownloadSize      int64
+	DownloadQuota        int64
 	FileProxyPrefix      string
+	FileServer           *FileServer
 	Pagination           int
+	TranslateEmoji       bool
+	Formatting           string
+	FilePreviews         FilePreviews
+	ListArchived         bool
+	CreateChannels       bool
+	TopicMode            string
+	AwayMode             string
+	NickPolicy           string
+	CacheDir             string
 	TLSConfig            *tls.Config
+	// slackAPIURL overrides the URL of the Slack API, for testing
+	slackAPIURL string
+
+	// mu protects the fields below
+	mu           sync.Mutex
+	shuttingDown bool
+	conns        map[net.Conn]struct{}
+	downloads    *DownloadManager
+	wg           sync.WaitGroup
 }
 
-// Start runs the IRC server
-func (s Server) Start() error {
-	var err error
+// ErrServerClosed is returned by Start after Shutdown is called.
+var ErrServerClosed = errors.New("irc-slack: Server closed")
+
+// Start runs the IRC server. It always returns a non-nil error, and
+// ErrServerClosed after Shutdown.
+func (s *Server) Start() error {
+	var (
+		ln  net.Listener
+		err error
+	)
 	if s.TLSConfig != nil {
-		s.Listener, err = tls.Listen("tcp", s.LocalAddr.String(), s.TLSConfig)
+		ln, err = tls.Listen("tcp", s.LocalAddr.String(), s.TLSConfig)
 	} else {
-		s.Listener, err = net.Listen("tcp", s.LocalAddr.String())
+		ln, err = net.Listen("tcp", s.LocalAddr.String())
 	}
 	if err != nil {
 		return err
 	}
-	defer s.Listener.Close()
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.Listener = ln
+	s.mu.Unlock()
+	defer ln.Close()
 	log.Infof("Listening on %v", s.LocalAddr)
 	for {
-		conn, err := s.Listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
+			s.mu.Lock()
+			shuttingDown := s.shuttingDown
+			s.mu.Unlock()
+			if shuttingDown {
+				return ErrServerClosed
+			}
 			return fmt.Errorf("Error accepting: %v", err)
 		}
 		go s.HandleRequest(conn)
 	}
 }
 
+// Shutdown gracefully shuts down the server: it stops accepting new
+// connections, then notifies every connected client, posts their pending
+// messages to Slack, and closes their Slack and IRC connections. If ctx is done
+// before all the clients are disconnected, Shutdown returns ctx's error, and
+// the remaining connections are closed abruptly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	log.Infof("Shutting down, disconnecting %d clients", len(conns))
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		userContextsMu.Lock()
+		ic := UserContexts[conn.RemoteAddr()]
+		userContextsMu.Unlock()
+		if ic == nil {
+			// the client did not send any message yet
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ic.Shutdown(ctx, "Server shutting down"); err != nil {
+				log.Warningf("Failed to shut down client %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		if downloads := s.downloadManager(); downloads != nil {
+			downloads.Close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadManager returns the download manager shared by all the clients, or
+// nil if files are not downloaded.
+func (s *Server) downloadManager() *DownloadManager {
+	if s.FileDownloadLocation == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downloads == nil {
+		s.downloads = &DownloadManager{
+			Dir:         s.FileDownloadLocation,
+			Workers:     s.DownloadWorkers,
+			MaxFileSize: s.MaxDownloadSize,
+			Quota:       s.DownloadQuota,
+		}
+	}
+	return s.downloads
+}
+
+// addConn adds a connection to the ones that Shutdown closes. It returns false
+// if the server is shutting down and the connection should be rejected.
+func (s *Server) addConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// removeConn removes a connection added with addConn.
+func (s *Server) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
 // HandleRequest handle IRC client connections
-func (s Server) HandleRequest(conn net.Conn) {
+func (s *Server) HandleRequest(conn net.Conn) {
 	defer conn.Close()
+	if !s.addConn(conn) {
+		return
+	}
+	defer s.removeConn(conn)
 	reader := bufio.NewReader(conn)
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			// clean up this client's state
+			userContextsMu.Lock()
+			ctx, ok := UserContexts[conn.RemoteAddr()]
 			delete(UserContexts, conn.RemoteAddr())
+			userContextsMu.Unlock()
+			if ok {
+				ctx.Close()
+			}
 			if err == io.EOF {
 				log.Warningf("Client %v disconnected", conn.RemoteAddr())
 				break
@@ -79,14 +240,18 @@ func (s *Server) HandleMsg(conn net.Conn, msg string) {
 		return
 	}
 	var (
+		tags         map[string]string
 		prefix, data string
 	)
-	if msg[0] == ':' {
-		prefix = strings.SplitN(msg[1:], " ", 1)[0]
-		data = msg[len(prefix)+1:]
-	} else {
-		prefix = ""
-		data = msg
+	data = msg
+	if data[0] == '@' {
+		// IRCv3 message tags
+		rawTags, rest, _ := strings.Cut(data[1:], " ")
+		tags = parseTags(rawTags)
+		data = rest
+	}
+	if strings.HasPrefix(data, ":") {
+		prefix, data, _ = strings.Cut(data[1:], " ")
 	}
 	if !strings.HasSuffix(data, "\r\n") {
 		log.Warning("Invalid data: not terminated with <CR><LF>")
@@ -105,11 +270,19 @@ func (s *Server) HandleMsg(conn net.Conn, msg string) {
 			break
 		}
 	}
+	if !utf8.ValidString(data) {
+		// as advertised with UTF8ONLY in RPL_ISUPPORT
+		if _, err := conn.Write([]byte(fmt.Sprintf(":%s FAIL %s INVALID_UTF8 :Message rejected, your IRC software MUST use UTF-8 encoding on this network\r\n", s.Name, cmd))); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
 	handler, ok := IrcCommandHandlers[cmd]
 	if !ok {
 		log.Warningf("No handler found for %v", cmd)
 		return
 	}
+	userContextsMu.Lock()
 	ctx, ok := UserContexts[conn.RemoteAddr()]
 	if !ok || ctx == nil {
 		ctx = &IrcContext{
@@ -118,18 +291,57 @@ func (s *Server) HandleMsg(conn net.Conn, msg string) {
 			SlackAPIKey:       s.SlackAPIKey,
 			SlackDebug:        s.SlackDebug,
 			ChunkSize:         s.ChunkSize,
+			BatchWindow:       s.BatchWindow,
+			BatchMaxSize:      s.BatchMaxSize,
+			SnippetLines:      s.SnippetLines,
+			FormatPaste:       s.FormatPaste,
+			UploadDir:         s.UploadDir,
+			UploadURLs:        s.UploadURLs,
+			Formatting:        s.Formatting,
+			FilePreviews:      s.FilePreviews,
+			ListArchived:      s.ListArchived,
+			CreateChannels:    s.CreateChannels,
+			TopicMode:         s.TopicMode,
+			AwayMode:          s.AwayMode,
+			CacheDir:          s.CacheDir,
+			slackAPIURL:       s.slackAPIURL,
 			postMessage:       make(chan SlackPostMessage),
+			drain:             make(chan struct{}),
+			drained:           make(chan struct{}),
 			conversationCache: make(map[string]*slack.Channel),
 			FileHandler: &FileHandler{
-				SlackAPIKey:          s.SlackAPIKey,
-				FileDownloadLocation: s.FileDownloadLocation,
-				ProxyPrefix:          s.FileProxyPrefix,
+				SlackAPIKey: s.SlackAPIKey,
+				Downloads:   s.downloadManager(),
+				ProxyPrefix: s.FileProxyPrefix,
+				FileServer:  s.FileServer,
 			},
-			Users:    NewUsers(s.Pagination),
-			Channels: NewChannels(s.Pagination),
+			Users:       NewUsers(s.Pagination),
+			UserGroups:  NewUserGroups(),
+			Channels:    NewChannels(s.Pagination),
+			RateLimiter: NewRateLimiter(),
+		}
+		// Slack rate limits are per method and per token, so all the
+		// requests of this client share the same rate limiter
+		ctx.Users.RateLimiter = ctx.RateLimiter
+		ctx.Channels.RateLimiter = ctx.RateLimiter
+		ctx.UserGroups.RateLimiter = ctx.RateLimiter
+		if s.NickPolicy != "" {
+			ctx.Users.SetNickPolicy(s.NickPolicy)
 		}
-		go ctx.Start()
+		// emoji can be enabled by the client with SET even if they are
+		// disabled by default
+		ctx.Emoji = NewEmoji()
+		ctx.Emoji.RateLimiter = ctx.RateLimiter
+		ctx.TranslateEmoji = s.TranslateEmoji
+		ctx.baseCtx, ctx.cancel = context.WithCancel(context.Background())
+		ctx.goBackground(ctx.Start)
 		UserContexts[conn.RemoteAddr()] = ctx
 	}
+	userContextsMu.Unlock()
+	if ref, ok := tags["batch"]; ok && ctx.addToBatch(ref, cmd, tags, args, trailing) {
+		// the message is part of a multiline batch, and it will be handled
+		// when the batch is closed
+		return
+	}
 	handler(ctx, prefix, cmd, args, trailing)
 }
@@ -0,0 +1,283 @@
+package ircslack
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeSlack returns a fake Slack API server that lets clients log in and
+// join #general, and that shares a file with each client over RTM. The file
+// downloads block until they are aborted, and are reported on started and
+// aborted.
+func newFakeSlack(t *testing.T, started, aborted chan<- string) *httptest.Server {
+	var (
+		api   *httptest.Server
+		files int32
+	)
+	reply := func(w http.ResponseWriter, data string) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(data))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rtm.connect", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, fmt.Sprintf(`{"ok": true, "url": "ws%s/ws", "self": {"id": "UME", "name": "me"}, "team": {"id": "T1", "name": "Acme", "domain": "acme"}}`, strings.TrimPrefix(api.URL, "http")))
+	})
+	mux.HandleFunc("/api/users.info", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("users") != "" {
+			reply(w, `{"ok": true, "users": [{"id": "UBOB", "name": "bob"}]}`)
+			return
+		}
+		reply(w, `{"ok": true, "user": {"id": "UME", "name": "me", "real_name": "Me"}}`)
+	})
+	mux.HandleFunc("/api/conversations.list", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, `{"ok": true, "channels": [{"id": "CGENERAL", "name": "general", "is_channel": true, "is_member": true}]}`)
+	})
+	mux.HandleFunc("/api/conversations.members", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, `{"ok": true, "members": ["UME", "UBOB"]}`)
+	})
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, `{"ok": false, "error": "unknown_method"}`)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		// the RTM client sets the origin to https://api.slack.com
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Cannot upgrade to websocket: %v", err)
+			return
+		}
+		defer conn.Close()
+		id := fmt.Sprintf("F%d", atomic.AddInt32(&files, 1))
+		if err := conn.WriteJSON(map[string]interface{}{
+			"type":    "message",
+			"channel": "CGENERAL",
+			"user":    "UBOB",
+			"text":    "have a look",
+			"ts":      "1700000000.000100",
+			"files":   []map[string]interface{}{{"id": id, "name": "report.pdf", "url_private": api.URL + "/files/" + id, "size": 1024}},
+		}); err != nil {
+			t.Errorf("Cannot send RTM message: %v", err)
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/files/")
+		started <- id
+		<-r.Context().Done()
+		aborted <- id
+	})
+	api = httptest.NewServer(mux)
+	return api
+}
+
+func TestServerClientsDoNotLeak(t *testing.T) {
+	const clients = 10
+	started := make(chan string, clients)
+	aborted := make(chan string, clients)
+	api := newFakeSlack(t, started, aborted)
+	defer api.Close()
+	// do not block on the downloads that were not aborted
+	defer api.CloseClientConnections()
+	baseline := runtime.NumGoroutine()
+
+	s := &Server{
+		Name:                 "localhost",
+		LocalAddr:            &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		FileDownloadLocation: t.TempDir(),
+		slackAPIURL:          api.URL + "/api/",
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start()
+	}()
+	var addr string
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.Listener == nil {
+			return false
+		}
+		addr = s.Listener.Addr().String()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < clients; i++ {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("PASS xoxp-test\r\nNICK me\r\nUSER me 0 * :Me\r\n"))
+		require.NoError(t, err)
+		// wait until the client joined #general, and the download of the
+		// shared file started
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			if strings.HasPrefix(line, ":localhost 366 me #general ") {
+				break
+			}
+		}
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the shared file was not downloaded")
+		}
+		require.NoError(t, conn.Close())
+	}
+
+	// the downloads are aborted when the clients disconnect
+	for i := 0; i < clients; i++ {
+		select {
+		case <-aborted:
+		case <-time.After(10 * time.Second):
+			t.Fatal("download not aborted after the client disconnected")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.True(t, errors.Is(<-errCh, ErrServerClosed))
+
+	// the Slack calls, the RTM connections and the goroutines of the clients
+	// are all gone
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= baseline, "goroutines leaked after the clients disconnected: %d, want at most %d", runtime.NumGoroutine(), baseline)
+	userContextsMu.Lock()
+	defer userContextsMu.Unlock()
+	assert.Empty(t, UserContexts)
+}
+
+func TestIrcContextClose(t *testing.T) {
+	s := Server{Name: "localhost"}
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = bufio.NewReader(client).ReadString('\n')
+	}()
+	s.HandleMsg(server, "CAP LS 302\r\n")
+	userContextsMu.Lock()
+	ctx := UserContexts[server.RemoteAddr()]
+	delete(UserContexts, server.RemoteAddr())
+	userContextsMu.Unlock()
+	require.NotNil(t, ctx)
+	require.NoError(t, ctx.Context().Err())
+
+	ctx.Close()
+	assert.Error(t, ctx.Context().Err())
+	// closing twice is fine
+	ctx.Close()
+	// messages posted after the client disconnected are dropped instead of
+	// blocking forever
+	done := make(chan struct{})
+	go func() {
+		ctx.PostTextMessage("#general", "hello", "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PostTextMessage blocked after Close")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	posted := make(chan string, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat.postMessage" {
+			http.NotFound(w, r)
+			return
+		}
+		posted <- r.FormValue("channel") + " " + r.FormValue("text")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok": true, "channel": "C1234", "ts": "1234.5678"}`))
+	}))
+	defer api.Close()
+
+	s := &Server{Name: "localhost", LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start()
+	}()
+	var addr string
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.Listener == nil {
+			return false
+		}
+		addr = s.Listener.Addr().String()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, err = conn.Write([]byte("CAP LS 302\r\n"))
+	require.NoError(t, err)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	// queue a message that has not been posted to Slack yet
+	var ic *IrcContext
+	userContextsMu.Lock()
+	for addr, ctx := range UserContexts {
+		if addr.String() == conn.LocalAddr().String() {
+			ic = ctx
+		}
+	}
+	userContextsMu.Unlock()
+	require.NotNil(t, ic)
+	ic.SlackClient = slack.New("test-token", slack.OptionAPIURL(api.URL+"/api/"))
+	ic.PostTextMessage("C1234", "hello", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.True(t, errors.Is(<-errCh, ErrServerClosed))
+	select {
+	case msg := <-posted:
+		assert.Equal(t, "C1234 hello", msg)
+	default:
+		t.Fatal("pending message was not posted to Slack")
+	}
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ":localhost NOTICE <unknown> :Server shutting down\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, line, "ERROR :Closing Link: ")
+	_, err = reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+
+	// new connections are refused
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
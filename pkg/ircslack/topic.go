@@ -0,0 +1,237 @@
+package ircslack
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Topic modes, i.e. which attribute of Slack channels is shown and set as
+// the IRC topic.
+const (
+	// TopicModeTopic maps the IRC topic to the Slack channel topic.
+	TopicModeTopic = "topic"
+	// TopicModePurpose maps the IRC topic to the Slack channel purpose, or
+	// description.
+	TopicModePurpose = "purpose"
+	// TopicModeBoth shows the Slack topic and purpose together, separated
+	// by topicSeparator. Setting the topic sets the Slack topic.
+	TopicModeBoth = "both"
+)
+
+// TopicModes returns a list of supported topic modes.
+func TopicModes() []string {
+	return []string{TopicModeTopic, TopicModePurpose, TopicModeBoth}
+}
+
+// topicSeparator separates the Slack topic and purpose with TopicModeBoth.
+const topicSeparator = " | "
+
+// channelTopic is the IRC topic of a channel, with who set it and when.
+type channelTopic struct {
+	Text string
+	// Setter is the Slack user ID of who set the topic
+	Setter string
+	SetAt  slack.JSONTime
+}
+
+// topicMode returns the topic mode of the client, defaulting to
+// TopicModePurpose.
+func (ic *IrcContext) topicMode() string {
+	if ic.TopicMode == "" {
+		return TopicModePurpose
+	}
+	return ic.TopicMode
+}
+
+// topicOf returns the IRC topic of a channel according to the topic mode.
+// With TopicModeBoth, the setter and time are the ones of the most recent
+// change.
+func topicOf(ch *Channel, mode string) channelTopic {
+	topic := channelTopic{Text: ch.Topic.Value, Setter: ch.Topic.Creator, SetAt: ch.Topic.LastSet}
+	purpose := channelTopic{Text: ch.Purpose.Value, Setter: ch.Purpose.Creator, SetAt: ch.Purpose.LastSet}
+	switch mode {
+	case TopicModeTopic:
+		return topic
+	case TopicModeBoth:
+		if topic.Text == "" {
+			return purpose
+		}
+		if purpose.Text == "" {
+			return topic
+		}
+		both := topic
+		if purpose.SetAt > topic.SetAt {
+			both = purpose
+		}
+		both.Text = topic.Text + topicSeparator + purpose.Text
+		return both
+	default:
+		return purpose
+	}
+}
+
+// topicText returns the topic text as sent to IRC, on a single line.
+func topicText(ctx *IrcContext, text string) string {
+	return ctx.ExpandText(strings.ReplaceAll(text, "\n", " "))
+}
+
+// sendTopic sends the topic of a channel to the client, i.e. RPL_TOPIC and
+// RPL_TOPICWHOTIME, or RPL_NOTOPIC if there is none and noTopic is set.
+func sendTopic(ctx *IrcContext, channame string, topic channelTopic, noTopic bool) {
+	if topic.Text == "" {
+		if noTopic {
+			// RPL_NOTOPIC
+			if err := SendIrcNumeric(ctx, 331, fmt.Sprintf("%s %s", ctx.Nick(), channame), "No topic is set"); err != nil {
+				log.Warningf("Failed to send IRC message: %v", err)
+			}
+		}
+		return
+	}
+	// RPL_TOPIC
+	if err := SendIrcNumeric(ctx, 332, fmt.Sprintf("%s %s", ctx.Nick(), channame), topicText(ctx, topic.Text)); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+	if topic.Setter == "" || topic.SetAt == 0 {
+		return
+	}
+	// RPL_TOPICWHOTIME
+	if err := SendIrcNumeric(ctx, 333, fmt.Sprintf("%s %s %s", ctx.Nick(), channame, userNick(ctx, topic.Setter)), fmt.Sprintf("%d", topic.SetAt)); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// stripPurpose removes the purpose from a topic set by the client with
+// TopicModeBoth. Clients usually edit the topic as it was shown, i.e. with
+// the purpose appended, which would otherwise end up in the Slack topic.
+func stripPurpose(ctx *IrcContext, ch *Channel, text string) string {
+	if ch.Purpose.Value == "" {
+		return text
+	}
+	for _, purpose := range []string{topicText(ctx, ch.Purpose.Value), ch.Purpose.Value} {
+		if topic, ok := strings.CutSuffix(text, topicSeparator+purpose); ok {
+			return topic
+		}
+	}
+	return text
+}
+
+// userNick returns the IRC nickname of a user ID, or the ID itself if the
+// user is unknown.
+func userNick(ctx *IrcContext, userID string) string {
+	if ctx.Users != nil {
+		if nick := ctx.Users.NickByID(userID); nick != "" {
+			return nick
+		}
+	}
+	return userID
+}
+
+// IrcTopicHandler is called when a TOPIC command is sent. The syntax is
+// `TOPIC <channel> [:topic]`. Without a topic, the current topic is sent,
+// otherwise the Slack topic or purpose is set according to the topic mode.
+// With TopicModeBoth, the purpose shown after the topic is not part of it.
+func IrcTopicHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if len(args) < 1 || len(args) > 2 {
+		// ERR_NEEDMOREPARAMS
+		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "TOPIC :Not enough parameters"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	channame := args[0]
+	text := trailing
+	if len(args) == 2 {
+		text = args[1]
+	}
+	ch := ctx.Channels.ByName(channame)
+	if ch == nil || !HasChannelPrefix(channame) {
+		sendNoSuchChannel(ctx, channame)
+		return
+	}
+	if text == "" {
+		// the parser does not distinguish an empty topic from a missing one,
+		// so topics cannot be cleared
+		sendTopic(ctx, channame, topicOf(ch, ctx.topicMode()), true)
+		return
+	}
+	if ctx.topicMode() == TopicModeBoth {
+		text = stripPurpose(ctx, ch, text)
+	}
+	setPurpose := ctx.topicMode() == TopicModePurpose
+	method := "conversations.setTopic"
+	if setPurpose {
+		method = "conversations.setPurpose"
+	}
+	err := ctx.RateLimiter.Do(ctx.Context(), method, PriorityHigh, func(c context.Context) error {
+		var err error
+		if setPurpose {
+			_, err = ctx.SlackClient.SetPurposeOfConversationContext(c, ch.ID, text)
+		} else {
+			_, err = ctx.SlackClient.SetTopicOfConversationContext(c, ch.ID, text)
+		}
+		return err
+	})
+	if err != nil {
+		log.Warningf("Cannot set topic of %s: %v", channame, err)
+		sendSlackError(ctx, err, channame, "")
+		return
+	}
+	// update the cache right away, so that the Slack event for this change
+	// is not sent to the client again
+	updated := updateTopic(ctx, ch.ID, !setPurpose, text, ctx.UserID(), slack.JSONTime(time.Now().Unix()))
+	if _, err := ctx.Conn.Write([]byte(fmt.Sprintf(":%s TOPIC %s :%s\r\n", ctx.Mask(), channame, topicText(ctx, topicOf(updated, ctx.topicMode()).Text)))); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
+
+// updateTopic updates the Slack topic, or the purpose if isTopic is false, of
+// a cached channel, and returns the updated channel.
+func updateTopic(ctx *IrcContext, channelID string, isTopic bool, text, setter string, setAt slack.JSONTime) *Channel {
+	ch := ctx.Channels.ByID(channelID)
+	if ch == nil {
+		return nil
+	}
+	if isTopic {
+		ch.Topic = slack.Topic{Value: text, Creator: setter, LastSet: setAt}
+	} else {
+		ch.Purpose = slack.Purpose{Value: text, Creator: setter, LastSet: setAt}
+	}
+	ctx.Channels.Add(*ch)
+	return ch
+}
+
+// handleTopicChange handles a channel_topic or channel_purpose message from
+// Slack, and notifies the client if the IRC topic changed.
+func handleTopicChange(ctx *IrcContext, message slack.Msg, isTopic bool) {
+	old := ctx.Channels.ByID(message.Channel)
+	if old == nil {
+		log.Warningf("Cannot get channel name for %v", message.Channel)
+		return
+	}
+	text := message.Purpose
+	if isTopic {
+		text = message.Topic
+	}
+	oldTopic := topicOf(old, ctx.topicMode())
+	setAt := slack.JSONTime(time.Now().Unix())
+	sec, _, _ := strings.Cut(message.Timestamp, ".")
+	if ts, err := strconv.ParseInt(sec, 10, 64); err == nil {
+		setAt = slack.JSONTime(ts)
+	}
+	ch := updateTopic(ctx, message.Channel, isTopic, text, message.User, setAt)
+	newTopic := topicOf(ch, ctx.topicMode())
+	if topicText(ctx, newTopic.Text) == topicText(ctx, oldTopic.Text) {
+		// either the change is not shown with this topic mode, or it was
+		// already sent by IrcTopicHandler
+		return
+	}
+	log.Infof("Got new topic for %s: %s", ch.IRCName(), newTopic.Text)
+	if _, err := ctx.Conn.Write([]byte(fmt.Sprintf(":%s!%s@%s TOPIC %s :%s\r\n", userNick(ctx, message.User), message.User, ctx.ServerName, ch.IRCName(), topicText(ctx, newTopic.Text)))); err != nil {
+		log.Warningf("Failed to send IRC message: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package ircslack
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+// routeTopic replies to conversations.setTopic and conversations.setPurpose,
+// and records the calls as "method channel text".
+func routeTopic(req *http.Request) (string, string, error) {
+	switch req.URL.Path {
+	case "/api/conversations.setTopic", "/api/conversations.setPurpose":
+		text := req.PostForm.Get("topic")
+		if req.URL.Path == "/api/conversations.setPurpose" {
+			text = req.PostForm.Get("purpose")
+		}
+		channel := req.PostForm.Get("channel")
+		return fmt.Sprintf("%s %s %s", req.URL.Path[len("/api/"):], channel, text), fmt.Sprintf(`{"ok": true, "channel": {"id": "%s"}}`, channel), nil
+	default:
+		return "", "", errUnsupportedURL(req)
+	}
+}
+
+func newTopicTestContext(mode string) (*IrcContext, *fakeConn, *fakeSlackAPI) {
+	ctx, conn, httpClient := newFakeSlackTestContext(routeTopic)
+	ctx.TopicMode = mode
+	ctx.Users.Add(slack.User{ID: "UBOB", Name: "bob"}, slack.User{ID: "UALICE", Name: "alice"})
+	general := Channel{IsChannel: true}
+	general.ID, general.Name, general.IsMember = "CGENERAL", "general", true
+	general.Topic = slack.Topic{Value: "Lunch at noon", Creator: "UBOB", LastSet: 1600000000}
+	general.Purpose = slack.Purpose{Value: "Company-wide\nannouncements", Creator: "UALICE", LastSet: 1500000000}
+	empty := Channel{IsChannel: true}
+	empty.ID, empty.Name, empty.IsMember = "CEMPTY", "empty", true
+	ctx.Channels.Add(general, empty)
+	return ctx, conn, httpClient
+}
+
+func TestTopicOf(t *testing.T) {
+	ctx, _, _ := newTopicTestContext("")
+	ch := ctx.Channels.ByID("CGENERAL")
+	assert.Equal(t, channelTopic{Text: "Lunch at noon", Setter: "UBOB", SetAt: 1600000000}, topicOf(ch, TopicModeTopic))
+	assert.Equal(t, channelTopic{Text: "Company-wide\nannouncements", Setter: "UALICE", SetAt: 1500000000}, topicOf(ch, TopicModePurpose))
+	assert.Equal(t, channelTopic{Text: "Lunch at noon | Company-wide\nannouncements", Setter: "UBOB", SetAt: 1600000000}, topicOf(ch, TopicModeBoth))
+
+	ch.Topic = slack.Topic{}
+	assert.Equal(t, channelTopic{Text: "Company-wide\nannouncements", Setter: "UALICE", SetAt: 1500000000}, topicOf(ch, TopicModeBoth))
+	assert.Equal(t, TopicModePurpose, ctx.topicMode())
+}
+
+func TestIrcTopicHandlerQuery(t *testing.T) {
+	ctx, conn, _ := newTopicTestContext(TopicModeTopic)
+	IrcTopicHandler(ctx, "", "TOPIC", []string{"#general"}, "")
+	assert.Equal(t,
+		":localhost 332 me #general :Lunch at noon\r\n"+
+			":localhost 333 me #general bob :1600000000\r\n",
+		conn.buf.String(),
+	)
+	conn.buf.Reset()
+
+	ctx.TopicMode = TopicModePurpose
+	IrcTopicHandler(ctx, "", "TOPIC", []string{"#general"}, "")
+	assert.Equal(t,
+		":localhost 332 me #general :Company-wide announcements\r\n"+
+			":localhost 333 me #general alice :1500000000\r\n",
+		conn.buf.String(),
+	)
+	conn.buf.Reset()
+
+	IrcTopicHandler(ctx, "", "TOPIC", []string{"#empty"}, "")
+	assert.Equal(t, ":localhost 331 me #empty :No topic is set\r\n", conn.buf.String())
+	conn.buf.Reset()
+
+	IrcTopicHandler(ctx, "", "TOPIC", []string{"#nonexistent"}, "")
+	assert.Equal(t, ":localhost 403 me #nonexistent :No such channel\r\n", conn.buf.String())
+}
+
+func TestIrcTopicHandlerSet(t *testing.T) {
+	ctx, conn, httpClient := newTopicTestContext(TopicModeBoth)
+	IrcTopicHandler(ctx, "", "TOPIC", []string{"#general"}, "Dinner at eight")
+	assert.Equal(t, []string{"conversations.setTopic CGENERAL Dinner at eight"}, httpClient.calls)
+	assert.Equal(t, ":me!UME@127.0.0.1 TOPIC #general :Dinner at eight | Company-wide announcements\r\n", conn.buf.String())
+	ch := ctx.Channels.ByID("CGENERAL")
+	assert.Equal(t, "Dinner at eight", ch.Topic.Value)
+	assert.Equal(t, "UME", ch.Topic.Creator)
+	conn.buf.Reset()
+
+	// the Slack event for the same change is not sent again
+	handleTopicChange(ctx, slack.Msg{Channel: "CGENERAL", User: "UME", Timestamp: "1700000000.000100", Topic: "Dinner at eight"}, true)
+	assert.Empty(t, conn.buf.String())
+
+	// the purpose is stripped from a topic edited as it was shown
+	IrcTopicHandler(ctx, "", "TOPIC", []string{"#general"}, "Dinner at nine | Company-wide announcements")
+	assert.Equal(t, "conversations.setTopic CGENERAL Dinner at nine", httpClient.calls[1])
+	assert.Equal(t, ":me!UME@127.0.0.1 TOPIC #general :Dinner at nine | Company-wide announcements\r\n", conn.buf.String())
+
+	ctx.TopicMode = TopicModePurpose
+	IrcTopicHandler(ctx, "", "TOPIC", []string{"#general"}, "Announcements only")
+	assert.Equal(t, "conversations.setPurpose CGENERAL Announcements only", httpClient.calls[2])
+}
+
+func TestHandleTopicChange(t *testing.T) {
+	ctx, conn, _ := newTopicTestContext(TopicModeTopic)
+	handleTopicChange(ctx, slack.Msg{Channel: "CGENERAL", User: "UALICE", Timestamp: "1700000000.000100", Topic: "New topic"}, true)
+	assert.Equal(t, ":alice!UALICE@localhost TOPIC #general :New topic\r\n", conn.buf.String())
+	assert.Equal(t, slack.Topic{Value: "New topic", Creator: "UALICE", LastSet: 1700000000}, ctx.Channels.ByID("CGENERAL").Topic)
+	conn.buf.Reset()
+
+	// purpose changes are not shown with the topic mode, but are cached
+	handleTopicChange(ctx, slack.Msg{Channel: "CGENERAL", User: "UBOB", Timestamp: "1700000001.000100", Purpose: "New purpose"}, false)
+	assert.Empty(t, conn.buf.String())
+	assert.Equal(t, "New purpose", ctx.Channels.ByID("CGENERAL").Purpose.Value)
+}
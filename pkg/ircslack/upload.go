@@ -0,0 +1,412 @@
+package ircslack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// MaxUploadSize is the maximum size of a file uploaded to Slack.
+const MaxUploadSize = 1 << 30
+
+// dccTimeout is the timeout of every read from a DCC connection.
+const dccTimeout = 30 * time.Second
+
+// uploadTarget is the conversation, and optionally the thread, that a file is
+// shared to.
+type uploadTarget struct {
+	// name is the IRC name of the target, used in notices
+	name      string
+	channelID string
+	threadTs  string
+}
+
+// resolveUploadTarget resolves an IRC channel, thread or nickname to the Slack
+// conversation that files are shared to. For nicknames, the direct message
+// conversation with the user is opened if needed.
+func (ic *IrcContext) resolveUploadTarget(name string) (*uploadTarget, error) {
+	if chName, ts, ok := SplitThreadName(name); ok {
+		ch := ic.Channels.ByName(chName)
+		if ch == nil {
+			return nil, fmt.Errorf("unknown channel for thread %s", name)
+		}
+		return &uploadTarget{name: name, channelID: ch.ID, threadTs: ts}, nil
+	}
+	if ch := ic.Channels.ByName(name); ch != nil {
+		return &uploadTarget{name: name, channelID: ch.ID}, nil
+	}
+	user := ic.lookupUser(name)
+	if user == nil {
+		return nil, fmt.Errorf("no such nick or channel: %s", name)
+	}
+	var ch *slack.Channel
+	err := ic.RateLimiter.Do(ic.Context(), "conversations.open", PriorityHigh, func(ctx context.Context) error {
+		var err error
+		ch, _, _, err = ic.SlackClient.OpenConversationContext(ctx, &slack.OpenConversationParameters{Users: []string{user.ID}})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open a conversation with %s: %w", name, err)
+	}
+	return &uploadTarget{name: name, channelID: ch.ID}, nil
+}
+
+// uploadFile shares a file to a Slack conversation, with an optional comment.
+// The file is read from the start on every attempt, so that the attempts that
+// are rate limited can be retried.
+func (ic *IrcContext) uploadFile(target *uploadTarget, r io.ReadSeeker, size int64, filename, comment string) error {
+	if size <= 0 {
+		return errors.New("cannot upload an empty file")
+	}
+	if size > MaxUploadSize {
+		return fmt.Errorf("file is too big (%s, maximum is %s)", formatSize(size), formatSize(MaxUploadSize))
+	}
+	return ic.RateLimiter.Do(ic.Context(), "files.completeUploadExternal", PriorityHigh, func(ctx context.Context) error {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := ic.SlackClient.UploadFileContext(ctx, slack.UploadFileParameters{
+			Reader:          r,
+			FileSize:        int(size),
+			Filename:        filename,
+			Title:           filename,
+			InitialComment:  comment,
+			Channel:         target.channelID,
+			ThreadTimestamp: target.threadTs,
+		})
+		return err
+	})
+}
+
+// openLocalFile opens a file in UploadDir. Paths can be relative to UploadDir
+// or absolute, but they cannot point outside of UploadDir.
+func (ic *IrcContext) openLocalFile(name string) (*os.File, error) {
+	if ic.UploadDir == "" {
+		return nil, errors.New("uploading local files is disabled")
+	}
+	if filepath.IsAbs(name) {
+		rel, err := filepath.Rel(ic.UploadDir, name)
+		if err != nil {
+			return nil, err
+		}
+		name = rel
+	}
+	root, err := os.OpenRoot(ic.UploadDir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Open(name)
+}
+
+// checkPublicAddr is a net.Dialer control function that refuses connections
+// to loopback, private and link-local addresses, so that UPLOAD cannot be used
+// to reach the host or the network of the gateway.
+func checkPublicAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// downloadToTemp downloads a URL to a temporary file, that the caller has to
+// remove. It returns the file name from the URL path. Only public addresses
+// are connected to, including on redirects.
+func (ic *IrcContext) downloadToTemp(u *url.URL) (*os.File, string, error) {
+	req, err := http.NewRequestWithContext(ic.Context(), "GET", u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !ic.allowPrivateURLs {
+		dialer.Control = checkPublicAddr
+	}
+	// no proxy is used, otherwise the address of the proxy would be checked
+	// instead of the destination
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("got %s", resp.Status)
+	}
+	tmp, err := os.CreateTemp("", "irc-slack-upload-*")
+	if err != nil {
+		return nil, "", err
+	}
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, MaxUploadSize+1))
+	if err == nil && n > MaxUploadSize {
+		err = fmt.Errorf("file is bigger than %s", formatSize(MaxUploadSize))
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, "", err
+	}
+	filename := path.Base(u.Path)
+	if filename == "/" || filename == "." {
+		filename = "upload"
+	}
+	return tmp, filename, nil
+}
+
+// IrcUploadHandler is called when an UPLOAD command is sent. The syntax is
+// `UPLOAD <target> <path or URL> [:comment]`, where the target is a channel, a
+// thread or a nickname. Local paths are relative to UploadDir, and URLs are
+// accepted only if UploadURLs is set. The upload happens in the background,
+// and its progress is reported with notices.
+func IrcUploadHandler(ctx *IrcContext, prefix, cmd string, args []string, trailing string) {
+	if len(args) != 2 {
+		// ERR_NEEDMOREPARAMS
+		if err := SendIrcNumeric(ctx, 461, ctx.Nick(), "UPLOAD :Not enough parameters"); err != nil {
+			log.Warningf("Failed to send IRC message: %v", err)
+		}
+		return
+	}
+	targetName, source, comment := args[0], args[1], trailing
+	ctx.goBackground(func() {
+		if err := uploadFromSource(ctx, targetName, source, comment); err != nil {
+			log.Warningf("Failed to upload %s to %s: %v", source, targetName, err)
+			ctx.SendNotice("Failed to upload %s to %s: %v", source, targetName, err)
+		}
+	})
+}
+
+// uploadFromSource uploads a local file or a URL to the given target.
+func uploadFromSource(ctx *IrcContext, targetName, source, comment string) error {
+	target, err := ctx.resolveUploadTarget(targetName)
+	if err != nil {
+		return err
+	}
+	var (
+		f        *os.File
+		filename string
+	)
+	if u, perr := url.Parse(source); perr == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if !ctx.UploadURLs {
+			return errors.New("uploading URLs is disabled")
+		}
+		ctx.SendNotice("Downloading %s", source)
+		f, filename, err = ctx.downloadToTemp(u)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+	} else {
+		f, err = ctx.openLocalFile(source)
+		if err != nil {
+			return err
+		}
+		filename = filepath.Base(source)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	ctx.SendNotice("Uploading %s (%s) to %s", filename, formatSize(fi.Size()), target.name)
+	if err := ctx.uploadFile(target, f, fi.Size(), filename, comment); err != nil {
+		return err
+	}
+	ctx.SendNotice("Uploaded %s to %s", filename, target.name)
+	return nil
+}
+
+// dccOffer is a DCC SEND offer, see
+// https://modern.ircdocs.horse/dcc.html#dcc-send .
+type dccOffer struct {
+	filename string
+	addr     string
+	size     int64
+}
+
+// parseDCCSend parses the arguments of a CTCP DCC SEND message, i.e. the text
+// after "DCC SEND ". File names with spaces have to be quoted.
+func parseDCCSend(text string) (*dccOffer, error) {
+	var filename string
+	if strings.HasPrefix(text, "\"") {
+		end := strings.Index(text[1:], "\"")
+		if end < 0 {
+			return nil, errors.New("unterminated file name")
+		}
+		filename = text[1 : end+1]
+		text = text[end+2:]
+	} else {
+		filename, text, _ = strings.Cut(text, " ")
+	}
+	fields := strings.Fields(text)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid DCC SEND: want filename, address, port and size")
+	}
+	var ip net.IP
+	if n, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+		ip = make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(n))
+	} else if ip = net.ParseIP(fields[0]); ip == nil {
+		return nil, fmt.Errorf("invalid DCC address %q", fields[0])
+	}
+	port, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DCC port %q", fields[1])
+	}
+	if port == 0 {
+		return nil, errors.New("passive DCC is not supported")
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid DCC file size %q", fields[2])
+	}
+	return &dccOffer{
+		filename: filepath.Base(filename),
+		addr:     net.JoinHostPort(ip.String(), strconv.Itoa(int(port))),
+		size:     size,
+	}, nil
+}
+
+// receiveDCC receives a file offered via DCC SEND into a temporary file, that
+// the caller has to remove. Progress is reported with notices. The offer must
+// come from the address of the client, so that DCC cannot be used to connect
+// to other hosts.
+func (ic *IrcContext) receiveDCC(offer *dccOffer) (*os.File, error) {
+	if offer.size > MaxUploadSize {
+		return nil, fmt.Errorf("file is too big (%s, maximum is %s)", formatSize(offer.size), formatSize(MaxUploadSize))
+	}
+	host, _, err := net.SplitHostPort(offer.addr)
+	if err != nil {
+		return nil, err
+	}
+	if remote, ok := ic.Conn.RemoteAddr().(*net.TCPAddr); !ok || !remote.IP.Equal(net.ParseIP(host)) {
+		return nil, fmt.Errorf("DCC address %s does not match the address of the client", host)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ic.Context(), "tcp", offer.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tmp, err := os.CreateTemp("", "irc-slack-dcc-*")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	var (
+		received int64
+		buf      = make([]byte, 32*1024)
+		ack      = make([]byte, 4)
+		reported int64
+	)
+	for received < offer.size {
+		if err := conn.SetReadDeadline(time.Now().Add(dccTimeout)); err != nil {
+			return fail(err)
+		}
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := tmp.Write(buf[:n]); werr != nil {
+				return fail(werr)
+			}
+			received += int64(n)
+			// acknowledge the bytes received so far, as a 32-bit
+			// counter
+			binary.BigEndian.PutUint32(ack, uint32(received))
+			if _, werr := conn.Write(ack); werr != nil {
+				return fail(werr)
+			}
+			// report the progress every 25%
+			if step := received * 100 / offer.size / 25 * 25; step > reported && received < offer.size {
+				reported = step
+				ic.SendNotice("Received %d%% of %s", step, offer.filename)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && received == offer.size {
+				break
+			}
+			return fail(fmt.Errorf("DCC transfer interrupted after %s: %w", formatSize(received), err))
+		}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return tmp, nil
+}
+
+// handleDCCSend receives a file offered via DCC SEND to a nickname or channel,
+// and uploads it to the corresponding Slack conversation.
+func handleDCCSend(ctx *IrcContext, targetName, text string) {
+	offer, err := parseDCCSend(text)
+	if err != nil {
+		ctx.SendNotice("Cannot accept DCC SEND: %v", err)
+		return
+	}
+	ctx.goBackground(func() {
+		err := func() error {
+			target, err := ctx.resolveUploadTarget(targetName)
+			if err != nil {
+				return err
+			}
+			ctx.SendNotice("Receiving %s (%s) for %s", offer.filename, formatSize(offer.size), target.name)
+			f, err := ctx.receiveDCC(offer)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			ctx.SendNotice("Uploading %s to %s", offer.filename, target.name)
+			if err := ctx.uploadFile(target, f, offer.size, offer.filename, ""); err != nil {
+				return err
+			}
+			ctx.SendNotice("Uploaded %s to %s", offer.filename, target.name)
+			return nil
+		}()
+		if err != nil {
+			log.Warningf("Failed to upload %s to %s: %v", offer.filename, targetName, err)
+			ctx.SendNotice("Failed to upload %s to %s: %v", offer.filename, targetName, err)
+		}
+	})
+}
+
+// formatSize formats a size in bytes in a human-readable form.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,253 @@
+package ircslack
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitThreadName(t *testing.T) {
+	ch, ts, ok := SplitThreadName("+my-channel-1234567890.123456")
+	require.True(t, ok)
+	assert.Equal(t, "my-channel", ch)
+	assert.Equal(t, "1234567890.123456", ts)
+
+	for _, name := range []string{"#general", "+general", "+general-", "+-1234"} {
+		_, _, ok := SplitThreadName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestParseDCCSend(t *testing.T) {
+	offer, err := parseDCCSend("report.pdf 2130706433 5000 1024")
+	require.NoError(t, err)
+	assert.Equal(t, &dccOffer{filename: "report.pdf", addr: "127.0.0.1:5000", size: 1024}, offer)
+
+	offer, err = parseDCCSend(`"my report.pdf" ::1 5000 10 token`)
+	require.NoError(t, err)
+	assert.Equal(t, &dccOffer{filename: "my report.pdf", addr: "[::1]:5000", size: 10}, offer)
+
+	// path components are stripped from file names
+	offer, err = parseDCCSend("../../etc/passwd 2130706433 5000 10")
+	require.NoError(t, err)
+	assert.Equal(t, "passwd", offer.filename)
+
+	for _, text := range []string{
+		"file 2130706433 5000",
+		"file 2130706433 0 10 token",
+		"file nowhere 5000 10",
+		"file 2130706433 99999 10",
+		"file 2130706433 5000 -1",
+		`"file 2130706433 5000 10`,
+	} {
+		_, err := parseDCCSend(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestReceiveDCC(t *testing.T) {
+	content := strings.Repeat("x", 100*1024)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	acked := make(chan uint32, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte(content))
+		// read acks until the whole file is acknowledged
+		ack := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(conn, ack); err != nil {
+				acked <- 0
+				return
+			}
+			if n := binary.BigEndian.Uint32(ack); n == uint32(len(content)) {
+				acked <- n
+				return
+			}
+		}
+	}()
+
+	ctx, conn := newMultilineTestContext()
+	offer := &dccOffer{filename: "file.txt", addr: ln.Addr().String(), size: int64(len(content))}
+	f, err := ctx.receiveDCC(offer)
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	assert.Equal(t, uint32(len(content)), <-acked)
+	assert.Contains(t, conn.buf.String(), ":localhost NOTICE me :Received 25% of file.txt\r\n")
+}
+
+func TestReceiveDCCOtherAddress(t *testing.T) {
+	ctx, _ := newMultilineTestContext()
+	// the client connects from 127.0.0.1
+	_, err := ctx.receiveDCC(&dccOffer{filename: "file.txt", addr: "192.0.2.1:5000", size: 10})
+	assert.EqualError(t, err, "DCC address 192.0.2.1 does not match the address of the client")
+}
+
+func TestCheckPublicAddr(t *testing.T) {
+	for _, addr := range []string{"93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:80"} {
+		assert.NoError(t, checkPublicAddr("tcp", addr, nil), addr)
+	}
+	for _, addr := range []string{
+		"127.0.0.1:80",
+		"[::1]:80",
+		"10.1.2.3:80",
+		"172.16.0.1:80",
+		"192.168.1.1:80",
+		"169.254.169.254:80",
+		"[fe80::1]:80",
+		"[fd00::1]:80",
+		"0.0.0.0:80",
+		"[::ffff:127.0.0.1]:80",
+	} {
+		assert.Error(t, checkPublicAddr("tcp", addr, nil), addr)
+	}
+}
+
+func newUploadTestServer(t *testing.T, calls *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls = append(*calls, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/conversations.open":
+			assert.Equal(t, "U1", r.FormValue("users"))
+			_, _ = w.Write([]byte(`{"ok": true, "channel": {"id": "D1"}}`))
+		case "/api/files.getUploadURLExternal":
+			assert.Equal(t, "hello.txt", r.FormValue("filename"))
+			assert.Equal(t, "5", r.FormValue("length"))
+			_, _ = w.Write([]byte(`{"ok": true, "upload_url": "http://` + r.Host + `/upload", "file_id": "F1"}`))
+		case "/upload":
+			w.WriteHeader(http.StatusOK)
+		case "/api/files.completeUploadExternal":
+			_, _ = w.Write([]byte(`{"ok": true, "files": [{"id": "F1", "title": "hello.txt"}]}`))
+		case "/files/hello.txt":
+			_, _ = w.Write([]byte("hello"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestUploadFromURL(t *testing.T) {
+	var calls []string
+	server := newUploadTestServer(t, &calls)
+	defer server.Close()
+
+	ctx, conn := newMultilineTestContext()
+	ctx.SlackClient = slack.New("test-token", slack.OptionAPIURL(server.URL+"/api/"))
+	ctx.Users.Add(slack.User{ID: "U1", Name: "bob"})
+	// URLs are refused unless enabled
+	assert.EqualError(t, uploadFromSource(ctx, "bob", server.URL+"/files/hello.txt", "look"), "uploading URLs is disabled")
+	// the test server listens on a loopback address
+	ctx.UploadURLs = true
+	err := uploadFromSource(ctx, "bob", server.URL+"/files/hello.txt", "look")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refusing to connect to non-public address 127.0.0.1")
+
+	calls = nil
+	ctx.allowPrivateURLs = true
+	require.NoError(t, uploadFromSource(ctx, "bob", server.URL+"/files/hello.txt", "look"))
+	assert.Equal(t, []string{
+		"/api/conversations.open",
+		"/files/hello.txt",
+		"/api/files.getUploadURLExternal",
+		"/upload",
+		"/api/files.completeUploadExternal",
+	}, calls)
+	assert.Contains(t, conn.buf.String(), ":localhost NOTICE me :Uploaded hello.txt to bob\r\n")
+}
+
+func TestUploadFromDir(t *testing.T) {
+	var calls []string
+	server := newUploadTestServer(t, &calls)
+	defer server.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0o644))
+	ctx, _ := newMultilineTestContext()
+	ctx.SlackClient = slack.New("test-token", slack.OptionAPIURL(server.URL+"/api/"))
+
+	// local files are refused unless an upload directory is set
+	require.Error(t, uploadFromSource(ctx, "#general", "hello.txt", ""))
+
+	ctx.UploadDir = dir
+	require.NoError(t, uploadFromSource(ctx, "+general-1234.5678", filepath.Join(dir, "hello.txt"), ""))
+	assert.Equal(t, []string{
+		"/api/files.getUploadURLExternal",
+		"/upload",
+		"/api/files.completeUploadExternal",
+	}, calls)
+
+	// files outside of the upload directory are refused
+	assert.Error(t, uploadFromSource(ctx, "#general", "../hello.txt", ""))
+	assert.Error(t, uploadFromSource(ctx, "#general", "/etc/passwd", ""))
+	assert.Error(t, uploadFromSource(ctx, "nobody", "hello.txt", ""))
+}
+
+func TestUploadFileRetry(t *testing.T) {
+	var uploads []string
+	completed := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/files.getUploadURLExternal":
+			_, _ = w.Write([]byte(`{"ok": true, "upload_url": "http://` + r.Host + `/upload", "file_id": "F1"}`))
+		case "/upload":
+			f, _, err := r.FormFile("file")
+			require.NoError(t, err)
+			data, err := io.ReadAll(f)
+			require.NoError(t, err)
+			uploads = append(uploads, string(data))
+		case "/api/files.completeUploadExternal":
+			completed++
+			if completed == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			_, _ = w.Write([]byte(`{"ok": true, "files": [{"id": "F1", "title": "hello.txt"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx, _ := newMultilineTestContext()
+	ctx.SlackClient = slack.New("test-token", slack.OptionAPIURL(server.URL+"/api/"))
+	ctx.RateLimiter = NewRateLimiter()
+	f, err := os.CreateTemp(t.TempDir(), "upload")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString("hello")
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, ctx.uploadFile(&uploadTarget{name: "#general", channelID: "C1"}, f, 5, "hello.txt", ""))
+	// the rate-limited attempt is retried with the whole file
+	assert.Equal(t, []string{"hello", "hello"}, uploads)
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", formatSize(512))
+	assert.Equal(t, "1.5 KiB", formatSize(1536))
+	assert.Equal(t, "1.0 GiB", formatSize(MaxUploadSize))
+	assert.Equal(t, "0 B", formatSize(0))
+}
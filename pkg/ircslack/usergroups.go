@@ -0,0 +1,88 @@
+package ircslack
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+// UserGroups wraps the user group list with convenient operations and cache.
+type UserGroups struct {
+	// RateLimiter schedules the requests to the Slack API. It should be
+	// shared with the other caches of the same Slack client
+	RateLimiter *RateLimiter
+	groups      map[string]slack.UserGroup
+	mu          sync.Mutex
+}
+
+// NewUserGroups creates a new UserGroups object.
+func NewUserGroups() *UserGroups {
+	return &UserGroups{
+		RateLimiter: NewRateLimiter(),
+		groups:      make(map[string]slack.UserGroup),
+	}
+}
+
+// Fetch retrieves all the user groups on a given Slack team. The Slack client
+// has to be valid and connected.
+func (g *UserGroups) Fetch(ctx context.Context, client *slack.Client) error {
+	var groups []slack.UserGroup
+	err := g.RateLimiter.Do(ctx, "usergroups.list", PriorityLow, func(ctx context.Context) error {
+		var err error
+		groups, err = client.GetUserGroupsContext(ctx, slack.GetUserGroupsOptionIncludeUsers(false))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Retrieved %d user groups", len(groups))
+	m := make(map[string]slack.UserGroup, len(groups))
+	for _, group := range groups {
+		m[group.ID] = group
+	}
+	g.mu.Lock()
+	g.groups = m
+	g.mu.Unlock()
+	return nil
+}
+
+// Update adds or replaces a user group in the cache, e.g. when Slack notifies
+// us that a user group was created or updated.
+func (g *UserGroups) Update(group slack.UserGroup) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.groups[group.ID] = group
+}
+
+// Count returns the number of user groups.
+func (g *UserGroups) Count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.groups)
+}
+
+// ByID retrieves a user group by its Slack ID.
+func (g *UserGroups) ByID(id string) *slack.UserGroup {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if group, ok := g.groups[id]; ok {
+		return &group
+	}
+	return nil
+}
+
+// ByHandle retrieves a user group by its handle, with or without the leading
+// "@". The comparison is case-insensitive.
+func (g *UserGroups) ByHandle(handle string) *slack.UserGroup {
+	handle = strings.TrimPrefix(handle, "@")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, group := range g.groups {
+		if strings.EqualFold(group.Handle, handle) {
+			return &group
+		}
+	}
+	return nil
+}
@@ -3,37 +3,240 @@ package ircslack
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/slack-go/slack"
 )
 
-// Users wraps the user list with convenient operations and cache.
+// Users wraps the user list with convenient operations and cache. Users are
+// indexed by Slack ID, Slack name, display name and IRC nickname.
 type Users struct {
-	users      map[string]slack.User
-	mu         sync.Mutex
-	pagination int
+	// RateLimiter schedules the requests to the Slack API. It should be
+	// shared with the other caches of the same Slack client
+	RateLimiter *RateLimiter
+	users       map[string]slack.User
+	mu          sync.RWMutex
+	pagination  int
+	nickPolicy  string
+	// byName maps case-folded Slack names to user IDs. Slack names are unique
+	// within a team.
+	byName map[string]string
+	// byDisplayName maps case-folded display names to the sorted IDs of the
+	// users using them, since display names are not unique.
+	byDisplayName map[string][]string
+	// nicks maps user IDs to their IRC nicknames, and byNick maps case-folded
+	// IRC nicknames back to user IDs.
+	nicks  map[string]string
+	byNick map[string]string
+	// bases maps user IDs to the nicknames derived from the nick policy,
+	// which are used to resolve collisions.
+	bases map[string]string
 }
 
 // NewUsers creates a new Users object.
 func NewUsers(pagination int) *Users {
 	return &Users{
-		users:      make(map[string]slack.User),
-		pagination: pagination,
+		RateLimiter:   NewRateLimiter(),
+		users:         make(map[string]slack.User),
+		pagination:    pagination,
+		nickPolicy:    NickPolicyUsername,
+		byName:        make(map[string]string),
+		byDisplayName: make(map[string][]string),
+		nicks:         make(map[string]string),
+		byNick:        make(map[string]string),
+		bases:         make(map[string]string),
 	}
 }
 
+// insertSorted inserts an ID in a sorted list of IDs, unless already present.
+func insertSorted(ids []string, id string) []string {
+	idx := sort.SearchStrings(ids, id)
+	if idx < len(ids) && ids[idx] == id {
+		return ids
+	}
+	ids = append(ids, "")
+	copy(ids[idx+1:], ids[idx:])
+	ids[idx] = id
+	return ids
+}
+
+// removeSorted removes an ID from a sorted list of IDs, if present.
+func removeSorted(ids []string, id string) []string {
+	idx := sort.SearchStrings(ids, id)
+	if idx < len(ids) && ids[idx] == id {
+		return append(ids[:idx], ids[idx+1:]...)
+	}
+	return ids
+}
+
+// indexNames adds a user to the name indexes. The caller must hold the lock.
+func (u *Users) indexNames(user *slack.User) {
+	if user.Name != "" {
+		u.byName[foldCase(user.Name)] = user.ID
+	}
+	if user.Profile.DisplayName != "" {
+		key := foldCase(user.Profile.DisplayName)
+		u.byDisplayName[key] = insertSorted(u.byDisplayName[key], user.ID)
+	}
+}
+
+// unindexNames removes a user from the name indexes. The caller must hold the
+// lock.
+func (u *Users) unindexNames(user *slack.User) {
+	if key := foldCase(user.Name); u.byName[key] == user.ID {
+		delete(u.byName, key)
+	}
+	if user.Profile.DisplayName != "" {
+		key := foldCase(user.Profile.DisplayName)
+		if ids := removeSorted(u.byDisplayName[key], user.ID); len(ids) > 0 {
+			u.byDisplayName[key] = ids
+		} else {
+			delete(u.byDisplayName, key)
+		}
+	}
+}
+
+// SetNickPolicy sets the policy used to derive IRC nicknames from Slack users,
+// see NickPolicies, and recomputes the nicknames of the known users.
+func (u *Users) SetNickPolicy(policy string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.nickPolicy = policy
+	u.reindex()
+}
+
+// NickChange describes the change of a user's IRC nickname.
+type NickChange struct {
+	UserID  string
+	OldNick string
+	NewNick string
+}
+
+// Add adds or replaces users in the cache, e.g. when Slack notifies us that a
+// user has changed, and updates their nicknames. It returns the nickname
+// changes of the users that were already known, which include the ones of
+// other users whose nickname collisions were resolved differently.
+func (u *Users) Add(users ...slack.User) []NickChange {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.addAll(users)
+}
+
+// addAll adds users to the cache, and reassigns the nicknames if any derived
+// nickname changed. The caller must hold the lock.
+func (u *Users) addAll(users []slack.User) []NickChange {
+	changed := false
+	for _, user := range users {
+		if u.add(user) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return u.assignNicks()
+}
+
+// add adds a user to the cache and updates the name indexes. It returns true
+// if the nickname derived for the user changed, in which case the nicknames
+// have to be reassigned. The caller must hold the lock.
+func (u *Users) add(user slack.User) bool {
+	if old, ok := u.users[user.ID]; ok {
+		u.unindexNames(&old)
+	}
+	u.users[user.ID] = user
+	u.indexNames(&user)
+	base := DeriveNick(&user, u.nickPolicy)
+	if oldBase, known := u.bases[user.ID]; known && oldBase == base {
+		return false
+	}
+	u.bases[user.ID] = base
+	return true
+}
+
+// assignNicks assigns the nicknames of all the users. Every derived nickname
+// goes to the user with the lowest ID among the ones sharing it, while the
+// others get a suffix based on their ID. Derived nicknames are assigned first,
+// so a suffixed nickname never takes the derived nickname of another user, and
+// every nickname is checked against all the ones assigned before, case-folded,
+// so the result is unique and does not depend on the order in which users are
+// added. It returns the nickname changes of the users that already had one.
+// The caller must hold the lock.
+func (u *Users) assignNicks() []NickChange {
+	ids := make([]string, 0, len(u.bases))
+	for id := range u.bases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	nicks := make(map[string]string, len(ids))
+	byNick := make(map[string]string, len(ids))
+	assign := func(id, nick string) {
+		nicks[id] = nick
+		byNick[foldCase(nick)] = id
+	}
+	taken := func(nick string) bool {
+		_, ok := byNick[foldCase(nick)]
+		return ok
+	}
+	var collided []string
+	for _, id := range ids {
+		if taken(u.bases[id]) {
+			collided = append(collided, id)
+			continue
+		}
+		assign(id, u.bases[id])
+	}
+	for _, id := range collided {
+		base := u.bases[id]
+		nick := disambiguateNick(base, id, false)
+		if taken(nick) {
+			nick = disambiguateNick(base, id, true)
+		}
+		// only possible if another user's nickname looks like a suffixed
+		// one, e.g. "bob|U1234"
+		for n := 2; taken(nick); n++ {
+			nick = disambiguateNick(base, fmt.Sprintf("%s-%d", id, n), true)
+		}
+		assign(id, nick)
+	}
+	var changes []NickChange
+	for _, id := range ids {
+		if old := u.nicks[id]; old != "" && old != nicks[id] {
+			changes = append(changes, NickChange{UserID: id, OldNick: old, NewNick: nicks[id]})
+		}
+	}
+	u.nicks = nicks
+	u.byNick = byNick
+	return changes
+}
+
+// reindex rebuilds the name and nick indexes from scratch. The caller must
+// hold the lock.
+func (u *Users) reindex() {
+	u.byName = make(map[string]string, len(u.users))
+	u.byDisplayName = make(map[string][]string)
+	u.nicks = make(map[string]string, len(u.users))
+	u.bases = make(map[string]string, len(u.users))
+	for id, user := range u.users {
+		u.indexNames(&user)
+		u.bases[id] = DeriveNick(&user, u.nickPolicy)
+	}
+	u.assignNicks()
+}
+
 // FetchByIDs fetches the users with the specified IDs and updates the internal
-// user mapping.
-func (u *Users) FetchByIDs(client *slack.Client, skipCache bool, userIDs ...string) ([]slack.User, error) {
+// user mapping. Like Add, it also returns the nickname changes of the users
+// that were already known, even if it fails.
+func (u *Users) FetchByIDs(ctx context.Context, client *slack.Client, skipCache bool, userIDs ...string) ([]slack.User, []NickChange, error) {
 	var (
 		toRetrieve       []string
 		alreadyRetrieved []slack.User
 	)
 
 	if !skipCache {
-		u.mu.Lock()
+		u.mu.RLock()
 		for _, uid := range userIDs {
 			if u, ok := u.users[uid]; !ok {
 				toRetrieve = append(toRetrieve, uid)
@@ -41,58 +244,48 @@ func (u *Users) FetchByIDs(client *slack.Client, skipCache bool, userIDs ...stri
 				alreadyRetrieved = append(alreadyRetrieved, u)
 			}
 		}
-		u.mu.Unlock()
+		u.mu.RUnlock()
 		log.Debugf("Fetching information for %d users out of %d (%d already in cache)", len(toRetrieve), len(userIDs), len(userIDs)-len(toRetrieve))
 	} else {
 		toRetrieve = userIDs
 	}
 	chunkSize := 1000
 	allFetchedUsers := make([]slack.User, 0, len(userIDs))
+	var changes []NickChange
 	for i := 0; i < len(toRetrieve); i += chunkSize {
 		upperLimit := i + chunkSize
 		if upperLimit > len(toRetrieve) {
 			upperLimit = len(toRetrieve)
 		}
-		for {
-			attempt := 0
-			if attempt >= MaxSlackAPIAttempts {
-				return nil, fmt.Errorf("Users.FetchByIDs: exceeded the maximum number of attempts (%d) with the Slack API", MaxSlackAPIAttempts)
-			}
-			log.Debugf("Fetching %d users of %d, attempt %d of %d", len(toRetrieve), len(userIDs), attempt+1, MaxSlackAPIAttempts)
-			slackUsers, err := client.GetUsersInfo(toRetrieve[i:upperLimit]...)
-			if err != nil {
-				if rlErr, ok := err.(*slack.RateLimitedError); ok {
-					// we were rate-limited. Let's wait the recommended delay
-					log.Warningf("Hit Slack API rate limiter. Waiting %v", rlErr.RetryAfter)
-					time.Sleep(rlErr.RetryAfter)
-					attempt++
-					continue
-				}
-				return nil, err
-			}
-			if len(*slackUsers) != len(toRetrieve[i:upperLimit]) {
-				log.Warningf("Tried to fetch %d users but only got %d", len(toRetrieve[i:upperLimit]), len(*slackUsers))
-			}
-			allFetchedUsers = append(allFetchedUsers, *slackUsers...)
-			// also update the local users map
-			u.mu.Lock()
-			for _, user := range *slackUsers {
-				u.users[user.ID] = user
-			}
-			u.mu.Unlock()
-			break
+		log.Debugf("Fetching %d users of %d", upperLimit-i, len(userIDs))
+		var slackUsers *[]slack.User
+		err := u.RateLimiter.Do(ctx, "users.info", PriorityLow, func(ctx context.Context) error {
+			var err error
+			slackUsers, err = client.GetUsersInfoContext(ctx, toRetrieve[i:upperLimit]...)
+			return err
+		})
+		if err != nil {
+			return nil, changes, fmt.Errorf("Users.FetchByIDs: %w", err)
 		}
+		if len(*slackUsers) != len(toRetrieve[i:upperLimit]) {
+			log.Warningf("Tried to fetch %d users but only got %d", len(toRetrieve[i:upperLimit]), len(*slackUsers))
+		}
+		allFetchedUsers = append(allFetchedUsers, *slackUsers...)
+		// also update the local users map
+		u.mu.Lock()
+		changes = append(changes, u.addAll(*slackUsers)...)
+		u.mu.Unlock()
 	}
 	allUsers := append(alreadyRetrieved, allFetchedUsers...)
 	if len(userIDs) != len(allUsers) {
-		return allFetchedUsers, fmt.Errorf("Found %d users but %d were requested", len(allUsers), len(userIDs))
+		return allFetchedUsers, changes, fmt.Errorf("Found %d users but %d were requested", len(allUsers), len(userIDs))
 	}
-	return allUsers, nil
+	return allUsers, changes, nil
 }
 
 // Fetch retrieves all the users on a given Slack team. The Slack client has to
 // be valid and connected.
-func (u *Users) Fetch(client *slack.Client) ([]slack.User, error) {
+func (u *Users) Fetch(ctx context.Context, client *slack.Client) ([]slack.User, error) {
 	log.Infof("Fetching all users, might take a while on large Slack teams")
 	var opts []slack.GetUsersOption
 	if u.pagination > 0 {
@@ -102,27 +295,26 @@ func (u *Users) Fetch(client *slack.Client) ([]slack.User, error) {
 	up := client.GetUsersPaginated(opts...)
 	var (
 		err   error
-		ctx   = context.Background()
 		users = make(map[string]slack.User)
 	)
 	start := time.Now()
 	var allFetchedUsers []slack.User
-	for err == nil {
-		up, err = up.Next(ctx)
-		if err == nil {
-			log.Debugf("Retrieved %d users (current total is %d)", len(up.Users), len(users))
-			for _, u := range up.Users {
-				users[u.ID] = u
-			}
-			allFetchedUsers = append(allFetchedUsers, up.Users...)
-		} else if rateLimitedError, ok := err.(*slack.RateLimitedError); ok {
-			select {
-			case <-ctx.Done():
-				err = ctx.Err()
-			case <-time.After(rateLimitedError.RetryAfter):
-				err = nil
-			}
+	for {
+		var next slack.UserPagination
+		err = u.RateLimiter.Do(ctx, "users.list", PriorityLow, func(ctx context.Context) error {
+			var err error
+			next, err = up.Next(ctx)
+			return err
+		})
+		if err != nil {
+			break
+		}
+		up = next
+		log.Debugf("Retrieved %d users (current total is %d)", len(up.Users), len(users))
+		for _, u := range up.Users {
+			users[u.ID] = u
 		}
+		allFetchedUsers = append(allFetchedUsers, up.Users...)
 	}
 	log.Infof("Retrieved %d users in %s", len(users), time.Since(start))
 	err = up.Failure(err)
@@ -131,50 +323,102 @@ func (u *Users) Fetch(client *slack.Client) ([]slack.User, error) {
 	}
 	u.mu.Lock()
 	u.users = users
+	u.reindex()
 	u.mu.Unlock()
 	return allFetchedUsers, nil
 }
 
+// AsMap returns the users as a map of ID -> user. The map is copied to avoid
+// data races
+func (u *Users) AsMap() map[string]slack.User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	ret := make(map[string]slack.User, len(u.users))
+	for k, v := range u.users {
+		ret[k] = v
+	}
+	return ret
+}
+
 // Count returns the number of users. This method must be called after `Fetch`.
 func (u *Users) Count() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	return len(u.users)
 }
 
 // ByID retrieves a user by its Slack ID.
 func (u *Users) ByID(id string) *slack.User {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	for _, u := range u.users {
-		if u.ID == id {
-			return &u
-		}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if user, ok := u.users[id]; ok {
+		return &user
 	}
 	return nil
 }
 
 // ByName retrieves a user by its Slack name.
 func (u *Users) ByName(name string) *slack.User {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	for _, u := range u.users {
-		if u.Name == name {
-			return &u
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if id, ok := u.byName[foldCase(name)]; ok {
+		if user := u.users[id]; user.Name == name {
+			return &user
 		}
 	}
 	return nil
 }
 
-// IDsToNames returns a list of user names from the given IDs. The
+// ByNameOrDisplayName retrieves a user by its Slack name or display name. The
+// comparison is case-insensitive, and names take precedence over display
+// names. If several users have the same display name, the one with the lowest
+// ID is returned.
+func (u *Users) ByNameOrDisplayName(name string) *slack.User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	key := foldCase(name)
+	if id, ok := u.byName[key]; ok {
+		user := u.users[id]
+		return &user
+	}
+	if ids := u.byDisplayName[key]; len(ids) > 0 {
+		user := u.users[ids[0]]
+		return &user
+	}
+	return nil
+}
+
+// ByNick retrieves a user by its IRC nickname. The comparison is
+// case-insensitive.
+func (u *Users) ByNick(nick string) *slack.User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if id, ok := u.byNick[foldCase(nick)]; ok {
+		user := u.users[id]
+		return &user
+	}
+	return nil
+}
+
+// NickByID returns the IRC nickname of a user, or an empty string if the user
+// is unknown.
+func (u *Users) NickByID(id string) string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.nicks[id]
+}
+
+// IDsToNames returns a list of IRC nicknames from the given IDs. The
 // returned list could be shorter if there are invalid user IDs.
 // Warning: this method is probably only useful for NAMES commands
 // where a non-exact mapping is acceptable.
 func (u *Users) IDsToNames(userIDs ...string) []string {
-	u.mu.Lock()
-	defer u.mu.Unlock()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	names := make([]string, 0)
 	for _, uid := range userIDs {
-		if u, ok := u.users[uid]; ok {
-			names = append(names, u.Name)
+		if _, ok := u.users[uid]; ok {
+			names = append(names, u.nicks[uid])
 		} else {
 			log.Warningf("IDsToNames: unknown user ID %s", uid)
 		}
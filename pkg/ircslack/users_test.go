@@ -2,6 +2,7 @@ package ircslack
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -50,6 +51,16 @@ func (c fakeSlackHTTPClient) Do(req *http.Request) (*http.Response, error) {
 			ProtoMinor: 1,
 			Body:       ioutil.NopCloser(bytes.NewBuffer(data)),
 		}, nil
+	case "/api/users.info":
+		data := []byte(`{"ok": true, "users": [{"id": "UAAAA", "name": "insomniac"}]}`)
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(data)),
+		}, nil
 	default:
 		return nil, fmt.Errorf("testing: http client URL not supported: %s", req.URL)
 	}
@@ -58,16 +69,31 @@ func (c fakeSlackHTTPClient) Do(req *http.Request) (*http.Response, error) {
 func TestUsersFetch(t *testing.T) {
 	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClient{}))
 	users := NewUsers(10)
-	fetched, err := users.Fetch(client)
+	fetched, err := users.Fetch(context.Background(), client)
 	require.NoError(t, err)
 	assert.Equal(t, 1, users.Count())
 	assert.Equal(t, 1, len(fetched))
 }
 
+func TestUsersFetchByIDsNickChanges(t *testing.T) {
+	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClient{}))
+	users := NewUsers(0)
+	users.Add(slack.User{ID: "UABCD", Name: "insomniac"})
+	fetched, changes, err := users.FetchByIDs(context.Background(), client, false, "UAAAA")
+	require.NoError(t, err)
+	assert.Len(t, fetched, 1)
+	// the fetched user has a lower ID, and takes the nickname
+	assert.Equal(t, "insomniac", users.NickByID("UAAAA"))
+	require.Len(t, changes, 1)
+	assert.Equal(t, "UABCD", changes[0].UserID)
+	assert.Equal(t, "insomniac", changes[0].OldNick)
+	assert.Equal(t, users.NickByID("UABCD"), changes[0].NewNick)
+}
+
 func TestUsersById(t *testing.T) {
 	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClient{}))
 	users := NewUsers(10)
-	_, err := users.Fetch(client)
+	_, err := users.Fetch(context.Background(), client)
 	require.NoError(t, err)
 	u := users.ByID("UABCD")
 	require.NotNil(t, u)
@@ -78,7 +104,7 @@ func TestUsersById(t *testing.T) {
 func TestUsersByName(t *testing.T) {
 	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClient{}))
 	users := NewUsers(10)
-	_, err := users.Fetch(client)
+	_, err := users.Fetch(context.Background(), client)
 	require.NoError(t, err)
 	u := users.ByName("insomniac")
 	require.NotNil(t, u)
@@ -89,8 +115,113 @@ func TestUsersByName(t *testing.T) {
 func TestUsersIDsToNames(t *testing.T) {
 	client := slack.New("test-token", slack.OptionHTTPClient(fakeSlackHTTPClient{}))
 	users := NewUsers(10)
-	_, err := users.Fetch(client)
+	_, err := users.Fetch(context.Background(), client)
 	require.NoError(t, err)
 	names := users.IDsToNames("UABCD")
 	assert.Equal(t, []string{"insomniac"}, names)
 }
+
+func TestUsersAddRename(t *testing.T) {
+	users := NewUsers(0)
+	users.Add(slack.User{ID: "U1", Name: "alice", Profile: slack.UserProfile{DisplayName: "Ali"}})
+	users.Add(slack.User{ID: "U1", Name: "alice2", Profile: slack.UserProfile{DisplayName: "Al"}})
+	assert.Equal(t, 1, users.Count())
+	assert.Nil(t, users.ByName("alice"))
+	assert.Nil(t, users.ByNameOrDisplayName("ali"))
+	u := users.ByName("alice2")
+	require.NotNil(t, u)
+	assert.Equal(t, "U1", u.ID)
+	u = users.ByNameOrDisplayName("AL")
+	require.NotNil(t, u)
+	assert.Equal(t, "U1", u.ID)
+}
+
+func TestUsersByNameOrDisplayName(t *testing.T) {
+	users := NewUsers(0)
+	users.Add(
+		slack.User{ID: "U3", Name: "bob", Profile: slack.UserProfile{DisplayName: "Robert"}},
+		slack.User{ID: "U2", Name: "bobby", Profile: slack.UserProfile{DisplayName: "Robert"}},
+		slack.User{ID: "U1", Name: "robert"},
+	)
+	// names take precedence over display names
+	u := users.ByNameOrDisplayName("Robert")
+	require.NotNil(t, u)
+	assert.Equal(t, "U1", u.ID)
+	// the lowest ID wins among equal display names
+	users.Add(slack.User{ID: "U1", Name: "rob"})
+	u = users.ByNameOrDisplayName("robert")
+	require.NotNil(t, u)
+	assert.Equal(t, "U2", u.ID)
+	// ByName is case-sensitive
+	assert.Nil(t, users.ByName("Bob"))
+}
+
+func newBenchmarkUsers(n int) *Users {
+	users := NewUsers(0)
+	batch := make([]slack.User, 0, n)
+	for i := 0; i < n; i++ {
+		batch = append(batch, slack.User{
+			ID:      fmt.Sprintf("U%08d", i),
+			Name:    fmt.Sprintf("user%d", i),
+			Profile: slack.UserProfile{DisplayName: fmt.Sprintf("User %d", i)},
+		})
+	}
+	users.Add(batch...)
+	return users
+}
+
+func BenchmarkUsersByID(b *testing.B) {
+	for _, n := range []int{100, 20000} {
+		users := newBenchmarkUsers(n)
+		id := fmt.Sprintf("U%08d", n-1)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if users.ByID(id) == nil {
+					b.Fatal("user not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUsersByName(b *testing.B) {
+	for _, n := range []int{100, 20000} {
+		users := newBenchmarkUsers(n)
+		name := fmt.Sprintf("user%d", n-1)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if users.ByName(name) == nil {
+					b.Fatal("user not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUsersByNick(b *testing.B) {
+	for _, n := range []int{100, 20000} {
+		users := newBenchmarkUsers(n)
+		nick := fmt.Sprintf("user%d", n-1)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if users.ByNick(nick) == nil {
+					b.Fatal("user not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUsersByNameOrDisplayName(b *testing.B) {
+	for _, n := range []int{100, 20000} {
+		users := newBenchmarkUsers(n)
+		name := fmt.Sprintf("user %d", n-1)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if users.ByNameOrDisplayName(name) == nil {
+					b.Fatal("user not found")
+				}
+			}
+		})
+	}
+}